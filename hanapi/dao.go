@@ -2,15 +2,50 @@ package hanapi
 
 // DatabaseInterface - a generic interface for database queries
 type DatabaseInterface interface {
-	GetRegions() []Location
-	AddRegion(lat float64, lng float64)
+	GetRegions() []Region
+	GetRegionByID(id string) (*Region, error)
+	GetNearestRegion(lat float64, lng float64) *Region
+	GetRegionsWithin(lat float64, lng float64, radius float64) []Region
+	AddRegion(region Region) error
+	UpdateRegion(region Region) error
+	DeleteRegion(id string) error
 	AddImage(image ImageData)
 	AddBulkImagesToRegion(images []ImageData, region *Location)
 	GetImages(lat float64, lng float64, start int, end int) []ImageData
 	GetAllImages() []ImageData
+	// whether a visible image has this image or thumbnail URL
+	HasImageURL(url string) bool
 	SoftDelete(id string, reason string)
 	DeleteOldImages(amount int)
+	// cursors store how far a collector has collected within a region's cell
+	GetCursor(collector string, region string, cell string) string
+	SetCursor(collector string, region string, cell string, cursor string)
+	// queries are recorded so that quotas are shared between processes,
+	// acquiring is atomic so that they can't exceed the limit together
+	AcquireQuery(key string, time int64, since int64, limit int) bool
+	ReleaseQuery(key string, time int64)
+	CountQueries(key string, since int64) int
+	// the provider's own view of the quota, remaining is -1 if unknown
+	GetProviderQuota(key string) (remaining int, reset int64)
+	SetProviderQuota(key string, remaining int, reset int64)
+	TakeProviderQuota(key string, now int64) bool
 	Size() int
+	// used by the admin dashboard, counts exclude hidden images
+	CountImagesByRegion() map[Location]int
+	// reports are kept until they're moderated, see `ReportImage`. HasImage
+	// includes hidden images but not deleted ones
+	HasImage(id string) bool
+	AddReport(report Report)
+	CountReporters(imageID string) int
+	GetReportedImages(limit int) []ReportedImage
+	ResolveReports(imageID string, status string) int
+	RestoreImage(id string) error
+	DeleteImage(id string) error
+	AddModerationDecision(decision ModerationDecision)
+	GetModerationDecisions(limit int) []ModerationDecision
+	// used by readiness checks, EnsureIndexes is safe to call repeatedly
+	Ping() error
+	EnsureIndexes() error
 	Copy() DatabaseInterface
 	Close()
 }
@@ -1,14 +1,13 @@
 package hanapi
 
 import (
-	"fmt"
-	"github.com/kellydunn/golang-geo"
 	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"go.opentelemetry.io/otel/attribute"
 	"math"
 	"sort"
 )
 
-// RegionSize is radius of a region in meters
+// RegionSize is the default radius of a region in meters
 const RegionSize = 5000
 
 // ContainsRegion - determines whether a point is within a specific region
@@ -16,30 +15,62 @@ func ContainsRegion(db DatabaseInterface, lat float64, lng float64) bool {
 	return GetRegion(db, lat, lng) != nil
 }
 
-// GetRegion - returns the region which the specified lat, lng lies in
-func GetRegion(db DatabaseInterface, lat float64, lng float64) *Location {
-	regions := db.GetRegions()
-	currentPoint := geo.NewPoint(lat, lng)
-	// loop through each region and return the first one that the point is
-	// enclosed in
+// GetRegion - returns the region which the specified lat, lng lies in. If
+// regions overlap then the region with the closest centre is returned
+func GetRegion(db DatabaseInterface, lat float64, lng float64) *Region {
+	db, span := startSpan(db, "GetRegion")
+	defer span.End()
+	// only regions within the largest possible radius could contain the point
+	regions := db.GetRegionsWithin(lat, lng, MaxRegionSize)
+	// these are sorted by distance so return the first one that the point
+	// is enclosed in
 	for _, r := range regions {
-		p := geo.NewPoint(r.Lat, r.Lng)
-		if p.GreatCircleDistance(currentPoint) <= RegionSize/1000 {
+		if r.Contains(lat, lng) {
 			return &r
 		}
 	}
 	return nil
 }
 
+// GetNearestRegion - returns the region whose centre is closest to the
+// specified lat, lng regardless of whether it lies within the region
+func GetNearestRegion(db DatabaseInterface, lat float64, lng float64) *Region {
+	return db.GetNearestRegion(lat, lng)
+}
+
+// GetRegionsWithin - returns the regions whose centre is within `radius`
+// meters of the specified lat, lng sorted by distance
+func GetRegionsWithin(db DatabaseInterface, lat float64, lng float64,
+	radius float64) []Region {
+	return db.GetRegionsWithin(lat, lng, radius)
+}
+
 // GetRegions - returns the currently used regions
-func GetRegions(db DatabaseInterface) []Location {
+func GetRegions(db DatabaseInterface) []Region {
 	return db.GetRegions()
 }
 
+// GetRegionStats - returns each region with the amount of images stored in it
+func GetRegionStats(db DatabaseInterface) []RegionStats {
+	db, span := startSpan(db, "GetRegionStats")
+	defer span.End()
+	counts := db.CountImagesByRegion()
+	stats := []RegionStats{}
+	for _, r := range db.GetRegions() {
+		stats = append(stats, RegionStats{Region: r, ImageCount: counts[*r.Location()]})
+	}
+	return stats
+}
+
 // AddRegion - adds a new region for image population
 func AddRegion(db DatabaseInterface, lat float64, lng float64) {
+	db, span := startSpan(db, "AddRegion")
+	defer span.End()
 	if !ContainsRegion(db, lat, lng) {
-		db.AddRegion(lat, lng)
+		err := db.AddRegion(*NewRegion("", lat, lng, RegionSize))
+		if err != nil {
+			logError(err)
+		}
 	}
 }
 
@@ -65,6 +96,9 @@ func GetImagesWithEnd(db DatabaseInterface, lat float64, lng float64,
 // @param end - end is optional, use -1 to signify no value
 func GetImagesWithRange(db DatabaseInterface, lat float64, lng float64,
 	start int, end int) []ImageData {
+	db, span := startSpan(db, "GetImagesWithRange",
+		attribute.Int("start", start), attribute.Int("end", end))
+	defer span.End()
 	// 100 images will be sorted at a time
 	return getImagesWithRangeAndSampleSize(db, lat, lng, start, end, 100)
 }
@@ -159,17 +193,9 @@ func getRange(sampleSize int, start int, end int) (int, int) {
 	return startSort, endSort
 }
 
-// ReportImage - report an image to be removed
-// @param id - the image ID which should match one in ImageData
-// @param reason - reason for reporting
-// @param logger - optional logging functionality
-func ReportImage(db DatabaseInterface, id string, reason string,
-	logger reporting.Logger) {
-	db.SoftDelete(id, reason)
-	// notify through Slack bot
-	message := fmt.Sprintf("Image %s reported because: %s", id, reason)
-	fmt.Println(message)
-	if logger != nil {
-		logger.Log(message)
-	}
+// logError reports database errors that aren't returned to the caller
+func logError(err error) {
+	reporting.Default().Log(reporting.Error, err.Error(), reporting.Fields{
+		"component": "database",
+	})
 }
@@ -1,28 +1,96 @@
 package hanapi
 
 import (
+	"context"
 	"github.com/kellydunn/golang-geo"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"math"
 	"reflect"
+	"sort"
 	"testing"
 )
 
 type MockDB struct {
-	regions []Location
-	images  []ImageData
+	regions   []Region
+	images    []ImageData
+	hidden    map[string]bool
+	purged    map[string]bool
+	reports   []Report
+	decisions []ModerationDecision
 }
 
-func NewMockDB(regions []Location, images []ImageData) *MockDB {
+func NewMockDB(regions []Region, images []ImageData) *MockDB {
 	c := new(MockDB)
 	c.regions = regions
 	c.images = images
+	c.hidden = map[string]bool{}
+	c.purged = map[string]bool{}
 	return c
 }
 
-func (c *MockDB) GetRegions() []Location {
+func (c *MockDB) GetRegions() []Region {
 	return c.regions
 }
 
-func (c *MockDB) AddRegion(lat float64, lng float64) {
+func (c *MockDB) GetRegionByID(id string) (*Region, error) {
+	for _, r := range c.regions {
+		if r.ID.Hex() == id {
+			return &r, nil
+		}
+	}
+	return nil, ErrRegionNotFound
+}
+
+func (c *MockDB) GetNearestRegion(lat float64, lng float64) *Region {
+	regions := c.GetRegionsWithin(lat, lng, math.MaxFloat64)
+	if len(regions) == 0 {
+		return nil
+	}
+	return &regions[0]
+}
+
+func (c *MockDB) GetRegionsWithin(lat float64, lng float64, radius float64) []Region {
+	p := geo.NewPoint(lat, lng)
+	distance := func(r Region) float64 {
+		return p.GreatCircleDistance(geo.NewPoint(r.Lat, r.Lng)) * 1000
+	}
+	regions := []Region{}
+	for _, r := range c.regions {
+		if distance(r) <= radius {
+			regions = append(regions, r)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return distance(regions[i]) < distance(regions[j])
+	})
+	return regions
+}
+
+func (c *MockDB) AddRegion(region Region) error {
+	c.regions = append(c.regions, region)
+	return nil
+}
+
+func (c *MockDB) UpdateRegion(region Region) error {
+	for i, r := range c.regions {
+		if r.ID == region.ID {
+			c.regions[i] = region
+			return nil
+		}
+	}
+	return ErrRegionNotFound
+}
+
+func (c *MockDB) DeleteRegion(id string) error {
+	for i, r := range c.regions {
+		if r.ID.Hex() == id {
+			c.regions = append(c.regions[:i], c.regions[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRegionNotFound
 }
 
 func (c *MockDB) AddImage(image ImageData) {
@@ -30,14 +98,130 @@ func (c *MockDB) AddImage(image ImageData) {
 
 func (c *MockDB) AddBulkImagesToRegion(images []ImageData,
 	region *Location) {
+	for _, img := range images {
+		if c.purged[img.ID] {
+			continue
+		}
+		img.Region = region
+		c.images = append(c.images, img)
+	}
 }
 
 func (c *MockDB) DeleteOldImages(amount int) {}
 
+func (c *MockDB) GetCursor(collector string, region string, cell string) string {
+	return ""
+}
+
+func (c *MockDB) SetCursor(collector string, region string, cell string, cursor string) {}
+
+func (c *MockDB) AcquireQuery(key string, time int64, since int64, limit int) bool {
+	return true
+}
+
+func (c *MockDB) ReleaseQuery(key string, time int64) {}
+
+func (c *MockDB) CountQueries(key string, since int64) int {
+	return 0
+}
+
+func (c *MockDB) GetProviderQuota(key string) (int, int64) {
+	return -1, 0
+}
+
+func (c *MockDB) SetProviderQuota(key string, remaining int, reset int64) {}
+
+func (c *MockDB) TakeProviderQuota(key string, now int64) bool {
+	return true
+}
+
 func (c *MockDB) Size() int {
 	return 0
 }
 
+func (c *MockDB) CountImagesByRegion() map[Location]int {
+	counts := map[Location]int{}
+	for _, image := range c.images {
+		if image.Region != nil {
+			counts[*image.Region]++
+		}
+	}
+	return counts
+}
+
+func (c *MockDB) AddReport(report Report) {
+	for i, r := range c.reports {
+		if r.ImageID == report.ImageID && r.Reporter == report.Reporter &&
+			r.Status == ReportPending {
+			c.reports[i] = report
+			return
+		}
+	}
+	c.reports = append(c.reports, report)
+}
+
+func (c *MockDB) CountReporters(imageID string) int {
+	reporters := map[string]bool{}
+	for _, r := range c.reports {
+		if r.ImageID == imageID && r.Status == ReportPending {
+			reporters[r.Reporter] = true
+		}
+	}
+	return len(reporters)
+}
+
+func (c *MockDB) GetReportedImages(limit int) []ReportedImage {
+	return []ReportedImage{}
+}
+
+func (c *MockDB) ResolveReports(imageID string, status string) int {
+	resolved := 0
+	for i, r := range c.reports {
+		if r.ImageID == imageID && r.Status == ReportPending {
+			c.reports[i].Status = status
+			resolved++
+		}
+	}
+	return resolved
+}
+
+func (c *MockDB) RestoreImage(id string) error {
+	for _, image := range c.images {
+		if image.ID == id && !c.purged[id] {
+			delete(c.hidden, id)
+			return nil
+		}
+	}
+	return ErrImageNotFound
+}
+
+func (c *MockDB) DeleteImage(id string) error {
+	for _, image := range c.images {
+		if image.ID == id && !c.purged[id] {
+			c.hidden[id] = true
+			c.purged[id] = true
+			return nil
+		}
+	}
+	return ErrImageNotFound
+}
+
+func (c *MockDB) AddModerationDecision(decision ModerationDecision) {
+	c.decisions = append(c.decisions, decision)
+}
+
+func (c *MockDB) GetModerationDecisions(limit int) []ModerationDecision {
+	return c.decisions
+}
+
+func (c *MockDB) Ping() error {
+	return nil
+}
+
+func (c *MockDB) EnsureIndexes() error {
+	return nil
+}
+
 func (c *MockDB) GetImages(lat float64, lng float64, start int, end int) []ImageData {
 	if end > len(c.images) {
 		end = len(c.images)
@@ -52,7 +236,27 @@ func (c *MockDB) GetAllImages() []ImageData {
 	return c.images
 }
 
-func (c *MockDB) SoftDelete(id string, reason string) {}
+func (c *MockDB) HasImage(id string) bool {
+	for _, image := range c.images {
+		if image.ID == id && !c.purged[id] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *MockDB) HasImageURL(url string) bool {
+	for _, image := range c.images {
+		if !c.hidden[image.ID] && (image.ImageURL == url || image.ThumbnailURL == url) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *MockDB) SoftDelete(id string, reason string) {
+	c.hidden[id] = true
+}
 
 func (c *MockDB) Copy() DatabaseInterface {
 	return c
@@ -70,9 +274,9 @@ func setupNonMatchingDB(testRegion *Location) *MockDB {
 	newPoint := p.PointAtDistanceAndBearing(5.1, 0)
 	// a point very out of range
 	newPoint2 := p.PointAtDistanceAndBearing(10, 0)
-	regions := []Location{
-		*NewLocation(newPoint.Lat(), newPoint.Lng()),
-		*NewLocation(newPoint2.Lat(), newPoint2.Lng()),
+	regions := []Region{
+		*NewRegion("", newPoint.Lat(), newPoint.Lng(), 0),
+		*NewRegion("", newPoint2.Lat(), newPoint2.Lng(), 0),
 	}
 	nonMatchingDB := NewMockDB(regions, []ImageData{})
 	return nonMatchingDB
@@ -91,10 +295,10 @@ func setupMatchingDB(testRegion *Location) (*MockDB, *Location) {
 	// a point in range
 	newPoint3 := p.PointAtDistanceAndBearing(4.5, 0)
 	expected := NewLocation(newPoint3.Lat(), newPoint3.Lng())
-	matchingRegions := []Location{
-		*NewLocation(newPoint.Lat(), newPoint.Lng()),
-		*NewLocation(newPoint2.Lat(), newPoint2.Lng()),
-		*expected,
+	matchingRegions := []Region{
+		*NewRegion("", newPoint.Lat(), newPoint.Lng(), 0),
+		*NewRegion("", newPoint2.Lat(), newPoint2.Lng(), 0),
+		*NewRegion("", expected.Lat, expected.Lng, 0),
 	}
 	matchDB := NewMockDB(matchingRegions, []ImageData{})
 	return matchDB, expected
@@ -127,6 +331,26 @@ func TestGetRegion(t *testing.T) {
 	}
 }
 
+func TestGetRegionStats(t *testing.T) {
+	sydney := NewRegion("sydney", -33.868820, 151.209296, 0)
+	canberra := NewRegion("canberra", -35.280937, 149.130009, 0)
+	images := []ImageData{
+		{ID: "1", Region: sydney.Location()},
+		{ID: "2", Region: sydney.Location()},
+		{ID: "3", Region: NewLocation(0, 0)},
+	}
+	db := NewMockDB([]Region{*sydney, *canberra}, images)
+	stats := GetRegionStats(db)
+	counts := map[string]int{}
+	for _, s := range stats {
+		counts[s.Name] = s.ImageCount
+	}
+	expected := map[string]int{"sydney": 2, "canberra": 0}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Error("Expected", expected, "but was", counts)
+	}
+}
+
 func TestGetImagesWithRange(t *testing.T) {
 	testRegion := NewLocation(-35.250327, 149.075300)
 	// arbitrary images. ensure that the distance and created time only
@@ -137,7 +361,7 @@ func TestGetImagesWithRange(t *testing.T) {
 		*NewImageWithDistance("dhfksdj", 100, "", "", "", testRegion.Lat, testRegion.Lng, 100),
 		*NewImageWithDistance("bla", 200, "", "", "", testRegion.Lat, testRegion.Lng, 200),
 	}
-	db := NewMockDB([]Location{}, images)
+	db := NewMockDB([]Region{}, images)
 	result := GetImagesWithRange(db, testRegion.Lat, testRegion.Lng, 1, 3)
 	if len(result) != 2 {
 		t.Error("Expected length of result to be 2")
@@ -243,7 +467,7 @@ func TestGetImagesWithRangeAndSampleSize(t *testing.T) {
 	// sorted images, where sample size is 2 -- so the first two images are
 	// sorted separately to the second two
 	sorted := []ImageData{images[1], images[0], images[2], images[3]}
-	db := NewMockDB([]Location{}, images)
+	db := NewMockDB([]Region{}, images)
 	result := getImagesWithRangeAndSampleSize(db, testRegion.Lat, testRegion.Lng, 0, len(images), sampleSize)
 	if len(result) != len(images) {
 		t.Error("Expected length of result to be", len(images), "but was", len(result))
@@ -271,7 +495,7 @@ func TestGetImagesWithRangeAndSampleSizeNotOnBorder(t *testing.T) {
 	// sorted images, where sample size is 2 -- so the first two images are
 	// sorted separately to the second two
 	sorted := []ImageData{images[1], images[0], images[2], images[3]}
-	db := NewMockDB([]Location{}, images)
+	db := NewMockDB([]Region{}, images)
 	result := getImagesWithRangeAndSampleSize(db, testRegion.Lat, testRegion.Lng, 0, 3, sampleSize)
 	if len(result) != 3 {
 		t.Error("Expected length of result to be", len(images), "but was", len(result))
@@ -282,3 +506,107 @@ func TestGetImagesWithRangeAndSampleSizeNotOnBorder(t *testing.T) {
 		}
 	}
 }
+
+func TestTracingNestsDatabaseOperations(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	ctx, request := otel.Tracer("test").Start(context.Background(), "request")
+	db := WithContext(ctx, NewMockDB([]Region{}, []ImageData{}))
+	GetImagesWithRange(db, -35.28, 149.13, 0, 10)
+	request.End()
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	function, ok := spans["hanapi.GetImagesWithRange"]
+	if !ok || function.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Fatal("Expected a span for the function within the request but was", spans)
+	}
+	query, ok := spans["db.GetImages"]
+	if !ok || query.Parent().SpanID() != function.SpanContext().SpanID() {
+		t.Error("Expected a span for the query within the function but was", spans)
+	}
+}
+
+func TestReportImageHidesAtThreshold(t *testing.T) {
+	db := NewMockDB([]Region{}, []ImageData{{ID: "image"}, {ID: "other"}})
+	policy := ModerationPolicy{
+		ReportThreshold:  2,
+		ReasonThresholds: map[string]int{"illegal": 1},
+	}
+	if hidden, _ := ReportImage(db, "image", "spam", "a", policy, nil); hidden {
+		t.Error("Expected image not to be hidden after 1 reporter")
+	}
+	// the same reporter only counts once
+	if hidden, _ := ReportImage(db, "image", "spam", "a", policy, nil); hidden {
+		t.Error("Expected repeated reports not to hide the image")
+	}
+	if len(db.reports) != 1 {
+		t.Error("Expected 1 report but was", db.reports)
+	}
+	if hidden, _ := ReportImage(db, "image", "spam", "b", policy, nil); !hidden || !db.hidden["image"] {
+		t.Error("Expected image to be hidden after 2 reporters")
+	}
+	// some reasons hide the image straight away
+	if hidden, _ := ReportImage(db, "other", "illegal", "a", policy, nil); !hidden {
+		t.Error("Expected image to be hidden after an illegal report")
+	}
+}
+
+func TestReportImageNotFound(t *testing.T) {
+	db := NewMockDB([]Region{}, []ImageData{})
+	policy := ModerationPolicy{ReportThreshold: 1}
+	if _, err := ReportImage(db, "missing", "spam", "a", policy, nil); err != ErrImageNotFound {
+		t.Error("Expected", ErrImageNotFound, "but was", err)
+	}
+	if len(db.reports) != 0 {
+		t.Error("Expected no reports to be stored but was", db.reports)
+	}
+	if _, err := ModerateImage(db, "missing", ModerationApprove, "mod", "", nil); err != ErrImageNotFound {
+		t.Error("Expected", ErrImageNotFound, "but was", err)
+	}
+	if db.hidden["missing"] || len(db.decisions) != 0 {
+		t.Error("Expected no decision to be recorded but was", db.decisions)
+	}
+}
+
+func TestModerateImage(t *testing.T) {
+	db := NewMockDB([]Region{}, []ImageData{{ID: "image"}})
+	policy := ModerationPolicy{ReportThreshold: 1}
+	ReportImage(db, "image", "spam", "a", policy, nil)
+	if _, err := ModerateImage(db, "image", "ignore", "mod", "", nil); err != ErrInvalidAction {
+		t.Error("Expected", ErrInvalidAction, "but was", err)
+	}
+	decision, err := ModerateImage(db, "image", ModerationRestore, "mod", "not spam", nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if db.hidden["image"] {
+		t.Error("Expected image to be restored")
+	}
+	if decision.Reports != 1 || db.reports[0].Status != ReportDismissed {
+		t.Error("Expected the report to be dismissed but was", db.reports)
+	}
+	if len(GetModerationLog(db, 10)) != 1 {
+		t.Error("Expected the decision to be recorded but was", db.decisions)
+	}
+	if _, err := ModerateImage(db, "image", ModerationDelete, "mod", "", nil); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !db.hidden["image"] || !db.purged["image"] {
+		t.Error("Expected image to be deleted")
+	}
+	if _, err := ModerateImage(db, "image", ModerationDelete, "mod", "", nil); err != ErrImageNotFound {
+		t.Error("Expected", ErrImageNotFound, "but was", err)
+	}
+	if _, err := ModerateImage(db, "image", ModerationRestore, "mod", "", nil); err != ErrImageNotFound {
+		t.Error("Expected", ErrImageNotFound, "but was", err)
+	}
+	// collecting the image again shouldn't store it
+	db.AddBulkImagesToRegion([]ImageData{{ID: "image"}}, &Location{})
+	if len(db.images) != 1 {
+		t.Error("Expected deleted image not to be stored again but was", db.images)
+	}
+}
@@ -30,6 +30,8 @@ type ImageData struct {
 	Distance float64 `json:"distance" bson:"distance"`
 	// the source of the image
 	Source string `json:"source" bson:"source"`
+	// the license the image is shared under, if the source specifies one
+	License string `json:"license,omitempty" bson:"license,omitempty"`
 }
 
 // NewLocation returns a new location
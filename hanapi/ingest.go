@@ -0,0 +1,202 @@
+package hanapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxIngestBatchSize is the most images that can be pushed in one request
+const MaxIngestBatchSize = 500
+
+// maxClockSkew is how far in the future a pushed image's created time can be,
+// to allow for partners' clocks being slightly ahead
+const maxClockSkew = 5 * 60
+
+// IngestCollector is the collector that pushed images are reported as in
+// metrics
+const IngestCollector = "ingest"
+
+// SignaturePrefix is prepended to the hex encoded HMAC-SHA256 signature
+const SignaturePrefix = "sha256="
+
+// SignatureWindow is how old or how far in the future a signature's timestamp
+// can be. Requests outside of this are rejected so that they can't be
+// replayed later, eg. to push images that have since been deleted
+const SignatureWindow = 5 * time.Minute
+
+// PushedImage is the schema that partners use to push images to han
+type PushedImage struct {
+	ID                string  `json:"id"`
+	Caption           string  `json:"caption"`
+	CreatedTime       int64   `json:"created_time"`
+	ImageURL          string  `json:"url"`
+	ThumbnailURL      string  `json:"thumbnail_url"`
+	Link              string  `json:"link"`
+	Lat               float64 `json:"lat"`
+	Lng               float64 `json:"lng"`
+	Username          string  `json:"username"`
+	ProfilePictureURL string  `json:"profile_picture"`
+	License           string  `json:"license"`
+}
+
+// Validate returns every problem with the image, this is empty if the image
+// is valid
+func (p *PushedImage) Validate() []string {
+	errs := []string{}
+	if len(strings.TrimSpace(p.ID)) == 0 {
+		errs = append(errs, "id is required")
+	}
+	if !isHTTPURL(p.ImageURL) {
+		errs = append(errs, "url must be an http or https URL")
+	}
+	if len(p.ThumbnailURL) > 0 && !isHTTPURL(p.ThumbnailURL) {
+		errs = append(errs, "thumbnail_url must be an http or https URL")
+	}
+	if len(p.Link) > 0 && !isHTTPURL(p.Link) {
+		errs = append(errs, "link must be an http or https URL")
+	}
+	if p.Lat < -90 || p.Lat > 90 {
+		errs = append(errs, "lat must be between -90 and 90")
+	}
+	if p.Lng < -180 || p.Lng > 180 {
+		errs = append(errs, "lng must be between -180 and 180")
+	}
+	if p.CreatedTime <= 0 {
+		errs = append(errs, "created_time is required")
+	} else if p.CreatedTime > time.Now().Unix()+maxClockSkew {
+		errs = append(errs, "created_time is in the future")
+	}
+	return errs
+}
+
+// ToImageData converts the image into the format stored in the database. The
+// ID is prefixed with the partner so that partners can't overwrite each
+// other's images
+func (p *PushedImage) ToImageData(partner string) *ImageData {
+	thumbnailURL := p.ThumbnailURL
+	if len(thumbnailURL) == 0 {
+		thumbnailURL = p.ImageURL
+	}
+	image := NewImage(p.Caption, p.CreatedTime, p.ImageURL, thumbnailURL,
+		partner+":"+p.ID, p.Lat, p.Lng, p.Link, p.Username,
+		p.ProfilePictureURL, partner)
+	image.License = p.License
+	return image
+}
+
+// IngestResult describes what happened to each image in a pushed batch
+type IngestResult struct {
+	Stored int `json:"stored"`
+	// Rejected maps the index of each image in the batch to why it wasn't
+	// stored
+	Rejected map[int][]string `json:"rejected,omitempty"`
+}
+
+// IngestImages validates and stores images pushed by a partner, assigning
+// each image to the region it lies in. Images outside of every region are
+// rejected since they'd never be returned
+func IngestImages(db DatabaseInterface, partner string, images []PushedImage) (*IngestResult, error) {
+	db, span := startSpan(db, "IngestImages",
+		attribute.String("partner", partner), attribute.Int("images", len(images)))
+	defer span.End()
+	if len(images) > MaxIngestBatchSize {
+		err := fmt.Errorf("batch of %d images exceeds the limit of %d",
+			len(images), MaxIngestBatchSize)
+		recordError(span, err)
+		return nil, err
+	}
+	result := &IngestResult{Rejected: map[int][]string{}}
+	regions := []*Region{}
+	batches := map[*Region][]ImageData{}
+	for i, p := range images {
+		if errs := p.Validate(); len(errs) > 0 {
+			result.Rejected[i] = errs
+			continue
+		}
+		region := findRegion(db, regions, p.Lat, p.Lng)
+		if region == nil {
+			result.Rejected[i] = []string{"location is not within a region"}
+			continue
+		}
+		if _, ok := batches[region]; !ok {
+			regions = append(regions, region)
+		}
+		batches[region] = append(batches[region], *p.ToImageData(partner))
+	}
+	for _, region := range regions {
+		db.AddBulkImagesToRegion(batches[region], region.Location())
+		result.Stored += len(batches[region])
+		metrics.ImagesIngested.WithLabelValues(IngestCollector, region.Label()).
+			Add(float64(len(batches[region])))
+	}
+	return result, nil
+}
+
+// findRegion returns the region containing the point, reusing a region that
+// was already found so that images are grouped by region
+func findRegion(db DatabaseInterface, found []*Region, lat float64, lng float64) *Region {
+	region := GetRegion(db, lat, lng)
+	if region == nil {
+		return nil
+	}
+	for _, r := range found {
+		if sameRegion(r, region) {
+			return r
+		}
+	}
+	return region
+}
+
+// sameRegion returns whether both regions are the same region
+func sameRegion(a *Region, b *Region) bool {
+	if len(a.ID) > 0 || len(b.ID) > 0 {
+		return a.ID == b.ID
+	}
+	return a.Lat == b.Lat && a.Lng == b.Lng
+}
+
+// SignPayload returns the signature that should be sent with the payload. The
+// signature covers the timestamp followed by a "." and the payload
+// @param timestamp - unix time that the request is sent, which must also be
+// sent with the request
+func SignPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return SignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature returns whether the signature was created from the
+// timestamp and payload using the secret, and whether the timestamp is within
+// `SignatureWindow` of now
+// @param timestamp - unix time sent with the request
+func VerifySignature(secret string, timestamp string, payload []byte, signature string) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(sent, 0))
+	if age > SignatureWindow || age < -SignatureWindow {
+		return false
+	}
+	return hmac.Equal([]byte(SignPayload(secret, sent, payload)), []byte(signature))
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
+}
@@ -0,0 +1,94 @@
+package hanapi
+
+import (
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIngestImagesAssignsRegions(t *testing.T) {
+	canberra := NewRegion("Canberra", -35.28, 149.13, 0)
+	sydney := NewRegion("Sydney", -33.86, 151.2, 0)
+	db := NewMockDB([]Region{*canberra, *sydney}, []ImageData{})
+	now := time.Now().Unix()
+	images := []PushedImage{
+		{ID: "1", ImageURL: "https://example.com/1.jpg", Lat: -35.28, Lng: 149.13, CreatedTime: now},
+		{ID: "2", ImageURL: "https://example.com/2.jpg", Lat: -33.86, Lng: 151.2, CreatedTime: now},
+		{ID: "3", ImageURL: "https://example.com/3.jpg", Lat: -35.281, Lng: 149.131, CreatedTime: now},
+		// outside of every region
+		{ID: "4", ImageURL: "https://example.com/4.jpg", Lat: 0, Lng: 0, CreatedTime: now},
+		// invalid
+		{ID: "", ImageURL: "ftp://example.com/5.jpg", Lat: 91, Lng: 0, CreatedTime: now + 60*60},
+	}
+	ingested := metrics.ImagesIngested.WithLabelValues(IngestCollector, "Canberra")
+	before := testutil.ToFloat64(ingested)
+	result, err := IngestImages(db, "partner", images)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if count := testutil.ToFloat64(ingested) - before; count != 2 {
+		t.Error("Expected 2 images to be counted for Canberra but was", count)
+	}
+	if result.Stored != 3 {
+		t.Error("Expected 3 images to be stored but was", result.Stored)
+	}
+	if len(result.Rejected) != 2 || len(result.Rejected[3]) != 1 {
+		t.Error("Expected images 3 and 4 to be rejected but was", result.Rejected)
+	}
+	if len(result.Rejected[4]) != 4 {
+		t.Error("Expected every problem to be reported but was", result.Rejected[4])
+	}
+	for _, img := range db.images {
+		expected := canberra.Location()
+		if img.ID == "partner:2" {
+			expected = sydney.Location()
+		}
+		if *img.Region != *expected {
+			t.Error("Expected", img.ID, "to be in", expected, "but was", img.Region)
+		}
+		if img.Source != "partner" || img.ThumbnailURL != img.ImageURL {
+			t.Error("Unexpected image", img)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	payload := []byte(`{"id": "1"}`)
+	now := time.Now().Unix()
+	timestamp := strconv.FormatInt(now, 10)
+	signature := SignPayload("secret", now, payload)
+	if !VerifySignature("secret", timestamp, payload, signature) {
+		t.Error("Expected signature to be valid")
+	}
+	if VerifySignature("other", timestamp, payload, signature) {
+		t.Error("Expected signature with a different secret to be invalid")
+	}
+	if VerifySignature("secret", timestamp, []byte(`{"id": "2"}`), signature) {
+		t.Error("Expected signature of a different payload to be invalid")
+	}
+	if VerifySignature("secret", strconv.FormatInt(now+1, 10), payload, signature) {
+		t.Error("Expected signature with a different timestamp to be invalid")
+	}
+	if VerifySignature("secret", "", payload, signature) {
+		t.Error("Expected signature without a timestamp to be invalid")
+	}
+	if VerifySignature("", timestamp, payload, SignPayload("", now, payload)) {
+		t.Error("Expected an empty secret to never be valid")
+	}
+}
+
+func TestVerifySignatureRejectsReplays(t *testing.T) {
+	payload := []byte(`{"id": "1"}`)
+	old := time.Now().Add(-SignatureWindow - time.Minute).Unix()
+	signature := SignPayload("secret", old, payload)
+	if VerifySignature("secret", strconv.FormatInt(old, 10), payload, signature) {
+		t.Error("Expected signature older than the window to be invalid")
+	}
+	future := time.Now().Add(SignatureWindow + time.Minute).Unix()
+	signature = SignPayload("secret", future, payload)
+	if VerifySignature("secret", strconv.FormatInt(future, 10), payload, signature) {
+		t.Error("Expected signature too far in the future to be invalid")
+	}
+}
@@ -0,0 +1,151 @@
+// Package metrics defines the Prometheus metrics that han components expose
+// on /metrics. Each process only reports what it does itself, eg. hancleaner
+// reports deletions while hanhttpserver reports requests
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "han"
+
+// shutdownTimeout is how long a scrape can take before the metrics server
+// stops anyway
+const shutdownTimeout = 5 * time.Second
+
+var (
+	// HTTPRequests counts responses by the route that handled them
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP responses by route, method and status code.",
+	}, []string{"handler", "method", "code"})
+	// HTTPDuration is how long each route takes to respond
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to respond to HTTP requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler"})
+	// ImagesIngested counts images stored by collectors, or pushed by
+	// partners where the collector is `ingest`
+	ImagesIngested = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "collector",
+		Name:      "images_ingested_total",
+		Help:      "Images stored by collector and region.",
+	}, []string{"collector", "region"})
+	// CollectorErrors counts failed collections by the kind of error, see
+	// `collectors.ClassifyError`
+	CollectorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "collector",
+		Name:      "errors_total",
+		Help:      "Failed collections by collector and kind of error.",
+	}, []string{"collector", "kind"})
+	// CollectorQueries counts queries to each provider's endpoints, the
+	// result is `ok`, `error` or `rejected` when the circuit is open
+	CollectorQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "collector",
+		Name:      "queries_total",
+		Help:      "Queries to providers by collector, endpoint and result.",
+	}, []string{"collector", "endpoint", "result"})
+	// CollectorQueryDuration includes retries, since that's how long the
+	// collector waited
+	CollectorQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "collector",
+		Name:      "query_duration_seconds",
+		Help:      "Time taken to query providers, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"collector", "endpoint"})
+	// QuotaRemaining is updated after each collector populates, see
+	// `collectors.QuotaState`
+	QuotaRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "collector",
+		Name:      "quota_remaining",
+		Help:      "Queries remaining in each endpoint's quota window.",
+	}, []string{"collector", "endpoint"})
+	// DBQueryDuration is how long each `DatabaseInterface` operation takes
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Time taken by database operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	// CleanerDeletions counts images removed by hancleaner
+	CleanerDeletions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cleaner",
+		Name:      "deleted_images_total",
+		Help:      "Images deleted by hancleaner.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		HTTPRequests,
+		HTTPDuration,
+		ImagesIngested,
+		CollectorErrors,
+		CollectorQueries,
+		CollectorQueryDuration,
+		QuotaRemaining,
+		DBQueryDuration,
+		CleanerDeletions,
+	)
+}
+
+// ObserveDB records how long a database operation took. Use this with defer
+// at the start of the operation
+// @param operation - the `DatabaseInterface` method, eg. `GetImages`
+// @param start - when the operation started
+func ObserveDB(operation string, start time.Time) {
+	DBQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// RegisterDatabaseSize reports the amount of images in the database whenever
+// metrics are scraped. This should only be called once per process
+// @param size - returns the amount of images, eg. `DatabaseInterface.Size`
+func RegisterDatabaseSize(size func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "images",
+		Help:      "Images stored in the database.",
+	}, func() float64 {
+		return float64(size())
+	}))
+}
+
+// Handler serves the metrics in Prometheus' text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve exposes /metrics on its own address until the context is cancelled.
+// This is used by components that don't otherwise serve HTTP
+func Serve(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package hanapi
+
+import (
+	"errors"
+	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Report statuses, reports are pending until a moderator decides on the image
+const (
+	ReportPending = "pending"
+	// the moderator agreed with the report
+	ReportUpheld = "upheld"
+	// the moderator restored the image
+	ReportDismissed = "dismissed"
+)
+
+// Moderation actions
+const (
+	// ModerationApprove keeps the image hidden
+	ModerationApprove = "approve"
+	// ModerationRestore shows the image again
+	ModerationRestore = "restore"
+	// ModerationDelete permanently removes the image, it won't be stored
+	// again if it's collected or pushed
+	ModerationDelete = "delete"
+)
+
+// ErrImageNotFound is returned when an image ID does not match any image
+var ErrImageNotFound = errors.New("image not found")
+
+// ErrInvalidAction is returned for unknown moderation actions
+var ErrInvalidAction = errors.New("action must be approve, restore or delete")
+
+// Report is a single report of an image
+type Report struct {
+	ID      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	ImageID string        `json:"image_id" bson:"image_id"`
+	Reason  string        `json:"reason" bson:"reason"`
+	// identifies who made the report, eg. their IP address. Each reporter
+	// only counts once towards hiding an image
+	Reporter string `json:"reporter" bson:"reporter"`
+	// unix time of the report
+	Time   int64  `json:"time" bson:"time"`
+	Status string `json:"status" bson:"status"`
+}
+
+// ReportedImage is an image with reports awaiting moderation
+type ReportedImage struct {
+	ImageData `bson:",inline"`
+	// whether the image has been hidden by its reports or a moderator
+	Hidden bool `json:"hidden" bson:"deleted"`
+	// pending reports, most recent first
+	Reports []Report `json:"reports" bson:"-"`
+}
+
+// ModerationDecision records a moderator's action, so that there's an audit
+// trail of who changed what
+type ModerationDecision struct {
+	ID        bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	ImageID   string        `json:"image_id" bson:"image_id"`
+	Action    string        `json:"action" bson:"action"`
+	Moderator string        `json:"moderator" bson:"moderator"`
+	Note      string        `json:"note,omitempty" bson:"note,omitempty"`
+	// the amount of pending reports that the decision resolved
+	Reports int `json:"reports" bson:"reports"`
+	// unix time of the decision
+	Time int64 `json:"time" bson:"time"`
+}
+
+// ModerationPolicy decides when reported images are hidden before being
+// moderated
+type ModerationPolicy struct {
+	// ReportThreshold is how many different reporters must report an image
+	// before it's hidden
+	ReportThreshold int
+	// ReasonThresholds overrides the threshold for reports with specific
+	// reasons, eg. so that a single report of illegal content hides it
+	ReasonThresholds map[string]int
+}
+
+// threshold returns the amount of reporters needed to hide an image, where
+// the latest report has this reason
+func (p ModerationPolicy) threshold(reason string) int {
+	if threshold, ok := p.ReasonThresholds[reason]; ok {
+		return threshold
+	}
+	return p.ReportThreshold
+}
+
+// ReportImage - report an image to be moderated. The image is hidden once
+// enough different reporters have reported it, see `ModerationPolicy`
+// @param id - the image ID which should match one in ImageData
+// @param reason - reason for reporting
+// @param reporter - identifies who made the report
+// @param policy - decides when the image is hidden
+// @param logger - optional logging functionality
+// @return whether the image was hidden, or `ErrImageNotFound` if there's no
+// image with the ID
+func ReportImage(db DatabaseInterface, id string, reason string,
+	reporter string, policy ModerationPolicy, logger reporting.Logger) (bool, error) {
+	db, span := startSpan(db, "ReportImage", attribute.String("image", id))
+	defer span.End()
+	if logger == nil {
+		logger = reporting.Default()
+	}
+	if !db.HasImage(id) {
+		recordError(span, ErrImageNotFound)
+		return false, ErrImageNotFound
+	}
+	db.AddReport(Report{
+		ImageID:  id,
+		Reason:   reason,
+		Reporter: reporter,
+		Time:     time.Now().Unix(),
+		Status:   ReportPending,
+	})
+	reporters := db.CountReporters(id)
+	fields := reporting.Fields{
+		"image":     id,
+		"reason":    reason,
+		"reporters": reporters,
+	}
+	if reporters < policy.threshold(reason) {
+		logger.Log(reporting.Info, "Image reported", fields)
+		return false, nil
+	}
+	db.SoftDelete(id, reason)
+	span.SetAttributes(attribute.Bool("hidden", true))
+	// notify through Slack bot, since this needs moderating
+	logger.Log(reporting.Warn, "Image hidden after being reported", fields)
+	return true, nil
+}
+
+// GetModerationQueue - returns images with reports awaiting moderation, most
+// recently reported first
+// @param limit - the maximum amount of images
+func GetModerationQueue(db DatabaseInterface, limit int) []ReportedImage {
+	db, span := startSpan(db, "GetModerationQueue")
+	defer span.End()
+	return db.GetReportedImages(limit)
+}
+
+// ModerateImage - approve, restore or permanently delete a reported image.
+// Its pending reports are resolved and the decision is recorded
+// @param id - the image ID which should match one in ImageData
+// @param action - `ModerationApprove`, `ModerationRestore` or
+// `ModerationDelete`
+// @param moderator - who made the decision
+// @param note - optional explanation of the decision
+// @param logger - optional logging functionality
+func ModerateImage(db DatabaseInterface, id string, action string,
+	moderator string, note string, logger reporting.Logger) (*ModerationDecision, error) {
+	db, span := startSpan(db, "ModerateImage",
+		attribute.String("image", id), attribute.String("action", action))
+	defer span.End()
+	if logger == nil {
+		logger = reporting.Default()
+	}
+	var err error
+	status := ReportUpheld
+	switch action {
+	case ModerationApprove:
+		if !db.HasImage(id) {
+			err = ErrImageNotFound
+			break
+		}
+		db.SoftDelete(id, "approved by "+moderator)
+	case ModerationRestore:
+		status = ReportDismissed
+		err = db.RestoreImage(id)
+	case ModerationDelete:
+		err = db.DeleteImage(id)
+	default:
+		err = ErrInvalidAction
+	}
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	decision := ModerationDecision{
+		ID:        bson.NewObjectId(),
+		ImageID:   id,
+		Action:    action,
+		Moderator: moderator,
+		Note:      note,
+		Reports:   db.ResolveReports(id, status),
+		Time:      time.Now().Unix(),
+	}
+	db.AddModerationDecision(decision)
+	logger.Log(reporting.Info, "Image moderated", reporting.Fields{
+		"image":     id,
+		"action":    action,
+		"moderator": moderator,
+		"reports":   decision.Reports,
+	})
+	return &decision, nil
+}
+
+// GetModerationLog - returns the most recent moderation decisions
+// @param limit - the maximum amount of decisions
+func GetModerationLog(db DatabaseInterface, limit int) []ModerationDecision {
+	db, span := startSpan(db, "GetModerationLog")
+	defer span.End()
+	return db.GetModerationDecisions(limit)
+}
@@ -1,34 +1,79 @@
 package hanapi
 
 import (
-	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// maxQuotaWindow is how long recorded queries are kept, quota windows
+// shouldn't be longer than this
+const maxQuotaWindow = 24 * time.Hour
+
 // MongoInterface - a mongodb implementation of `DatabaseInterface`
 type MongoInterface struct {
 	DatabaseInterface
 	session *mgo.Session
+	// shared between copies so that indexes are only ensured once
+	indexes *indexState
+}
+
+// indexState records whether indexes have been created
+type indexState struct {
+	mutex   sync.Mutex
+	ensured bool
 }
 
 // NewMongoInterface - use to create a new mongo connection
 func NewMongoInterface() DatabaseInterface {
+	// use for Docker, use "localhost:27017" locally
+	return NewMongoInterfaceWithURL("mongodb")
+}
+
+// NewMongoInterfaceWithURL - use to create a new mongo connection to a
+// specific server
+func NewMongoInterfaceWithURL(url string) DatabaseInterface {
 	c := new(MongoInterface)
-	// use for Docker:
-	session, err := mgo.Dial("mongodb")
-	// use locally:
-	// session, err := mgo.Dial("localhost:27017")
+	session, err := mgo.Dial(url)
 	if err != nil {
 		log.Fatal(err)
 	}
 	c.session = session
-	// if geospatial index hasn't been set up this will create it
-	getImageCollection(session).EnsureIndex(mgo.Index{Key: []string{"$2dsphere:coordinates"}})
+	c.indexes = new(indexState)
+	// regions are indexed by coordinates so that lookups don't scan every
+	// region
+	ensureRegionCoordinates(session)
+	// if this fails then it's retried by readiness checks
+	if err := c.EnsureIndexes(); err != nil {
+		logError(err)
+	}
 	return c
 }
 
+// ensureRegionCoordinates sets the indexed coordinates on regions that were
+// stored with only a lat and lng
+func ensureRegionCoordinates(session *mgo.Session) {
+	collection := getRegionCollection(session)
+	var regions []Region
+	err := collection.Find(bson.M{"coordinates": bson.M{"$exists": false}}).All(&regions)
+	if err != nil {
+		logError(err)
+		return
+	}
+	for _, r := range regions {
+		err = collection.UpdateId(r.ID, bson.M{
+			"$set": bson.M{"coordinates": []float64{r.Lng, r.Lat}},
+		})
+		if err != nil {
+			logError(err)
+		}
+	}
+}
+
 func getHanDB(session *mgo.Session) *mgo.Database {
 	return session.DB("han")
 }
@@ -41,24 +86,327 @@ func getImageCollection(session *mgo.Session) *mgo.Collection {
 	return getHanDB(session).C("images")
 }
 
+func getCursorCollection(session *mgo.Session) *mgo.Collection {
+	return getHanDB(session).C("cursors")
+}
+
+func getQueryCollection(session *mgo.Session) *mgo.Collection {
+	return getHanDB(session).C("queries")
+}
+
+func getQuotaCollection(session *mgo.Session) *mgo.Collection {
+	return getHanDB(session).C("quotas")
+}
+
+func getReportCollection(session *mgo.Session) *mgo.Collection {
+	return getHanDB(session).C("reports")
+}
+
+func getModerationCollection(session *mgo.Session) *mgo.Collection {
+	return getHanDB(session).C("moderation")
+}
+
 // GetRegions returns the watched locations that are stored in the database
 // These locations are queried to populate the database with images
-func (c *MongoInterface) GetRegions() []Location {
+func (c *MongoInterface) GetRegions() []Region {
+	defer metrics.ObserveDB("GetRegions", time.Now())
 	collection := getRegionCollection(c.session)
-	var regions []Location
+	var regions []Region
 	collection.Find(map[string]interface{}{}).All(&regions)
 	return regions
 }
 
-// AddRegion adds this new location as a place to query images on
-func (c *MongoInterface) AddRegion(lat float64, lng float64) {
+// GetRegionByID returns the region with the specified hex ID
+func (c *MongoInterface) GetRegionByID(id string) (*Region, error) {
+	defer metrics.ObserveDB("GetRegionByID", time.Now())
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrRegionNotFound
+	}
+	collection := getRegionCollection(c.session)
+	region := new(Region)
+	err := collection.FindId(bson.ObjectIdHex(id)).One(region)
+	if err == mgo.ErrNotFound {
+		return nil, ErrRegionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return region, nil
+}
+
+// GetNearestRegion returns the region with the closest centre to the
+// specified location or nil if there are no regions
+func (c *MongoInterface) GetNearestRegion(lat float64, lng float64) *Region {
+	defer metrics.ObserveDB("GetNearestRegion", time.Now())
+	collection := getRegionCollection(c.session)
+	region := new(Region)
+	err := collection.Find(nearQuery(lat, lng, -1)).One(region)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logError(err)
+		}
+		return nil
+	}
+	return region
+}
+
+// GetRegionsWithin returns the regions whose centre is within `radius`
+// meters of the specified location, sorted by distance
+func (c *MongoInterface) GetRegionsWithin(lat float64, lng float64,
+	radius float64) []Region {
+	defer metrics.ObserveDB("GetRegionsWithin", time.Now())
+	collection := getRegionCollection(c.session)
+	regions := []Region{}
+	err := collection.Find(nearQuery(lat, lng, radius)).All(&regions)
+	if err != nil {
+		logError(err)
+	}
+	return regions
+}
+
+// nearQuery returns a query sorted by distance to the specified location
+// @param maxDistance - optional limit in meters, use -1 to signify no value
+func nearQuery(lat float64, lng float64, maxDistance float64) bson.M {
+	near := bson.M{
+		"$geometry": bson.M{
+			"type":        "Point",
+			"coordinates": []float64{lng, lat},
+		},
+	}
+	if maxDistance >= 0 {
+		near["$maxDistance"] = maxDistance
+	}
+	return bson.M{"coordinates": bson.M{"$nearSphere": near}}
+}
+
+// AddRegion adds this new region as a place to query images on
+func (c *MongoInterface) AddRegion(region Region) error {
+	defer metrics.ObserveDB("AddRegion", time.Now())
+	collection := getRegionCollection(c.session)
+	if len(region.ID) == 0 {
+		region.ID = bson.NewObjectId()
+	}
+	region.Coordinates = []float64{region.Lng, region.Lat}
+	return collection.Insert(region)
+}
+
+// UpdateRegion replaces the stored region with the same ID
+func (c *MongoInterface) UpdateRegion(region Region) error {
+	defer metrics.ObserveDB("UpdateRegion", time.Now())
+	collection := getRegionCollection(c.session)
+	region.Coordinates = []float64{region.Lng, region.Lat}
+	err := collection.UpdateId(region.ID, region)
+	if err == mgo.ErrNotFound {
+		return ErrRegionNotFound
+	}
+	return err
+}
+
+// DeleteRegion removes the region with the specified hex ID
+func (c *MongoInterface) DeleteRegion(id string) error {
+	defer metrics.ObserveDB("DeleteRegion", time.Now())
+	if !bson.IsObjectIdHex(id) {
+		return ErrRegionNotFound
+	}
 	collection := getRegionCollection(c.session)
-	collection.Insert(map[string]interface{}{"lat": lat, "lng": lng})
+	err := collection.RemoveId(bson.ObjectIdHex(id))
+	if err == mgo.ErrNotFound {
+		return ErrRegionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// the region's cursors are no longer needed
+	_, err = getCursorCollection(c.session).RemoveAll(bson.M{"region": id})
+	return err
+}
+
+// GetCursor returns the stored cursor for the collector's cell within a
+// region or an empty string if there isn't one
+func (c *MongoInterface) GetCursor(collector string, region string, cell string) string {
+	defer metrics.ObserveDB("GetCursor", time.Now())
+	collection := getCursorCollection(c.session)
+	doc := struct {
+		Cursor string `bson:"cursor"`
+	}{}
+	err := collection.FindId(cursorID(collector, region, cell)).One(&doc)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logError(err)
+		}
+		return ""
+	}
+	return doc.Cursor
+}
+
+// SetCursor stores the cursor for the collector's cell within a region
+func (c *MongoInterface) SetCursor(collector string, region string, cell string, cursor string) {
+	defer metrics.ObserveDB("SetCursor", time.Now())
+	collection := getCursorCollection(c.session)
+	_, err := collection.UpsertId(cursorID(collector, region, cell), bson.M{
+		"$set": bson.M{
+			"collector": collector,
+			"region":    region,
+			"cell":      cell,
+			"cursor":    cursor,
+			"updated":   time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		logError(err)
+	}
+}
+
+func cursorID(collector string, region string, cell string) string {
+	return collector + "|" + region + "|" + cell
+}
+
+// AcquireQuery stores that a query was made against the quota, if fewer than
+// `limit` queries were made since the specified unix time. Each quota's
+// query times are kept in one document so that this can be checked and
+// updated atomically
+func (c *MongoInterface) AcquireQuery(key string, queryTime int64, since int64, limit int) bool {
+	defer metrics.ObserveDB("AcquireQuery", time.Now())
+	if limit <= 0 {
+		return false
+	}
+	collection := getQueryCollection(c.session)
+	// drop queries that have left the window so they don't count
+	err := collection.UpdateId(key, bson.M{
+		"$pull": bson.M{"times": bson.M{"$lt": since}},
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		logError(err)
+	}
+	// this only matches while there are fewer than limit queries, otherwise
+	// the upsert fails as the document already exists
+	lastAllowed := "times." + strconv.Itoa(limit-1)
+	_, err = collection.Upsert(bson.M{
+		"_id":       key,
+		lastAllowed: bson.M{"$exists": false},
+	}, bson.M{
+		"$push": bson.M{"times": queryTime},
+		"$set":  bson.M{"expires": time.Unix(queryTime, 0)},
+	})
+	if err != nil {
+		if !mgo.IsDup(err) {
+			logError(err)
+		}
+		return false
+	}
+	return true
+}
+
+// ReleaseQuery removes one query recorded at the specified unix time, for a
+// query that wasn't made after all. Queries made in the same second share a
+// time, so one is cleared and then pulled rather than pulling them all
+func (c *MongoInterface) ReleaseQuery(key string, queryTime int64) {
+	defer metrics.ObserveDB("ReleaseQuery", time.Now())
+	collection := getQueryCollection(c.session)
+	err := collection.Update(bson.M{"_id": key, "times": queryTime},
+		bson.M{"$unset": bson.M{"times.$": 1}})
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logError(err)
+		}
+		return
+	}
+	err = collection.UpdateId(key, bson.M{"$pull": bson.M{"times": nil}})
+	if err != nil && err != mgo.ErrNotFound {
+		logError(err)
+	}
+}
+
+// CountQueries returns the amount of queries made against the quota since
+// the specified unix time
+func (c *MongoInterface) CountQueries(key string, since int64) int {
+	defer metrics.ObserveDB("CountQueries", time.Now())
+	doc := struct {
+		Times []int64 `bson:"times"`
+	}{}
+	err := getQueryCollection(c.session).FindId(key).One(&doc)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logError(err)
+		}
+		return 0
+	}
+	count := 0
+	for _, t := range doc.Times {
+		if t >= since {
+			count++
+		}
+	}
+	return count
+}
+
+// GetProviderQuota returns the remaining queries and reset time last reported
+// by the provider, remaining is -1 if the provider hasn't reported it
+func (c *MongoInterface) GetProviderQuota(key string) (int, int64) {
+	defer metrics.ObserveDB("GetProviderQuota", time.Now())
+	doc := struct {
+		Remaining int   `bson:"remaining"`
+		Reset     int64 `bson:"reset"`
+	}{}
+	err := getQuotaCollection(c.session).FindId(key).One(&doc)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logError(err)
+		}
+		return -1, 0
+	}
+	return doc.Remaining, doc.Reset
+}
+
+// SetProviderQuota stores the remaining queries and reset time reported by
+// the provider
+func (c *MongoInterface) SetProviderQuota(key string, remaining int, reset int64) {
+	defer metrics.ObserveDB("SetProviderQuota", time.Now())
+	_, err := getQuotaCollection(c.session).UpsertId(key, bson.M{
+		"$set": bson.M{"remaining": remaining, "reset": reset},
+	})
+	if err != nil {
+		logError(err)
+	}
+}
+
+// TakeProviderQuota decrements the remaining queries reported by the
+// provider. This returns false if the provider reported that there are none
+// left before the reset, and true if its quota is unknown or has reset
+func (c *MongoInterface) TakeProviderQuota(key string, now int64) bool {
+	defer metrics.ObserveDB("TakeProviderQuota", time.Now())
+	collection := getQuotaCollection(c.session)
+	// matching and decrementing is atomic, so processes can't both take the
+	// last query
+	_, err := collection.Find(bson.M{
+		"_id":       key,
+		"reset":     bson.M{"$gt": now},
+		"remaining": bson.M{"$gt": 0},
+	}).Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"remaining": -1}}}, nil)
+	if err == nil {
+		return true
+	}
+	if err != mgo.ErrNotFound {
+		logError(err)
+	}
+	exhausted, err := collection.Find(bson.M{
+		"_id":       key,
+		"reset":     bson.M{"$gt": now},
+		"remaining": bson.M{"$lte": 0},
+	}).Count()
+	if err != nil {
+		logError(err)
+	}
+	return exhausted == 0
 }
 
 // AddImage adds new image data for the feed
 func (c *MongoInterface) AddImage(image ImageData) {
+	defer metrics.ObserveDB("AddImage", time.Now())
 	collection := getImageCollection(c.session)
+	if c.purgedImageIDs([]ImageData{image})[image.ID] {
+		return
+	}
 	// insert if it's not already there
 	_, err := collection.Upsert(bson.M{"_id": image.ID}, bson.M{"$set": image})
 	if err != nil {
@@ -66,12 +414,39 @@ func (c *MongoInterface) AddImage(image ImageData) {
 	}
 }
 
+// purgedImageIDs returns which of the images have been deleted by a
+// moderator, these are kept as tombstones so that they aren't stored again
+func (c *MongoInterface) purgedImageIDs(images []ImageData) map[string]bool {
+	ids := []string{}
+	for _, img := range images {
+		ids = append(ids, img.ID)
+	}
+	var purged []string
+	err := getImageCollection(c.session).Find(bson.M{
+		"_id":    bson.M{"$in": ids},
+		"purged": true,
+	}).Distinct("_id", &purged)
+	if err != nil {
+		logError(err)
+	}
+	result := map[string]bool{}
+	for _, id := range purged {
+		result[id] = true
+	}
+	return result
+}
+
 // AddBulkImagesToRegion adds new images in bulk, also setting the region
 func (c *MongoInterface) AddBulkImagesToRegion(images []ImageData,
 	region *Location) {
+	defer metrics.ObserveDB("AddBulkImagesToRegion", time.Now())
 	collection := getImageCollection(c.session)
+	purged := c.purgedImageIDs(images)
 	bulk := collection.Bulk()
 	for _, img := range images {
+		if purged[img.ID] {
+			continue
+		}
 		img.Region = region
 		// insert if it's not already there
 		bulk.Upsert(bson.M{"_id": img.ID}, bson.M{"$set": img})
@@ -80,10 +455,19 @@ func (c *MongoInterface) AddBulkImagesToRegion(images []ImageData,
 	if err != nil {
 		log.Fatal(err)
 	}
+	// regions are matched by their centre, which images are stored with
+	_, err = getRegionCollection(c.session).UpdateAll(
+		bson.M{"lat": region.Lat, "lng": region.Lng},
+		bson.M{"$set": bson.M{"last_populated": time.Now().Unix()}},
+	)
+	if err != nil {
+		logError(err)
+	}
 }
 
 // GetImages returns images closest to the specified location
 func (c *MongoInterface) GetImages(lat float64, lng float64, start int, end int) []ImageData {
+	defer metrics.ObserveDB("GetImages", time.Now())
 	if start == -1 {
 		start = 0
 	}
@@ -136,57 +520,318 @@ func (c *MongoInterface) GetImages(lat float64, lng float64, start int, end int)
 
 // GetAllImages returns all images stored
 func (c *MongoInterface) GetAllImages() []ImageData {
+	defer metrics.ObserveDB("GetAllImages", time.Now())
 	var response []ImageData
 	collection := getImageCollection(c.session)
-	err := collection.Find(nil).All(&response)
+	err := collection.Find(bson.M{"purged": nil}).All(&response)
 	if err != nil {
 		panic(err)
 	}
 	return response
 }
 
+// HasImage returns whether the image exists and hasn't been deleted by a
+// moderator, hidden images are included
+func (c *MongoInterface) HasImage(id string) bool {
+	defer metrics.ObserveDB("HasImage", time.Now())
+	count, err := getImageCollection(c.session).Find(bson.M{
+		"_id":    id,
+		"purged": nil,
+	}).Count()
+	if err != nil {
+		logError(err)
+		return false
+	}
+	return count > 0
+}
+
+// HasImageURL returns whether a visible image has this image or thumbnail URL
+func (c *MongoInterface) HasImageURL(url string) bool {
+	defer metrics.ObserveDB("HasImageURL", time.Now())
+	count, err := getImageCollection(c.session).Find(bson.M{
+		"$or":     []bson.M{{"url": url}, {"thumbnail_url": url}},
+		"deleted": nil,
+	}).Limit(1).Count()
+	if err != nil {
+		logError(err)
+		return false
+	}
+	return count > 0
+}
+
 // SoftDelete will add a delete field to image so it's no longer visible in
 // feed
 func (c *MongoInterface) SoftDelete(id string, reason string) {
+	defer metrics.ObserveDB("SoftDelete", time.Now())
 	collection := getImageCollection(c.session)
 	// update the image with a "deleted" field
 	err := collection.UpdateId(
 		id,
-		bson.M{"$set": bson.M{"deleted": true, "deleted_reason": reason}},
+		bson.M{"$set": bson.M{
+			"deleted":        true,
+			"deleted_reason": reason,
+			"deleted_time":   time.Now().Unix(),
+		}},
 	)
 	if err != nil {
-		fmt.Println(err)
+		logError(err)
 	}
 }
 
 // DeleteOldImages will clear `amount` worth of images starting at the oldest
 func (c *MongoInterface) DeleteOldImages(amount int) {
+	defer metrics.ObserveDB("DeleteOldImages", time.Now())
 	collection := getImageCollection(c.session)
 	change := mgo.Change{
 		Remove: true,
 	}
-	query := collection.Find(nil).Sort("createdTime")
+	// tombstones are kept, otherwise deleted images could be collected again
+	query := collection.Find(bson.M{"purged": nil}).Sort("createdTime")
 	// sort by the oldest images and remove those first
 	for i := 0; i < amount && c.Size() > 0; i++ {
 		_, err := query.Apply(change, nil)
 		if err != nil {
-			fmt.Println(err)
+			logError(err)
 		}
 	}
 }
 
 // Size will return the amount of images in the database
 func (c *MongoInterface) Size() int {
+	defer metrics.ObserveDB("Size", time.Now())
 	collection := getImageCollection(c.session)
 	// TODO: check error
-	count, _ := collection.Count()
+	count, _ := collection.Find(bson.M{"purged": nil}).Count()
 	return count
 }
 
+// CountImagesByRegion returns the amount of images stored in each region,
+// keyed by the region's centre
+func (c *MongoInterface) CountImagesByRegion() map[Location]int {
+	defer metrics.ObserveDB("CountImagesByRegion", time.Now())
+	collection := getImageCollection(c.session)
+	var results []struct {
+		Region *Location `bson:"_id"`
+		Count  int       `bson:"count"`
+	}
+	err := collection.Pipe([]bson.M{
+		{"$match": bson.M{"deleted": nil}},
+		{"$group": bson.M{"_id": "$region", "count": bson.M{"$sum": 1}}},
+	}).All(&results)
+	if err != nil {
+		logError(err)
+	}
+	counts := map[Location]int{}
+	for _, r := range results {
+		if r.Region != nil {
+			counts[*r.Region] = r.Count
+		}
+	}
+	return counts
+}
+
+// AddReport stores a pending report. Repeated reports of an image by the
+// same reporter replace their earlier pending report
+func (c *MongoInterface) AddReport(report Report) {
+	defer metrics.ObserveDB("AddReport", time.Now())
+	collection := getReportCollection(c.session)
+	_, err := collection.Upsert(bson.M{
+		"image_id": report.ImageID,
+		"reporter": report.Reporter,
+		"status":   ReportPending,
+	}, bson.M{"$set": bson.M{"reason": report.Reason, "time": report.Time}})
+	if err != nil {
+		logError(err)
+	}
+}
+
+// CountReporters returns how many different reporters have pending reports
+// of the image
+func (c *MongoInterface) CountReporters(imageID string) int {
+	defer metrics.ObserveDB("CountReporters", time.Now())
+	collection := getReportCollection(c.session)
+	var reporters []string
+	err := collection.Find(bson.M{"image_id": imageID, "status": ReportPending}).
+		Distinct("reporter", &reporters)
+	if err != nil {
+		logError(err)
+	}
+	return len(reporters)
+}
+
+// GetReportedImages returns the images with pending reports, most recently
+// reported first
+func (c *MongoInterface) GetReportedImages(limit int) []ReportedImage {
+	defer metrics.ObserveDB("GetReportedImages", time.Now())
+	var groups []struct {
+		ImageID string   `bson:"_id"`
+		Reports []Report `bson:"reports"`
+	}
+	err := getReportCollection(c.session).Pipe([]bson.M{
+		{"$match": bson.M{"status": ReportPending}},
+		{"$sort": bson.M{"time": -1}},
+		{"$group": bson.M{
+			"_id":     "$image_id",
+			"reports": bson.M{"$push": "$$ROOT"},
+			"latest":  bson.M{"$max": "$time"},
+		}},
+		{"$sort": bson.M{"latest": -1}},
+		{"$limit": limit},
+	}).All(&groups)
+	if err != nil {
+		logError(err)
+	}
+	ids := []string{}
+	for _, g := range groups {
+		ids = append(ids, g.ImageID)
+	}
+	var images []ReportedImage
+	err = getImageCollection(c.session).Find(bson.M{"_id": bson.M{"$in": ids}}).All(&images)
+	if err != nil {
+		logError(err)
+	}
+	byID := map[string]ReportedImage{}
+	for _, image := range images {
+		byID[image.ID] = image
+	}
+	reported := []ReportedImage{}
+	for _, g := range groups {
+		image, ok := byID[g.ImageID]
+		if !ok {
+			// the image may have been removed by hancleaner
+			image.ID = g.ImageID
+		}
+		image.Reports = g.Reports
+		reported = append(reported, image)
+	}
+	return reported
+}
+
+// ResolveReports sets the status of the image's pending reports, returning
+// how many were resolved
+func (c *MongoInterface) ResolveReports(imageID string, status string) int {
+	defer metrics.ObserveDB("ResolveReports", time.Now())
+	collection := getReportCollection(c.session)
+	info, err := collection.UpdateAll(
+		bson.M{"image_id": imageID, "status": ReportPending},
+		bson.M{"$set": bson.M{"status": status}},
+	)
+	if err != nil {
+		logError(err)
+		return 0
+	}
+	return info.Updated
+}
+
+// RestoreImage shows an image that was hidden
+func (c *MongoInterface) RestoreImage(id string) error {
+	defer metrics.ObserveDB("RestoreImage", time.Now())
+	collection := getImageCollection(c.session)
+	// deleted images can't be restored
+	err := collection.Update(bson.M{"_id": id, "purged": nil}, bson.M{"$unset": bson.M{
+		"deleted":        "",
+		"deleted_reason": "",
+		"deleted_time":   "",
+	}})
+	if err == mgo.ErrNotFound {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+// DeleteImage permanently removes an image's content. A tombstone is kept so
+// that collectors and partners can't store the image again
+func (c *MongoInterface) DeleteImage(id string) error {
+	defer metrics.ObserveDB("DeleteImage", time.Now())
+	err := getImageCollection(c.session).Update(bson.M{"_id": id, "purged": nil}, bson.M{
+		"$set": bson.M{
+			"deleted":      true,
+			"purged":       true,
+			"deleted_time": time.Now().Unix(),
+		},
+		"$unset": bson.M{
+			"caption":       "",
+			"url":           "",
+			"thumbnail_url": "",
+			"link":          "",
+			"user":          "",
+		},
+	})
+	if err == mgo.ErrNotFound {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+// AddModerationDecision records a moderator's decision
+func (c *MongoInterface) AddModerationDecision(decision ModerationDecision) {
+	defer metrics.ObserveDB("AddModerationDecision", time.Now())
+	err := getModerationCollection(c.session).Insert(decision)
+	if err != nil {
+		logError(err)
+	}
+}
+
+// GetModerationDecisions returns the most recent moderation decisions
+func (c *MongoInterface) GetModerationDecisions(limit int) []ModerationDecision {
+	defer metrics.ObserveDB("GetModerationDecisions", time.Now())
+	decisions := []ModerationDecision{}
+	err := getModerationCollection(c.session).Find(nil).
+		Sort("-time").Limit(limit).All(&decisions)
+	if err != nil {
+		logError(err)
+	}
+	return decisions
+}
+
+// Ping checks that the database can be reached
+func (c *MongoInterface) Ping() error {
+	defer metrics.ObserveDB("Ping", time.Now())
+	return c.session.Ping()
+}
+
+// EnsureIndexes creates the indexes used for lookups. Once this has succeeded
+// it won't query the database again
+func (c *MongoInterface) EnsureIndexes() error {
+	defer metrics.ObserveDB("EnsureIndexes", time.Now())
+	c.indexes.mutex.Lock()
+	defer c.indexes.mutex.Unlock()
+	if c.indexes.ensured {
+		return nil
+	}
+	indexes := []struct {
+		collection *mgo.Collection
+		index      mgo.Index
+	}{
+		{getImageCollection(c.session), mgo.Index{Key: []string{"$2dsphere:coordinates"}}},
+		{getRegionCollection(c.session), mgo.Index{Key: []string{"$2dsphere:coordinates"}}},
+		// local photos are only served if they're stored
+		{getImageCollection(c.session), mgo.Index{Key: []string{"url"}}},
+		{getImageCollection(c.session), mgo.Index{Key: []string{"thumbnail_url"}}},
+		// queries are only needed for the length of the longest quota window
+		{getQueryCollection(c.session), mgo.Index{
+			Key:         []string{"expires"},
+			ExpireAfter: maxQuotaWindow,
+		}},
+		// reports are looked up by image and listed when pending
+		{getReportCollection(c.session), mgo.Index{Key: []string{"image_id", "status"}}},
+		{getReportCollection(c.session), mgo.Index{Key: []string{"status", "-time"}}},
+		{getModerationCollection(c.session), mgo.Index{Key: []string{"-time"}}},
+	}
+	for _, i := range indexes {
+		if err := i.collection.EnsureIndex(i.index); err != nil {
+			return err
+		}
+	}
+	c.indexes.ensured = true
+	return nil
+}
+
 // Copy the interface for added concurrency
 func (c *MongoInterface) Copy() DatabaseInterface {
 	i := new(MongoInterface)
 	i.session = c.session.Copy()
+	i.indexes = c.indexes
 	return i
 }
 
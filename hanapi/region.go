@@ -0,0 +1,236 @@
+package hanapi
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kellydunn/golang-geo"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+)
+
+// ErrRegionNotFound is returned when a region ID does not match any region
+var ErrRegionNotFound = errors.New("region not found")
+
+// MaxRegionSize is the largest radius a region can have in meters. This
+// bounds how far away a region's centre can be when looking up a point
+const MaxRegionSize = 100000
+
+// Region is an area that is periodically populated with images
+type Region struct {
+	ID   bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Name string        `json:"name" bson:"name"`
+	Lat  float64       `json:"lat" bson:"lat"`
+	Lng  float64       `json:"lng" bson:"lng"`
+	// radius in meters, regions stored without one use `RegionSize`. For
+	// polygon regions this is the distance to the furthest vertex
+	Radius float64 `json:"radius" bson:"radius"`
+	// optional boundary, when set points must lie within this polygon
+	// rather than the radius to be in the region
+	Polygon []Location `json:"polygon,omitempty" bson:"polygon,omitempty"`
+	// disabled regions are still matched against but won't be populated
+	Disabled bool `json:"disabled" bson:"disabled"`
+	// the centre as lng, lat so that regions can be geospatially indexed
+	Coordinates []float64 `json:"-" bson:"coordinates"`
+	// unix time that images were last added to the region, zero if never
+	LastPopulated int64 `json:"last_populated" bson:"last_populated,omitempty"`
+}
+
+// RegionStats is a region along with the amount of images stored in it
+type RegionStats struct {
+	Region
+	ImageCount int `json:"image_count"`
+}
+
+// NewRegion returns a new region, a radius of zero or less will use the
+// default `RegionSize`
+func NewRegion(name string, lat float64, lng float64, radius float64) *Region {
+	r := new(Region)
+	r.Name = name
+	r.Lat = lat
+	r.Lng = lng
+	r.Radius = radius
+	if radius <= 0 {
+		r.Radius = RegionSize
+	}
+	r.Coordinates = []float64{lng, lat}
+	return r
+}
+
+// NewPolygonRegion returns a new region bounded by the polygon. The centre is
+// the average of the vertices
+func NewPolygonRegion(name string, polygon []Location) *Region {
+	lat, lng := float64(0), float64(0)
+	for _, p := range polygon {
+		lat += p.Lat
+		lng += p.Lng
+	}
+	if len(polygon) > 0 {
+		lat /= float64(len(polygon))
+		lng /= float64(len(polygon))
+	}
+	centre := geo.NewPoint(lat, lng)
+	radius := float64(0)
+	for _, p := range polygon {
+		distance := centre.GreatCircleDistance(geo.NewPoint(p.Lat, p.Lng)) * 1000
+		radius = math.Max(radius, distance)
+	}
+	r := NewRegion(name, lat, lng, math.Ceil(radius))
+	r.Polygon = polygon
+	return r
+}
+
+// Label identifies the region in logs and metrics, using its name if it has
+// one
+func (r *Region) Label() string {
+	if len(r.Name) > 0 {
+		return r.Name
+	}
+	if r.ID.Valid() {
+		return r.ID.Hex()
+	}
+	return fmt.Sprintf("%f,%f", r.Lat, r.Lng)
+}
+
+// Contains returns whether the point lies within the region's polygon or
+// radius
+func (r *Region) Contains(lat float64, lng float64) bool {
+	point := geo.NewPoint(lat, lng)
+	if len(r.Polygon) > 0 {
+		points := make([]*geo.Point, len(r.Polygon))
+		for i, p := range r.Polygon {
+			points[i] = geo.NewPoint(p.Lat, p.Lng)
+		}
+		return geo.NewPolygon(points).Contains(point)
+	}
+	centre := geo.NewPoint(r.Lat, r.Lng)
+	return centre.GreatCircleDistance(point) <= r.GetRadius()/1000
+}
+
+// GetRadius returns the radius of the region in meters
+func (r *Region) GetRadius() float64 {
+	if r.Radius <= 0 {
+		return RegionSize
+	}
+	return r.Radius
+}
+
+// Location returns the centre of the region
+func (r *Region) Location() *Location {
+	return NewLocation(r.Lat, r.Lng)
+}
+
+// Validate returns an error if the region cannot be stored
+func (r *Region) Validate() error {
+	if r.Lat < -90 || r.Lat > 90 {
+		return fmt.Errorf("invalid latitude %f", r.Lat)
+	}
+	if r.Lng < -180 || r.Lng > 180 {
+		return fmt.Errorf("invalid longitude %f", r.Lng)
+	}
+	if r.Radius < 0 || r.Radius > MaxRegionSize {
+		return fmt.Errorf("invalid radius %f, must be at most %d meters",
+			r.Radius, MaxRegionSize)
+	}
+	if len(r.Polygon) > 0 {
+		return ValidatePolygon(r.Polygon)
+	}
+	return nil
+}
+
+// ValidatePolygon returns an error if the polygon has fewer than 3 points or
+// any of its points are out of range. Regions without a polygon are circles,
+// so this should be used when a polygon is given but may be empty
+func ValidatePolygon(polygon []Location) error {
+	if len(polygon) < 3 {
+		return errors.New("polygon must have at least 3 points")
+	}
+	for _, p := range polygon {
+		if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+			return fmt.Errorf("invalid polygon point %f, %f", p.Lat, p.Lng)
+		}
+	}
+	return nil
+}
+
+// GetActiveRegions - returns the regions that have not been disabled
+func GetActiveRegions(db DatabaseInterface) []Region {
+	db, span := startSpan(db, "GetActiveRegions")
+	defer span.End()
+	active := []Region{}
+	for _, r := range db.GetRegions() {
+		if !r.Disabled {
+			active = append(active, r)
+		}
+	}
+	return active
+}
+
+// CreateRegion - adds a named region, unlike `AddRegion` this will be added
+// even if it overlaps an existing region
+func CreateRegion(db DatabaseInterface, region Region) (*Region, error) {
+	if err := region.Validate(); err != nil {
+		return nil, err
+	}
+	if region.Radius == 0 {
+		region.Radius = RegionSize
+	}
+	region.ID = bson.NewObjectId()
+	if err := db.AddRegion(region); err != nil {
+		return nil, err
+	}
+	return &region, nil
+}
+
+// RenameRegion - sets the name of the region with the specified ID
+func RenameRegion(db DatabaseInterface, id string, name string) (*Region, error) {
+	region, err := db.GetRegionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	region.Name = name
+	return region, db.UpdateRegion(*region)
+}
+
+// SetRegionDisabled - disabling a region stops it from being populated
+// without deleting it, so that image searches within it won't recreate it
+func SetRegionDisabled(db DatabaseInterface, id string, disabled bool) (*Region, error) {
+	region, err := db.GetRegionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	region.Disabled = disabled
+	return region, db.UpdateRegion(*region)
+}
+
+// DeleteRegion - removes the region. Images that were collected for this
+// region are left to be cleaned up by `hancleaner`
+func DeleteRegion(db DatabaseInterface, id string) error {
+	return db.DeleteRegion(id)
+}
+
+// ImportRegions - adds each region that isn't already covered by an existing
+// region, so that importing the same file twice has no effect
+// @return the amount of regions that were added
+func ImportRegions(db DatabaseInterface, regions []Region) (added int, err error) {
+	db, span := startSpan(db, "ImportRegions", attribute.Int("regions", len(regions)))
+	defer func() {
+		recordError(span, err)
+		span.End()
+	}()
+	for i := range regions {
+		if err := regions[i].Validate(); err != nil {
+			return 0, fmt.Errorf("region %d (%s): %s", i+1, regions[i].Name, err)
+		}
+	}
+	for _, r := range regions {
+		if ContainsRegion(db, r.Lat, r.Lng) {
+			continue
+		}
+		if _, err := CreateRegion(db, r); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
@@ -0,0 +1,210 @@
+package hanapi
+
+import (
+	"github.com/kellydunn/golang-geo"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestGetRegionUsesRegionRadius(t *testing.T) {
+	testRegion := NewLocation(-35.250327, 149.075300)
+	p := geo.NewPoint(testRegion.Lat, testRegion.Lng)
+	// outside of the default region size but within the custom radius
+	newPoint := p.PointAtDistanceAndBearing(8, 0)
+	db := NewMockDB([]Region{
+		*NewRegion("large", newPoint.Lat(), newPoint.Lng(), 10000),
+	}, []ImageData{})
+	result := GetRegion(db, testRegion.Lat, testRegion.Lng)
+	if result == nil || result.Name != "large" {
+		t.Error("Expected region match with custom radius, got", result)
+	}
+	db = NewMockDB([]Region{
+		*NewRegion("small", newPoint.Lat(), newPoint.Lng(), 0),
+	}, []ImageData{})
+	if GetRegion(db, testRegion.Lat, testRegion.Lng) != nil {
+		t.Error("Expected no region match with default radius")
+	}
+}
+
+func TestRegionManagement(t *testing.T) {
+	db := NewMockDB([]Region{}, []ImageData{})
+	region, err := CreateRegion(db, *NewRegion("Canberra", -35.28, 149.13, 8000))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	id := region.ID.Hex()
+	region, err = RenameRegion(db, id, "Civic")
+	if err != nil || region.Name != "Civic" || db.regions[0].Name != "Civic" {
+		t.Error("Expected region to be renamed but was", db.regions[0].Name, err)
+	}
+	_, err = SetRegionDisabled(db, id, true)
+	if err != nil || !db.regions[0].Disabled {
+		t.Error("Expected region to be disabled", err)
+	}
+	if len(GetActiveRegions(db)) != 0 {
+		t.Error("Expected disabled region to not be active")
+	}
+	if err := DeleteRegion(db, id); err != nil || len(db.regions) != 0 {
+		t.Error("Expected region to be deleted", err)
+	}
+	if _, err := RenameRegion(db, id, "missing"); err != ErrRegionNotFound {
+		t.Error("Expected", ErrRegionNotFound, "but was", err)
+	}
+	if _, err := CreateRegion(db, *NewRegion("", 91, 0, 0)); err == nil {
+		t.Error("Expected invalid latitude to fail")
+	}
+}
+
+func TestImportRegionsSkipsExisting(t *testing.T) {
+	db := NewMockDB([]Region{}, []ImageData{})
+	regions := []Region{
+		*NewRegion("Canberra", -35.28, 149.13, 0),
+		*NewRegion("Sydney", -33.87, 151.21, 0),
+	}
+	added, err := ImportRegions(db, regions)
+	if err != nil || added != 2 {
+		t.Error("Expected 2 regions to be added but was", added, err)
+	}
+	added, err = ImportRegions(db, regions)
+	if err != nil || added != 0 {
+		t.Error("Expected no regions to be added but was", added, err)
+	}
+}
+
+func TestParseRegionsCSV(t *testing.T) {
+	csv := "name,lat,lng,radius\nCanberra,-35.28,149.13,8000\nSydney, -33.87, 151.21\n"
+	regions, err := ParseRegionsCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(regions) != 2 {
+		t.Fatal("Expected 2 regions but was", len(regions))
+	}
+	if regions[0].Name != "Canberra" || regions[0].Radius != 8000 {
+		t.Error("Unexpected region", regions[0])
+	}
+	if regions[1].Lng != 151.21 || regions[1].Radius != RegionSize {
+		t.Error("Unexpected region", regions[1])
+	}
+	_, err = ParseRegionsCSV(strings.NewReader("Canberra,abc,149.13\n"))
+	if err == nil {
+		t.Error("Expected invalid latitude to fail")
+	}
+}
+
+func TestParseRegionsGeoJSON(t *testing.T) {
+	json := `{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "geometry": {"type": "Point", "coordinates": [149.13, -35.28]},
+		 "properties": {"name": "Canberra", "radius": 8000}}
+	]}`
+	regions, err := ParseRegionsGeoJSON(strings.NewReader(json))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(regions) != 1 {
+		t.Fatal("Expected 1 region but was", len(regions))
+	}
+	r := regions[0]
+	if r.Name != "Canberra" || r.Lat != -35.28 || r.Lng != 149.13 || r.Radius != 8000 {
+		t.Error("Unexpected region", r)
+	}
+}
+
+func TestGetRegionReturnsClosestOverlappingRegion(t *testing.T) {
+	testRegion := NewLocation(-35.250327, 149.075300)
+	p := geo.NewPoint(testRegion.Lat, testRegion.Lng)
+	far := p.PointAtDistanceAndBearing(4, 0)
+	near := p.PointAtDistanceAndBearing(2, 180)
+	db := NewMockDB([]Region{
+		*NewRegion("far", far.Lat(), far.Lng(), 0),
+		*NewRegion("near", near.Lat(), near.Lng(), 0),
+	}, []ImageData{})
+	result := GetRegion(db, testRegion.Lat, testRegion.Lng)
+	if result == nil || result.Name != "near" {
+		t.Error("Expected the closest region to match, got", result)
+	}
+	nearest := GetNearestRegion(db, far.Lat(), far.Lng())
+	if nearest == nil || nearest.Name != "far" {
+		t.Error("Expected nearest region to be far, got", nearest)
+	}
+	within := GetRegionsWithin(db, testRegion.Lat, testRegion.Lng, 3000)
+	if len(within) != 1 || within[0].Name != "near" {
+		t.Error("Expected only the near region to be within 3km, got", within)
+	}
+}
+
+func TestPolygonRegionContains(t *testing.T) {
+	square := []Location{
+		*NewLocation(-35.2, 149.0),
+		*NewLocation(-35.2, 149.2),
+		*NewLocation(-35.4, 149.2),
+		*NewLocation(-35.4, 149.0),
+	}
+	region := NewPolygonRegion("square", square)
+	if math.Abs(region.Lat+35.3) > 1e-9 || math.Abs(region.Lng-149.1) > 1e-9 {
+		t.Error("Expected centre of polygon but was", region.Lat, region.Lng)
+	}
+	if !region.Contains(-35.25, 149.05) {
+		t.Error("Expected point inside polygon to be contained")
+	}
+	// within the bounding radius but outside of the polygon
+	if region.Contains(-35.3, 149.21) {
+		t.Error("Expected point outside polygon to not be contained")
+	}
+	if err := region.Validate(); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	region.Polygon = square[:2]
+	if region.Validate() == nil {
+		t.Error("Expected polygon with 2 points to be invalid")
+	}
+	if ValidatePolygon([]Location{}) == nil {
+		t.Error("Expected empty polygon to be invalid")
+	}
+}
+
+func TestParseRegionsGeoJSONEmptyPolygon(t *testing.T) {
+	json := `{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"name": "Empty"}, "geometry": {
+			"type": "Polygon", "coordinates": [[]]
+		}}
+	]}`
+	if _, err := ParseRegionsGeoJSON(strings.NewReader(json)); err == nil {
+		t.Error("Expected a polygon without points to be invalid")
+	}
+}
+
+func TestParseRegionsGeoJSONPolygon(t *testing.T) {
+	json := `{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"name": "Park"}, "geometry": {
+			"type": "Polygon",
+			"coordinates": [[[149.0, -35.2], [149.2, -35.2], [149.2, -35.4], [149.0, -35.4], [149.0, -35.2]]]
+		}}
+	]}`
+	regions, err := ParseRegionsGeoJSON(strings.NewReader(json))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(regions) != 1 || len(regions[0].Polygon) != 4 {
+		t.Fatal("Expected a single polygon with 4 points but was", regions)
+	}
+	if regions[0].Name != "Park" || !regions[0].Contains(-35.3, 149.1) {
+		t.Error("Unexpected region", regions[0])
+	}
+}
+
+func TestRegionLabel(t *testing.T) {
+	if label := NewRegion("Canberra", -35.28, 149.13, 0).Label(); label != "Canberra" {
+		t.Error("Expected Canberra but was", label)
+	}
+	region := NewRegion("", -35.28, 149.13, 0)
+	if label := region.Label(); label != "-35.280000,149.130000" {
+		t.Error("Expected the location but was", label)
+	}
+	region.ID = bson.NewObjectId()
+	if label := region.Label(); label != region.ID.Hex() {
+		t.Error("Expected", region.ID.Hex(), "but was", label)
+	}
+}
@@ -0,0 +1,126 @@
+package hanapi
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseRegionsCSV reads regions from CSV rows in the form
+// `name,lat,lng[,radius]`. A header row starting with "name" is skipped
+func ParseRegionsCSV(r io.Reader) ([]Region, error) {
+	reader := csv.NewReader(r)
+	// radius is optional
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	regions := []Region{}
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && strings.EqualFold(record[0], "name") {
+			continue
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected name, lat, lng", i+1)
+		}
+		lat, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid latitude %q", i+1, record[1])
+		}
+		lng, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid longitude %q", i+1, record[2])
+		}
+		radius := float64(0)
+		if len(record) > 3 && len(record[3]) > 0 {
+			radius, err = strconv.ParseFloat(record[3], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid radius %q", i+1, record[3])
+			}
+		}
+		regions = append(regions, *NewRegion(record[0], lat, lng, radius))
+	}
+	return regions, nil
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// ParseRegionsGeoJSON reads regions from a GeoJSON FeatureCollection of
+// points or polygons. The optional properties "name" and "radius" (in meters)
+// are used, radius is ignored for polygons
+func ParseRegionsGeoJSON(r io.Reader) ([]Region, error) {
+	collection := geoJSONFeatureCollection{}
+	if err := json.NewDecoder(r).Decode(&collection); err != nil {
+		return nil, err
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected FeatureCollection but got %q", collection.Type)
+	}
+	regions := []Region{}
+	for i, f := range collection.Features {
+		name, _ := f.Properties["name"].(string)
+		switch f.Geometry.Type {
+		case "Point":
+			// GeoJSON is ordered lng, lat
+			coordinates := []float64{}
+			err := json.Unmarshal(f.Geometry.Coordinates, &coordinates)
+			if err != nil || len(coordinates) < 2 {
+				return nil, fmt.Errorf("feature %d: invalid coordinates", i+1)
+			}
+			radius, _ := f.Properties["radius"].(float64)
+			regions = append(regions, *NewRegion(name, coordinates[1], coordinates[0], radius))
+		case "Polygon":
+			rings := [][][]float64{}
+			err := json.Unmarshal(f.Geometry.Coordinates, &rings)
+			if err != nil || len(rings) == 0 {
+				return nil, fmt.Errorf("feature %d: invalid coordinates", i+1)
+			}
+			polygon, err := geoJSONRingToPolygon(rings[0])
+			if err != nil {
+				return nil, fmt.Errorf("feature %d: %s", i+1, err)
+			}
+			regions = append(regions, *NewPolygonRegion(name, polygon))
+		default:
+			return nil, fmt.Errorf("feature %d: unsupported geometry %q", i+1, f.Geometry.Type)
+		}
+	}
+	return regions, nil
+}
+
+// geoJSONRingToPolygon converts a linear ring, holes are not supported so only
+// the exterior ring should be used
+func geoJSONRingToPolygon(ring [][]float64) ([]Location, error) {
+	polygon := []Location{}
+	for _, position := range ring {
+		if len(position) < 2 {
+			return nil, fmt.Errorf("invalid position %v", position)
+		}
+		polygon = append(polygon, *NewLocation(position[1], position[0]))
+	}
+	// GeoJSON rings repeat the first position at the end
+	if len(polygon) > 1 && polygon[0] == polygon[len(polygon)-1] {
+		polygon = polygon[:len(polygon)-1]
+	}
+	if err := ValidatePolygon(polygon); err != nil {
+		return nil, err
+	}
+	return polygon, nil
+}
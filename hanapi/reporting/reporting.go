@@ -1,41 +1,189 @@
 package reporting
 
 import (
+	"context"
 	"fmt"
-	"github.com/oliveroneill/slack"
+	"github.com/oliveroneill/hanserver/hanapi/secrets"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Level is the severity of a log entry
+type Level int
+
+const (
+	// Debug is used for detail that's only useful when investigating issues
+	Debug Level = iota
+	// Info is used for normal operation, such as collectors populating
+	Info
+	// Warn is used for problems that don't need immediate attention
+	Warn
+	// Error is used for failures that should be looked at
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	}
+	return "error"
+}
+
+// MarshalText is used so that levels are readable in JSON
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// ParseLevel returns the level with the name `debug`, `info`, `warn` or
+// `error`
+func ParseLevel(name string) (Level, error) {
+	for _, level := range []Level{Debug, Info, Warn, Error} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", name)
+}
+
+// Fields add context to an entry, such as the collector, region or
+// request_id
+type Fields map[string]interface{}
+
+// Entry is a single message sent to each sink
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  Fields
+}
+
+// Sink is somewhere that log entries are written, such as stdout or Slack
+type Sink interface {
+	Write(entry Entry)
+	// Close sends any entries that are buffered
+	Close()
+}
+
 // Logger used to log errors or messages
 type Logger interface {
-	Log(message string)
+	// Log sends the message to each sink, if it's at least the logger's level
+	Log(level Level, message string, fields Fields)
+	// With returns a logger that adds the fields to each entry
+	With(fields Fields) Logger
+	// Close sends any entries that sinks have buffered, this should be called
+	// before exiting
+	Close()
 }
 
-// SlackLogger is an implementation used for logging to slack
-type SlackLogger struct {
-	Logger
-	apiToken string
+// multiLogger is a Logger that fans out to multiple sinks
+type multiLogger struct {
+	level  Level
+	sinks  []Sink
+	fields Fields
 }
 
-// NewSlackLogger creates a Logger that sends messages to Slack
-func NewSlackLogger(apiToken string) *SlackLogger {
-	l := new(SlackLogger)
-	l.apiToken = apiToken
-	return l
+// NewLogger creates a Logger that writes each entry to every sink
+// @param level - entries below this level are ignored
+func NewLogger(level Level, sinks ...Sink) Logger {
+	return &multiLogger{
+		level:  level,
+		sinks:  sinks,
+		fields: Fields{},
+	}
 }
 
-// Log will log the specified message to Slack under the `hanserver` channel
-func (l *SlackLogger) Log(message string) {
-	if len(l.apiToken) == 0 {
-		fmt.Println("No Slack API token set. Logging disabled")
+func (l *multiLogger) Log(level Level, message string, fields Fields) {
+	if level < l.level {
 		return
 	}
-	// notify through Slack bot
-	channelName := "hanserver"
-	api := slack.New(l.apiToken)
-	params := slack.PostMessageParameters{}
-	_, _, err := api.PostMessage(channelName, message, params)
-	if err != nil {
-		fmt.Println(err)
-		return
+	entry := Entry{
+		Time:  time.Now().UTC(),
+		Level: level,
+		// errors can include request URLs that contain credentials
+		Message: secrets.Redact(message),
+		Fields:  Fields{},
+	}
+	for key, value := range l.fields {
+		entry.Fields[key] = value
+	}
+	for key, value := range fields {
+		entry.Fields[key] = value
+	}
+	for key, value := range entry.Fields {
+		switch v := value.(type) {
+		case error:
+			entry.Fields[key] = secrets.Redact(v.Error())
+		case string:
+			entry.Fields[key] = secrets.Redact(v)
+		}
+	}
+	for _, sink := range l.sinks {
+		sink.Write(entry)
+	}
+}
+
+func (l *multiLogger) With(fields Fields) Logger {
+	merged := Fields{}
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &multiLogger{
+		level:  l.level,
+		sinks:  l.sinks,
+		fields: merged,
+	}
+}
+
+func (l *multiLogger) Close() {
+	for _, sink := range l.sinks {
+		sink.Close()
+	}
+}
+
+// defaultLogger is used by code that isn't given a logger, such as the
+// database
+var defaultLogger = NewLogger(Info, NewStreamSink(os.Stdout))
+var defaultMutex sync.Mutex
+
+// Default returns the logger used when one isn't given. This writes JSON to
+// stdout until `SetDefault` is called
+func Default() Logger {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the logger used when one isn't given, this should be
+// called with the configured logger on startup
+func SetDefault(logger Logger) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultLogger = logger
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger, this is used to add
+// fields such as request_id to everything logged while handling a request
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger added with `NewContext`, or the default
+// logger
+func FromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(contextKey{}).(Logger); ok {
+		return logger
 	}
+	return Default()
 }
@@ -0,0 +1,151 @@
+package reporting
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/oliveroneill/hanserver/hanapi/secrets"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockSink struct {
+	entries []Entry
+	closed  bool
+}
+
+func (s *mockSink) Write(entry Entry) {
+	s.entries = append(s.entries, entry)
+}
+
+func (s *mockSink) Close() {
+	s.closed = true
+}
+
+func TestLoggerLevelsAndFields(t *testing.T) {
+	sink := &mockSink{}
+	logger := NewLogger(Info, sink)
+	logger.Log(Debug, "ignored", nil)
+	collectorLogger := logger.With(Fields{"collector": "twitter"})
+	collectorLogger.Log(Error, "failed", Fields{"region": "Canberra"})
+	if len(sink.entries) != 1 {
+		t.Fatal("Expected 1 entry but was", sink.entries)
+	}
+	entry := sink.entries[0]
+	if entry.Level != Error || entry.Message != "failed" {
+		t.Error("Unexpected entry", entry)
+	}
+	if entry.Fields["collector"] != "twitter" || entry.Fields["region"] != "Canberra" {
+		t.Error("Expected fields to be merged but was", entry.Fields)
+	}
+	logger.Close()
+	if !sink.closed {
+		t.Error("Expected sinks to be closed")
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	secrets.Register("logger-secret-token")
+	sink := &mockSink{}
+	logger := NewLogger(Debug, sink)
+	logger.Log(Error, "failed with logger-secret-token", Fields{
+		"error": errors.New("GET ?access_token=logger-secret-token"),
+	})
+	entry := sink.entries[0]
+	if strings.Contains(entry.Message, "logger-secret-token") ||
+		strings.Contains(entry.Fields["error"].(string), "logger-secret-token") {
+		t.Error("Expected secrets to be redacted but was", entry)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	if err != nil || level != Warn {
+		t.Error("Expected", Warn, "but was", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+}
+
+func TestStreamSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewStreamSink(buf)
+	sink.Write(Entry{
+		Time:    time.Unix(0, 0).UTC(),
+		Level:   Warn,
+		Message: "Circuit breaker changed state",
+		Fields:  Fields{"collector": "flickr"},
+	})
+	expected := `{"collector":"flickr","level":"warn","message":"Circuit breaker changed state","time":"1970-01-01T00:00:00Z"}` + "\n"
+	if buf.String() != expected {
+		t.Error("Expected", expected, "but was", buf.String())
+	}
+}
+
+func TestSlackSinkBatchesAndDeduplicates(t *testing.T) {
+	messages := []string{}
+	channels := []string{}
+	sink := newSlackSink(SlackConfig{
+		Channel:       "alerts",
+		Level:         Warn,
+		BatchInterval: time.Hour,
+		DedupWindow:   time.Minute,
+	}, func(channel string, text string) error {
+		channels = append(channels, channel)
+		messages = append(messages, text)
+		return nil
+	})
+	now := time.Unix(1000, 0)
+	sink.now = func() time.Time { return now }
+	failure := Entry{Level: Error, Message: "failed", Fields: Fields{"collector": "twitter"}}
+	sink.Write(Entry{Level: Info, Message: "ignored"})
+	sink.Write(failure)
+	sink.Write(failure)
+	sink.Write(Entry{Level: Warn, Message: "reported"})
+	sink.batch.flush()
+	expected := "[ERROR] failed (collector=twitter)\n[WARN] reported"
+	if len(messages) != 1 || messages[0] != expected || channels[0] != "alerts" {
+		t.Fatal("Expected", expected, "but was", messages, channels)
+	}
+	// repeats are sent again after the window, with the amount suppressed
+	now = now.Add(2 * time.Minute)
+	sink.Write(failure)
+	sink.Close()
+	expected = "[ERROR] failed (collector=twitter, repeated=1)"
+	if len(messages) != 2 || messages[1] != expected {
+		t.Error("Expected", expected, "but was", messages)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mutex sync.Mutex
+	received := []map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Entries []map[string]interface{} `json:"entries"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mutex.Lock()
+		received = append(received, body.Entries...)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+	sink := NewWebhookSink(WebhookConfig{URL: server.URL, Level: Warn, BatchInterval: time.Hour})
+	sink.Write(Entry{Level: Info, Message: "ignored"})
+	sink.Write(Entry{Level: Error, Message: "failed", Fields: Fields{"request_id": "abc"}})
+	sink.Close()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 1 {
+		t.Fatal("Expected 1 entry but was", received)
+	}
+	if received[0]["message"] != "failed" || received[0]["level"] != "error" ||
+		received[0]["request_id"] != "abc" {
+		t.Error("Unexpected entry", received[0])
+	}
+}
@@ -0,0 +1,323 @@
+package reporting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi/secrets"
+	"github.com/oliveroneill/slack"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchEntries is the most entries buffered before a batch is sent early
+const maxBatchEntries = 50
+
+// webhookTimeout is how long a webhook can take before the batch is dropped
+const webhookTimeout = 10 * time.Second
+
+// MarshalJSON writes the entry as a single object, with its fields alongside
+// the time, level and message
+func (e Entry) MarshalJSON() ([]byte, error) {
+	object := map[string]interface{}{}
+	for key, value := range e.Fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		object[key] = value
+	}
+	object["time"] = e.Time.Format(time.RFC3339Nano)
+	object["level"] = e.Level
+	object["message"] = e.Message
+	return json.Marshal(object)
+}
+
+// text formats the entry for people to read, eg. in Slack
+func (e Entry) text() string {
+	keys := []string{}
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields := []string{}
+	for _, key := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%v", key, e.Fields[key]))
+	}
+	text := fmt.Sprintf("[%s] %s", strings.ToUpper(e.Level.String()), e.Message)
+	if len(fields) > 0 {
+		text += " (" + strings.Join(fields, ", ") + ")"
+	}
+	return text
+}
+
+// streamSink writes each entry as a line of JSON
+type streamSink struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewStreamSink creates a Sink that writes each entry to w as a line of
+// JSON, use this with stdout
+func NewStreamSink(w io.Writer) Sink {
+	return &streamSink{w: w}
+}
+
+func (s *streamSink) Write(entry Entry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":"error","message":%q}`, err.Error()))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.w.Write(append(data, '\n'))
+}
+
+func (s *streamSink) Close() {}
+
+// batcher buffers entries and sends them together at an interval
+type batcher struct {
+	pending []Entry
+	mutex   sync.Mutex
+	send    func(entries []Entry)
+	full    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newBatcher starts sending buffered entries at the interval, entries are
+// sent as they're written if the interval is 0
+func newBatcher(interval time.Duration, send func(entries []Entry)) *batcher {
+	b := &batcher{
+		send: send,
+		full: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(b.done)
+		return b
+	}
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+				b.flush()
+			case <-b.full:
+				b.flush()
+			}
+		}
+	}()
+	return b
+}
+
+func (b *batcher) add(entry Entry) {
+	b.mutex.Lock()
+	b.pending = append(b.pending, entry)
+	count := len(b.pending)
+	b.mutex.Unlock()
+	select {
+	case <-b.done:
+		// not batching
+		b.flush()
+		return
+	default:
+	}
+	if count >= maxBatchEntries {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *batcher) flush() {
+	b.mutex.Lock()
+	entries := b.pending
+	b.pending = nil
+	b.mutex.Unlock()
+	if len(entries) > 0 {
+		b.send(entries)
+	}
+}
+
+// close stops batching and sends any remaining entries
+func (b *batcher) close() {
+	b.once.Do(func() {
+		close(b.stop)
+	})
+	<-b.done
+	b.flush()
+}
+
+// SlackConfig specifies how entries are sent to Slack
+type SlackConfig struct {
+	Token   string
+	Channel string
+	// Level is the lowest level that's sent
+	Level Level
+	// BatchInterval is how often buffered entries are sent as one message,
+	// entries are sent immediately if this is 0
+	BatchInterval time.Duration
+	// DedupWindow is how long repeats of an entry are suppressed for, the
+	// amount suppressed is included once it's sent again
+	DedupWindow time.Duration
+}
+
+type slackSink struct {
+	config SlackConfig
+	batch  *batcher
+	// when each entry was last sent and how many repeats were suppressed
+	seen  map[string]*seenEntry
+	mutex sync.Mutex
+	// used to control time in tests
+	now  func() time.Time
+	post func(channel string, text string) error
+}
+
+type seenEntry struct {
+	sent       time.Time
+	suppressed int
+}
+
+// NewSlackSink creates a Sink that sends entries to a Slack channel
+func NewSlackSink(c SlackConfig) Sink {
+	client := slack.New(c.Token)
+	return newSlackSink(c, func(channel string, text string) error {
+		_, _, err := client.PostMessage(channel, text, slack.PostMessageParameters{})
+		return err
+	})
+}
+
+func newSlackSink(c SlackConfig, post func(channel string, text string) error) *slackSink {
+	s := &slackSink{
+		config: c,
+		seen:   map[string]*seenEntry{},
+		now:    time.Now,
+		post:   post,
+	}
+	s.batch = newBatcher(c.BatchInterval, s.send)
+	return s
+}
+
+func (s *slackSink) Write(entry Entry) {
+	if entry.Level < s.config.Level {
+		return
+	}
+	// repeated errors such as a collector failing every update would
+	// otherwise flood the channel
+	key := entry.Level.String() + entry.text()
+	now := s.now()
+	s.mutex.Lock()
+	previous, ok := s.seen[key]
+	if ok && now.Sub(previous.sent) < s.config.DedupWindow {
+		previous.suppressed++
+		s.mutex.Unlock()
+		return
+	}
+	s.seen[key] = &seenEntry{sent: now}
+	s.pruneSeen(now)
+	s.mutex.Unlock()
+	if ok && previous.suppressed > 0 {
+		fields := Fields{}
+		for k, v := range entry.Fields {
+			fields[k] = v
+		}
+		fields["repeated"] = previous.suppressed
+		entry.Fields = fields
+	}
+	s.batch.add(entry)
+}
+
+// pruneSeen forgets entries that are outside of the window. Suppressed
+// repeats are kept for another window in case the entry is sent again. This
+// must be called with the mutex held
+func (s *slackSink) pruneSeen(now time.Time) {
+	for key, seen := range s.seen {
+		age := now.Sub(seen.sent)
+		if age >= 2*s.config.DedupWindow || (age >= s.config.DedupWindow && seen.suppressed == 0) {
+			delete(s.seen, key)
+		}
+	}
+}
+
+func (s *slackSink) send(entries []Entry) {
+	lines := []string{}
+	for _, entry := range entries {
+		lines = append(lines, entry.text())
+	}
+	if err := s.post(s.config.Channel, strings.Join(lines, "\n")); err != nil {
+		// this can't be logged without failing again
+		fmt.Fprintln(os.Stderr, "Slack logging failed:", secrets.Redact(err.Error()))
+	}
+}
+
+func (s *slackSink) Close() {
+	s.batch.close()
+}
+
+// WebhookConfig specifies where entries are posted
+type WebhookConfig struct {
+	URL string
+	// Level is the lowest level that's sent
+	Level Level
+	// BatchInterval is how often buffered entries are posted, entries are
+	// posted immediately if this is 0
+	BatchInterval time.Duration
+}
+
+type webhookSink struct {
+	config WebhookConfig
+	client *http.Client
+	batch  *batcher
+}
+
+// NewWebhookSink creates a Sink that posts entries to a URL as JSON, in the
+// form `{"entries": [...]}`
+func NewWebhookSink(c WebhookConfig) Sink {
+	s := &webhookSink{
+		config: c,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+	s.batch = newBatcher(c.BatchInterval, s.send)
+	return s
+}
+
+func (s *webhookSink) Write(entry Entry) {
+	if entry.Level < s.config.Level {
+		return
+	}
+	s.batch.add(entry)
+}
+
+func (s *webhookSink) send(entries []Entry) {
+	body, err := json.Marshal(map[string][]Entry{"entries": entries})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Webhook logging failed:", err)
+		return
+	}
+	res, err := s.client.Post(s.config.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the error includes the URL, which may contain a token
+		fmt.Fprintln(os.Stderr, "Webhook logging failed:", secrets.Redact(err.Error()))
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		fmt.Fprintln(os.Stderr, "Webhook logging failed with status", res.StatusCode)
+	}
+}
+
+func (s *webhookSink) Close() {
+	s.batch.close()
+}
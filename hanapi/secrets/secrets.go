@@ -0,0 +1,150 @@
+// Package secrets resolves credentials that are referenced from configuration
+// rather than written in it, and keeps them out of logs.
+//
+// A configuration value of `env:NAME` is replaced with the environment
+// variable NAME and `file:/path` with the contents of the file, such as a
+// Docker or Kubernetes secret. Other values are used as they are
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in logs and configuration dumps
+const Redacted = "[REDACTED]"
+
+const envPrefix = "env:"
+const filePrefix = "file:"
+
+// known are the secrets that have been loaded, so that they can be redacted
+var known = map[string]struct{}{}
+var knownMutex sync.Mutex
+
+// Resolve returns the value that a reference points to, values that aren't
+// references are returned unchanged
+func Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, envPrefix):
+		name := strings.TrimPrefix(value, envPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return value, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, filePrefix):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, filePrefix))
+		if err != nil {
+			return value, err
+		}
+		// secret files commonly end with a newline
+		return strings.TrimSpace(string(data)), nil
+	}
+	return value, nil
+}
+
+// ResolveFields resolves references in each string field of the struct that
+// v points to, including embedded structs. Fields tagged `secret:"true"` are
+// registered so that they're redacted. A problem is returned for each
+// reference that couldn't be resolved
+func ResolveFields(v interface{}) []string {
+	problems := []string{}
+	eachField(reflect.ValueOf(v), func(field reflect.StructField, value reflect.Value) {
+		resolved, err := Resolve(value.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", fieldName(field), err))
+			return
+		}
+		value.SetString(resolved)
+		if field.Tag.Get("secret") == "true" {
+			Register(resolved)
+		}
+	})
+	return problems
+}
+
+// Register adds a secret that should be redacted from logs
+func Register(secret string) {
+	if len(secret) == 0 {
+		return
+	}
+	knownMutex.Lock()
+	defer knownMutex.Unlock()
+	known[secret] = struct{}{}
+}
+
+// Redact replaces every registered secret within the message
+func Redact(message string) string {
+	knownMutex.Lock()
+	secrets := []string{}
+	for secret := range known {
+		secrets = append(secrets, secret)
+	}
+	knownMutex.Unlock()
+	// replace longer secrets first in case one contains another
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	for _, secret := range secrets {
+		message = strings.Replace(message, secret, Redacted, -1)
+	}
+	return message
+}
+
+// RedactFields returns a copy of the struct that v points to, with each field
+// tagged `secret:"true"` replaced so that it can be dumped safely
+func RedactFields(v interface{}) interface{} {
+	original := reflect.ValueOf(v)
+	if original.Kind() != reflect.Ptr || original.IsNil() {
+		return v
+	}
+	copied := reflect.New(original.Elem().Type())
+	copied.Elem().Set(original.Elem())
+	eachField(copied, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("secret") == "true" && value.Len() > 0 {
+			value.SetString(Redacted)
+		}
+	})
+	return copied.Interface()
+}
+
+// eachField calls f with each settable string field of the struct that v
+// points to, including the fields of embedded structs
+func eachField(v reflect.Value, f func(field reflect.StructField, value reflect.Value)) {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+		if !value.CanSet() {
+			continue
+		}
+		switch value.Kind() {
+		case reflect.String:
+			f(field, value)
+		case reflect.Struct:
+			if field.Anonymous {
+				eachField(value.Addr(), f)
+			}
+		}
+	}
+}
+
+// fieldName returns the name used in json, so that problems can be found in
+// the configuration file
+func fieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if len(name) == 0 || name == "-" {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,78 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token" secret:"true"`
+	Embedded
+}
+
+type Embedded struct {
+	Key string `json:"key" secret:"true"`
+}
+
+func TestResolve(t *testing.T) {
+	t.Setenv("HAN_TEST_SECRET", "from-env")
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"plain":                "plain",
+		"env:HAN_TEST_SECRET":  "from-env",
+		"file:" + path:         "from-file",
+		"environment:variable": "environment:variable",
+	}
+	for value, expected := range cases {
+		resolved, err := Resolve(value)
+		if err != nil || resolved != expected {
+			t.Error("Expected", expected, "but was", resolved, err)
+		}
+	}
+	if _, err := Resolve("env:HAN_TEST_MISSING"); err == nil {
+		t.Error("Expected error for missing environment variable")
+	}
+	if _, err := Resolve("file:" + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestResolveFields(t *testing.T) {
+	t.Setenv("HAN_TEST_TOKEN", "resolved-token")
+	c := &testConfig{
+		Name:     "env:HAN_TEST_MISSING",
+		Token:    "env:HAN_TEST_TOKEN",
+		Embedded: Embedded{Key: "literal-key"},
+	}
+	problems := ResolveFields(c)
+	expected := "name: environment variable HAN_TEST_MISSING is not set"
+	if len(problems) != 1 || problems[0] != expected {
+		t.Error("Expected", expected, "but was", problems)
+	}
+	if c.Token != "resolved-token" || c.Key != "literal-key" {
+		t.Error("Unexpected fields", c)
+	}
+	// both resolved and literal secrets are redacted
+	message := Redact("failed with resolved-token and literal-key")
+	if strings.Contains(message, "resolved-token") || strings.Contains(message, "literal-key") {
+		t.Error("Expected secrets to be redacted but was", message)
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	c := &testConfig{Name: "name", Token: "token", Embedded: Embedded{}}
+	redacted := RedactFields(c).(*testConfig)
+	if redacted.Name != "name" || redacted.Token != Redacted || redacted.Key != "" {
+		t.Error("Unexpected redaction", redacted)
+	}
+	// the original is unchanged
+	if c.Token != "token" {
+		t.Error("Expected original to be kept but was", c.Token)
+	}
+}
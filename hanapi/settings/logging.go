@@ -0,0 +1,70 @@
+package settings
+
+import (
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"os"
+)
+
+// NewLogger creates a logger that writes JSON to stdout, and to Slack and
+// each webhook if they're configured. This should be closed before exiting
+// so that batched entries are sent
+func (c LoggingConfig) NewLogger() reporting.Logger {
+	// levels have been validated
+	level, _ := reporting.ParseLevel(c.Level)
+	sinks := []reporting.Sink{reporting.NewStreamSink(os.Stdout)}
+	if len(c.SlackToken) > 0 {
+		slackLevel, _ := reporting.ParseLevel(c.SlackLevel)
+		sinks = append(sinks, reporting.NewSlackSink(reporting.SlackConfig{
+			Token:         c.SlackToken,
+			Channel:       c.SlackChannel,
+			Level:         slackLevel,
+			BatchInterval: Seconds(c.BatchInterval),
+			DedupWindow:   Seconds(c.DedupWindow),
+		}))
+	}
+	for _, webhook := range c.Webhooks {
+		webhookLevel, _ := reporting.ParseLevel(webhook.level())
+		sinks = append(sinks, reporting.NewWebhookSink(reporting.WebhookConfig{
+			URL:           webhook.URL,
+			Level:         webhookLevel,
+			BatchInterval: Seconds(c.BatchInterval),
+		}))
+	}
+	return reporting.NewLogger(level, sinks...)
+}
+
+func (c WebhookConfig) level() string {
+	if len(c.Level) == 0 {
+		return "error"
+	}
+	return c.Level
+}
+
+func (c LoggingConfig) validate() Errors {
+	problems := Errors{}
+	if _, err := reporting.ParseLevel(c.Level); err != nil {
+		problems = append(problems, "logging.level: "+err.Error())
+	}
+	if _, err := reporting.ParseLevel(c.SlackLevel); err != nil {
+		problems = append(problems, "logging.slack_level: "+err.Error())
+	}
+	if len(c.SlackToken) > 0 && len(c.SlackChannel) == 0 {
+		problems = append(problems, "logging.slack_channel is required")
+	}
+	if c.BatchInterval < 0 {
+		problems = append(problems, "logging.batch_interval can't be negative")
+	}
+	if c.DedupWindow < 0 {
+		problems = append(problems, "logging.dedup_window can't be negative")
+	}
+	for i, webhook := range c.Webhooks {
+		if len(webhook.URL) == 0 {
+			problems = append(problems, fmt.Sprintf("logging.webhooks[%d].url is required", i))
+		}
+		if _, err := reporting.ParseLevel(webhook.level()); err != nil {
+			problems = append(problems, fmt.Sprintf("logging.webhooks[%d].level: %s", i, err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,442 @@
+// Package settings is the configuration shared by hanhttpserver, hancollector
+// and hancleaner. Settings are read from a json file, then environment
+// variables and then command line flags, with later sources taking precedence
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi/secrets"
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of every han component
+type Config struct {
+	Storage    StorageConfig    `json:"storage"`
+	HTTP       HTTPConfig       `json:"http"`
+	Cleaning   CleaningConfig   `json:"cleaning"`
+	Moderation ModerationConfig `json:"moderation"`
+	Logging    LoggingConfig    `json:"logging"`
+	Metrics    MetricsConfig    `json:"metrics"`
+	Tracing    TracingConfig    `json:"tracing"`
+	// Collectors is decoded separately since each collector type has its own
+	// configuration
+	Collectors config.CollectionConfig `json:"-"`
+}
+
+// StorageConfig specifies the database
+type StorageConfig struct {
+	// MongoURL may contain credentials, which are redacted rather than the
+	// whole URL so that the database host can still be seen in logs
+	MongoURL string `json:"mongo_url" env:"HAN_MONGO_URL"`
+}
+
+// HTTPConfig is used by hanhttpserver, timeouts are in seconds
+type HTTPConfig struct {
+	Address         string `json:"address" env:"HAN_HTTP_ADDRESS"`
+	ReadTimeout     int64  `json:"read_timeout" env:"HAN_HTTP_READ_TIMEOUT"`
+	WriteTimeout    int64  `json:"write_timeout" env:"HAN_HTTP_WRITE_TIMEOUT"`
+	ShutdownTimeout int64  `json:"shutdown_timeout" env:"HAN_HTTP_SHUTDOWN_TIMEOUT"`
+	// AdminToken is required to use the admin endpoints, these are disabled
+	// if it's empty
+	AdminToken string `json:"admin_token" env:"HAN_ADMIN_TOKEN" secret:"true"`
+	// PartnersFile is a json file mapping partner names to the secret used
+	// to sign images pushed to the ingestion endpoint
+	PartnersFile string `json:"partners_file" env:"HAN_PARTNERS_FILE"`
+	// NoCollection stops hanhttpserver from collecting images itself
+	NoCollection bool `json:"no_collection" env:"HAN_NO_COLLECTION"`
+	// Partners is read from PartnersFile
+	Partners map[string]string `json:"-"`
+}
+
+// CleaningConfig is used by hancleaner
+type CleaningConfig struct {
+	// ImageLimit is the maximum amount of images allowed in the database
+	// before cleaning up
+	ImageLimit int `json:"image_limit" env:"HAN_CLEANING_IMAGE_LIMIT"`
+	// ClearCount is the amount of images cleared when reaching the limit
+	ClearCount int `json:"clear_count" env:"HAN_CLEANING_CLEAR_COUNT"`
+	// Frequency in seconds at which the database is checked
+	Frequency int64 `json:"frequency" env:"HAN_CLEANING_FREQUENCY"`
+}
+
+// ModerationConfig decides when reported images are hidden before being
+// moderated
+type ModerationConfig struct {
+	// ReportThreshold is how many different reporters must report an image
+	// before it's hidden
+	ReportThreshold int `json:"report_threshold" env:"HAN_MODERATION_REPORT_THRESHOLD"`
+	// ReasonThresholds overrides the threshold for specific report reasons
+	ReasonThresholds map[string]int `json:"reason_thresholds"`
+}
+
+// LoggingConfig specifies where log entries are written, see `NewLogger`
+type LoggingConfig struct {
+	// Level is the lowest level written to stdout: debug, info, warn or
+	// error
+	Level      string `json:"level" env:"HAN_LOG_LEVEL"`
+	SlackToken string `json:"slack_token" env:"HAN_SLACK_TOKEN" secret:"true"`
+	// SlackChannel is where entries are posted if there's a token
+	SlackChannel string `json:"slack_channel" env:"HAN_SLACK_CHANNEL"`
+	// SlackLevel is the lowest level posted to Slack
+	SlackLevel string `json:"slack_level" env:"HAN_SLACK_LEVEL"`
+	// BatchInterval in seconds at which entries are sent to Slack and
+	// webhooks together
+	BatchInterval int64 `json:"batch_interval" env:"HAN_LOG_BATCH_INTERVAL"`
+	// DedupWindow in seconds during which repeats of an entry aren't sent to
+	// Slack again
+	DedupWindow int64 `json:"dedup_window" env:"HAN_LOG_DEDUP_WINDOW"`
+	// Webhooks are sent entries as JSON
+	Webhooks []WebhookConfig `json:"webhooks"`
+}
+
+// WebhookConfig is a URL that log entries are posted to
+type WebhookConfig struct {
+	URL string `json:"url" secret:"true"`
+	// Level is the lowest level posted, this defaults to error
+	Level string `json:"level"`
+}
+
+// MetricsConfig specifies where Prometheus metrics are served
+type MetricsConfig struct {
+	// Address that /metrics is served on. hanhttpserver serves it alongside
+	// the API, requiring the admin token, when this is empty, while
+	// hancollector and hancleaner only serve metrics if this is set
+	Address string `json:"address" env:"HAN_METRICS_ADDRESS"`
+}
+
+// TracingConfig specifies where OpenTelemetry spans are exported, see
+// `TracingConfig.Start`
+type TracingConfig struct {
+	// Exporter is `none`, `stdout` or `otlp`
+	Exporter string `json:"exporter" env:"HAN_TRACING_EXPORTER"`
+	// Endpoint is the host and port of the OTLP collector, using HTTP
+	Endpoint string `json:"endpoint" env:"HAN_TRACING_ENDPOINT"`
+	// Insecure sends spans without TLS, which is fine for a local collector
+	Insecure bool `json:"insecure" env:"HAN_TRACING_INSECURE"`
+	// SampleRatio is the fraction of traces recorded, between 0 and 1.
+	// Requests that are part of a caller's trace follow the caller's choice
+	SampleRatio float64 `json:"sample_ratio" env:"HAN_TRACING_SAMPLE_RATIO"`
+}
+
+// Errors lists every problem found in the configuration, so that they can all
+// be fixed at once
+type Errors []string
+
+func (e Errors) Error() string {
+	return "Invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Default returns the configuration used when nothing is specified
+func Default() *Config {
+	return &Config{
+		Storage: StorageConfig{
+			// use for Docker, use "localhost:27017" locally
+			MongoURL: "mongodb",
+		},
+		HTTP: HTTPConfig{
+			Address:         ":80",
+			ReadTimeout:     2 * 60,
+			WriteTimeout:    60,
+			ShutdownTimeout: 30,
+			Partners:        map[string]string{},
+		},
+		Cleaning: CleaningConfig{
+			ImageLimit: 500000,
+			ClearCount: 100000,
+			Frequency:  60 * 60,
+		},
+		Moderation: ModerationConfig{
+			ReportThreshold:  3,
+			ReasonThresholds: map[string]int{},
+		},
+		Logging: LoggingConfig{
+			Level:         "info",
+			SlackChannel:  "hanserver",
+			SlackLevel:    "warn",
+			BatchInterval: 10,
+			DedupWindow:   60 * 60,
+			Webhooks:      []WebhookConfig{},
+		},
+		Tracing: TracingConfig{
+			Exporter:    TracingNone,
+			Endpoint:    "localhost:4318",
+			Insecure:    true,
+			SampleRatio: 1,
+		},
+		Collectors: config.CollectionConfig{},
+	}
+}
+
+// Load reads the configuration file, then environment variables and then
+// applies flags. Secrets referenced by any of these are then resolved, see
+// `secrets.Resolve`. Every problem found is returned together
+// @param path  - optional json file, this can also contain only collectors
+// @param flags - optional function that sets any flags that were specified
+func Load(path string, flags func(c *Config)) (*Config, error) {
+	c := Default()
+	problems := Errors{}
+	if len(path) > 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, Errors{err.Error()}
+		}
+		problems = append(problems, c.decode(data)...)
+	}
+	problems = append(problems, c.applyEnv(os.LookupEnv)...)
+	if flags != nil {
+		flags(c)
+	}
+	problems = append(problems, c.resolveSecrets()...)
+	problems = append(problems, c.loadPartners()...)
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return c, nil
+}
+
+// decode reads the json file. Files without a `collectors` key are treated
+// as only containing collector configuration, which is the older format
+func (c *Config) decode(data []byte) Errors {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Errors{err.Error()}
+	}
+	collectors, ok := raw["collectors"]
+	if !ok {
+		return collectorErrors(c.decodeCollectors(data))
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return Errors{err.Error()}
+	}
+	return collectorErrors(c.decodeCollectors(collectors))
+}
+
+func (c *Config) decodeCollectors(data []byte) error {
+	collectors, err := config.UnmarshalConfig(string(data))
+	c.Collectors = collectors
+	return err
+}
+
+// collectorErrors prefixes each collector problem so that it's clear where it
+// is in the file
+func collectorErrors(err error) Errors {
+	if err == nil {
+		return nil
+	}
+	problems := Errors{}
+	if errs, ok := err.(config.Errors); ok {
+		for _, problem := range errs {
+			problems = append(problems, "collectors."+problem)
+		}
+		return problems
+	}
+	return Errors{"collectors: " + err.Error()}
+}
+
+// applyEnv sets any field whose `env` variable is set
+func (c *Config) applyEnv(lookup func(string) (string, bool)) Errors {
+	problems := Errors{}
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		for j := 0; j < section.NumField(); j++ {
+			name := section.Type().Field(j).Tag.Get("env")
+			if len(name) == 0 {
+				continue
+			}
+			value, ok := lookup(name)
+			if !ok {
+				continue
+			}
+			if err := setField(section.Field(j), value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+	}
+	return problems
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(f)
+	}
+	return nil
+}
+
+// resolveSecrets resolves references in each section, collectors are
+// resolved as they're decoded
+func (c *Config) resolveSecrets() Errors {
+	problems := Errors{}
+	sections := map[string]interface{}{
+		"storage":  &c.Storage,
+		"http":     &c.HTTP,
+		"cleaning": &c.Cleaning,
+		"logging":  &c.Logging,
+	}
+	for _, name := range []string{"storage", "http", "cleaning", "logging"} {
+		for _, problem := range secrets.ResolveFields(sections[name]) {
+			problems = append(problems, name+"."+problem)
+		}
+	}
+	for i := range c.Logging.Webhooks {
+		for _, problem := range secrets.ResolveFields(&c.Logging.Webhooks[i]) {
+			problems = append(problems, fmt.Sprintf("logging.webhooks[%d].%s", i, problem))
+		}
+	}
+	secrets.Register(mongoUserinfo(c.Storage.MongoURL))
+	return problems
+}
+
+// mongoUserinfo returns the credentials within a MongoDB URL, which may be
+// written with or without the mongodb:// scheme. This is empty if there are
+// none
+func mongoUserinfo(mongoURL string) string {
+	authority := mongoURL
+	if i := strings.Index(authority, "://"); i >= 0 {
+		authority = authority[i+len("://"):]
+	}
+	if i := strings.IndexAny(authority, "/?"); i >= 0 {
+		authority = authority[:i]
+	}
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		return authority[:i]
+	}
+	return ""
+}
+
+// String returns the configuration as json with secrets redacted, so that
+// it can be logged
+func (c *Config) String() string {
+	collectors := map[string]interface{}{}
+	for name, collectorConfig := range c.Collectors {
+		collectors[name] = secrets.RedactFields(collectorConfig)
+	}
+	logging := secrets.RedactFields(&c.Logging).(*LoggingConfig)
+	logging.Webhooks = []WebhookConfig{}
+	for i := range c.Logging.Webhooks {
+		webhook := secrets.RedactFields(&c.Logging.Webhooks[i]).(*WebhookConfig)
+		logging.Webhooks = append(logging.Webhooks, *webhook)
+	}
+	storage := c.Storage
+	if userinfo := mongoUserinfo(storage.MongoURL); len(userinfo) > 0 {
+		storage.MongoURL = strings.Replace(storage.MongoURL, userinfo+"@",
+			secrets.Redacted+"@", 1)
+	}
+	dump := struct {
+		*Config
+		Storage    StorageConfig          `json:"storage"`
+		HTTP       interface{}            `json:"http"`
+		Logging    interface{}            `json:"logging"`
+		Collectors map[string]interface{} `json:"collectors"`
+	}{
+		Config:     c,
+		Storage:    storage,
+		HTTP:       secrets.RedactFields(&c.HTTP),
+		Logging:    logging,
+		Collectors: collectors,
+	}
+	data, err := json.Marshal(dump)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func (c *Config) loadPartners() Errors {
+	if len(c.HTTP.PartnersFile) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.HTTP.PartnersFile)
+	if err != nil {
+		return Errors{"http.partners_file: " + err.Error()}
+	}
+	partners := map[string]string{}
+	if err := json.Unmarshal(data, &partners); err != nil {
+		return Errors{"http.partners_file: " + err.Error()}
+	}
+	for _, secret := range partners {
+		secrets.Register(secret)
+	}
+	c.HTTP.Partners = partners
+	return nil
+}
+
+// validate returns every problem with the configuration. Collectors are
+// validated as they're decoded
+func (c *Config) validate() Errors {
+	problems := Errors{}
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	check(len(c.Storage.MongoURL) > 0, "storage.mongo_url is required")
+	check(len(c.HTTP.Address) > 0, "http.address is required")
+	check(c.HTTP.ReadTimeout > 0, "http.read_timeout must be greater than 0")
+	check(c.HTTP.WriteTimeout > 0, "http.write_timeout must be greater than 0")
+	check(c.HTTP.ShutdownTimeout >= 0, "http.shutdown_timeout can't be negative")
+	for partner, secret := range c.HTTP.Partners {
+		check(len(secret) > 0, fmt.Sprintf("http.partners_file: %s has no secret", partner))
+	}
+	check(c.Cleaning.ImageLimit > 0, "cleaning.image_limit must be greater than 0")
+	check(c.Cleaning.ClearCount > 0, "cleaning.clear_count must be greater than 0")
+	check(c.Cleaning.ClearCount <= c.Cleaning.ImageLimit,
+		"cleaning.clear_count can't be more than cleaning.image_limit")
+	check(c.Cleaning.Frequency > 0, "cleaning.frequency must be greater than 0")
+	check(c.Moderation.ReportThreshold > 0,
+		"moderation.report_threshold must be greater than 0")
+	for reason, threshold := range c.Moderation.ReasonThresholds {
+		check(threshold > 0, fmt.Sprintf(
+			"moderation.reason_thresholds: %s must be greater than 0", reason))
+	}
+	for _, problem := range c.Collectors.Validate() {
+		problems = append(problems, "collectors."+problem)
+	}
+	check(c.HTTP.NoCollection || c.Collectors.Enabled(),
+		"collectors: no collectors are enabled, enable one or set http.no_collection")
+	problems = append(problems, c.Logging.validate()...)
+	problems = append(problems, c.Tracing.validate()...)
+	return problems
+}
+
+// Seconds converts a setting in seconds to a duration
+func Seconds(s int64) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// SetString overrides a setting with a flag's value, if the flag was given
+func SetString(setting *string, flag string) {
+	if len(flag) > 0 {
+		*setting = flag
+	}
+}
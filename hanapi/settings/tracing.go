@@ -0,0 +1,85 @@
+package settings
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"os"
+	"time"
+)
+
+const (
+	// TracingNone doesn't record spans
+	TracingNone = "none"
+	// TracingStdout writes spans to stdout, which is useful when developing
+	TracingStdout = "stdout"
+	// TracingOTLP sends spans to an OpenTelemetry collector over HTTP
+	TracingOTLP = "otlp"
+)
+
+// tracingFlushTimeout is how long exporting the remaining spans can take
+// when stopping
+const tracingFlushTimeout = 5 * time.Second
+
+// Start sets up tracing for the process, spans are then exported as they're
+// ended. The returned function sends any spans that haven't been exported
+// yet and should be called before exiting
+// @param service - the name of the process, eg. `hanhttpserver`
+func (c TracingConfig) Start(service string) (func() error, error) {
+	stop := func() error { return nil }
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case TracingNone:
+		return stop, nil
+	case TracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TracingOTLP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+		if c.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	}
+	if err != nil {
+		return stop, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	// callers can include requests in their own traces
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	}, nil
+}
+
+func (c TracingConfig) validate() Errors {
+	problems := Errors{}
+	switch c.Exporter {
+	case TracingNone, TracingStdout:
+	case TracingOTLP:
+		if len(c.Endpoint) == 0 {
+			problems = append(problems, "tracing.endpoint is required")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"tracing.exporter: unknown exporter %q, use none, stdout or otlp", c.Exporter))
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio must be between 0 and 1")
+	}
+	return problems
+}
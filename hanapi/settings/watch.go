@@ -0,0 +1,44 @@
+package settings
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchInterval is how often the configuration file is checked for changes
+const WatchInterval = 5 * time.Second
+
+// Watch calls onChange each time the file is modified, until the context is
+// cancelled. Nothing is watched if the path is empty
+// @param interval - how often the file's modification time is checked
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	if len(path) == 0 {
+		return
+	}
+	modified, _ := modTime(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t, err := modTime(path)
+			// the file may be missing while it's being replaced
+			if err != nil || t.Equal(modified) {
+				continue
+			}
+			modified = t
+			onChange()
+		}
+	}
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
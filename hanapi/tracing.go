@@ -0,0 +1,296 @@
+package hanapi
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName identifies spans started by hanapi
+const TracerName = "github.com/oliveroneill/hanserver/hanapi"
+
+var tracer = otel.Tracer(TracerName)
+
+// tracedDatabase starts a span around each operation, as a child of the span
+// in its context
+type tracedDatabase struct {
+	db  DatabaseInterface
+	ctx context.Context
+}
+
+// WithContext returns the database with each operation traced as part of the
+// context's span, eg. the request being handled. Database operations don't
+// otherwise take a context, so this is also how hanapi functions find the
+// span that they're part of
+func WithContext(ctx context.Context, db DatabaseInterface) DatabaseInterface {
+	if traced, ok := db.(*tracedDatabase); ok {
+		db = traced.db
+	}
+	return &tracedDatabase{db: db, ctx: ctx}
+}
+
+// startSpan starts a span for a hanapi function. The database returned traces
+// its operations as children of this span
+func startSpan(db DatabaseInterface, name string, attributes ...attribute.KeyValue) (DatabaseInterface, trace.Span) {
+	ctx := context.Background()
+	if traced, ok := db.(*tracedDatabase); ok {
+		ctx = traced.ctx
+	}
+	ctx, span := tracer.Start(ctx, "hanapi."+name, trace.WithAttributes(attributes...))
+	return WithContext(ctx, db), span
+}
+
+// recordError marks the span as failed, if there was an error
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func (t *tracedDatabase) start(operation string) trace.Span {
+	_, span := tracer.Start(t.ctx, "db."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.operation", operation)))
+	return span
+}
+
+func (t *tracedDatabase) GetRegions() []Region {
+	span := t.start("GetRegions")
+	defer span.End()
+	return t.db.GetRegions()
+}
+
+func (t *tracedDatabase) GetRegionByID(id string) (*Region, error) {
+	span := t.start("GetRegionByID")
+	defer span.End()
+	region, err := t.db.GetRegionByID(id)
+	recordError(span, err)
+	return region, err
+}
+
+func (t *tracedDatabase) GetNearestRegion(lat float64, lng float64) *Region {
+	span := t.start("GetNearestRegion")
+	defer span.End()
+	return t.db.GetNearestRegion(lat, lng)
+}
+
+func (t *tracedDatabase) GetRegionsWithin(lat float64, lng float64, radius float64) []Region {
+	span := t.start("GetRegionsWithin")
+	defer span.End()
+	return t.db.GetRegionsWithin(lat, lng, radius)
+}
+
+func (t *tracedDatabase) AddRegion(region Region) error {
+	span := t.start("AddRegion")
+	defer span.End()
+	err := t.db.AddRegion(region)
+	recordError(span, err)
+	return err
+}
+
+func (t *tracedDatabase) UpdateRegion(region Region) error {
+	span := t.start("UpdateRegion")
+	defer span.End()
+	err := t.db.UpdateRegion(region)
+	recordError(span, err)
+	return err
+}
+
+func (t *tracedDatabase) DeleteRegion(id string) error {
+	span := t.start("DeleteRegion")
+	defer span.End()
+	err := t.db.DeleteRegion(id)
+	recordError(span, err)
+	return err
+}
+
+func (t *tracedDatabase) AddImage(image ImageData) {
+	span := t.start("AddImage")
+	defer span.End()
+	t.db.AddImage(image)
+}
+
+func (t *tracedDatabase) AddBulkImagesToRegion(images []ImageData, region *Location) {
+	span := t.start("AddBulkImagesToRegion")
+	defer span.End()
+	span.SetAttributes(attribute.Int("images", len(images)))
+	t.db.AddBulkImagesToRegion(images, region)
+}
+
+func (t *tracedDatabase) GetImages(lat float64, lng float64, start int, end int) []ImageData {
+	span := t.start("GetImages")
+	defer span.End()
+	images := t.db.GetImages(lat, lng, start, end)
+	span.SetAttributes(attribute.Int("images", len(images)))
+	return images
+}
+
+func (t *tracedDatabase) GetAllImages() []ImageData {
+	span := t.start("GetAllImages")
+	defer span.End()
+	return t.db.GetAllImages()
+}
+
+func (t *tracedDatabase) HasImage(id string) bool {
+	span := t.start("HasImage")
+	defer span.End()
+	return t.db.HasImage(id)
+}
+
+func (t *tracedDatabase) HasImageURL(url string) bool {
+	span := t.start("HasImageURL")
+	defer span.End()
+	return t.db.HasImageURL(url)
+}
+
+func (t *tracedDatabase) SoftDelete(id string, reason string) {
+	span := t.start("SoftDelete")
+	defer span.End()
+	t.db.SoftDelete(id, reason)
+}
+
+func (t *tracedDatabase) DeleteOldImages(amount int) {
+	span := t.start("DeleteOldImages")
+	defer span.End()
+	t.db.DeleteOldImages(amount)
+}
+
+func (t *tracedDatabase) GetCursor(collector string, region string, cell string) string {
+	span := t.start("GetCursor")
+	defer span.End()
+	return t.db.GetCursor(collector, region, cell)
+}
+
+func (t *tracedDatabase) SetCursor(collector string, region string, cell string, cursor string) {
+	span := t.start("SetCursor")
+	defer span.End()
+	t.db.SetCursor(collector, region, cell, cursor)
+}
+
+func (t *tracedDatabase) AcquireQuery(key string, time int64, since int64, limit int) bool {
+	span := t.start("AcquireQuery")
+	defer span.End()
+	return t.db.AcquireQuery(key, time, since, limit)
+}
+
+func (t *tracedDatabase) ReleaseQuery(key string, time int64) {
+	span := t.start("ReleaseQuery")
+	defer span.End()
+	t.db.ReleaseQuery(key, time)
+}
+
+func (t *tracedDatabase) CountQueries(key string, since int64) int {
+	span := t.start("CountQueries")
+	defer span.End()
+	return t.db.CountQueries(key, since)
+}
+
+func (t *tracedDatabase) GetProviderQuota(key string) (int, int64) {
+	span := t.start("GetProviderQuota")
+	defer span.End()
+	return t.db.GetProviderQuota(key)
+}
+
+func (t *tracedDatabase) SetProviderQuota(key string, remaining int, reset int64) {
+	span := t.start("SetProviderQuota")
+	defer span.End()
+	t.db.SetProviderQuota(key, remaining, reset)
+}
+
+func (t *tracedDatabase) TakeProviderQuota(key string, now int64) bool {
+	span := t.start("TakeProviderQuota")
+	defer span.End()
+	return t.db.TakeProviderQuota(key, now)
+}
+
+func (t *tracedDatabase) Size() int {
+	span := t.start("Size")
+	defer span.End()
+	return t.db.Size()
+}
+
+func (t *tracedDatabase) CountImagesByRegion() map[Location]int {
+	span := t.start("CountImagesByRegion")
+	defer span.End()
+	return t.db.CountImagesByRegion()
+}
+
+func (t *tracedDatabase) AddReport(report Report) {
+	span := t.start("AddReport")
+	defer span.End()
+	t.db.AddReport(report)
+}
+
+func (t *tracedDatabase) CountReporters(imageID string) int {
+	span := t.start("CountReporters")
+	defer span.End()
+	return t.db.CountReporters(imageID)
+}
+
+func (t *tracedDatabase) GetReportedImages(limit int) []ReportedImage {
+	span := t.start("GetReportedImages")
+	defer span.End()
+	return t.db.GetReportedImages(limit)
+}
+
+func (t *tracedDatabase) ResolveReports(imageID string, status string) int {
+	span := t.start("ResolveReports")
+	defer span.End()
+	return t.db.ResolveReports(imageID, status)
+}
+
+func (t *tracedDatabase) RestoreImage(id string) error {
+	span := t.start("RestoreImage")
+	defer span.End()
+	err := t.db.RestoreImage(id)
+	recordError(span, err)
+	return err
+}
+
+func (t *tracedDatabase) DeleteImage(id string) error {
+	span := t.start("DeleteImage")
+	defer span.End()
+	err := t.db.DeleteImage(id)
+	recordError(span, err)
+	return err
+}
+
+func (t *tracedDatabase) AddModerationDecision(decision ModerationDecision) {
+	span := t.start("AddModerationDecision")
+	defer span.End()
+	t.db.AddModerationDecision(decision)
+}
+
+func (t *tracedDatabase) GetModerationDecisions(limit int) []ModerationDecision {
+	span := t.start("GetModerationDecisions")
+	defer span.End()
+	return t.db.GetModerationDecisions(limit)
+}
+
+func (t *tracedDatabase) Ping() error {
+	span := t.start("Ping")
+	defer span.End()
+	err := t.db.Ping()
+	recordError(span, err)
+	return err
+}
+
+func (t *tracedDatabase) EnsureIndexes() error {
+	span := t.start("EnsureIndexes")
+	defer span.End()
+	err := t.db.EnsureIndexes()
+	recordError(span, err)
+	return err
+}
+
+// Copy keeps tracing as part of the same span
+func (t *tracedDatabase) Copy() DatabaseInterface {
+	return WithContext(t.ctx, t.db.Copy())
+}
+
+func (t *tracedDatabase) Close() {
+	t.db.Close()
+}
@@ -1,45 +1,118 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
+	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"github.com/oliveroneill/hanserver/hanapi/settings"
+	"go.opentelemetry.io/otel"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-// DefaultImageCountLimit is the default maximum amount of images allowed in
-// the database before cleaning up
-const DefaultImageCountLimit = 500000
-
-// DefaultClearanceCount is the default amount of images to be cleared if the
-// maximum is reached
-const DefaultClearanceCount = 100000
+// tracer starts a span each time the database is checked
+var tracer = otel.Tracer("github.com/oliveroneill/hanserver/hancleaner")
 
 // Watch the database and clear old images when it starts reaching a max size
 func main() {
-	// connect to mongo
-	db := hanapi.NewMongoInterface()
-
 	// parse arguments
+	configUsageString := "Specify the config file, settings can also be set using environment variables"
+	configPath := flag.String("config", "", configUsageString)
+	mongoUsageString := "Specify the MongoDB URL"
+	mongoURL := flag.String("mongo", "", mongoUsageString)
 	limitUsageString := "Specify the maximum amount of images allowed in the database"
-	imageCountLimitPtr := flag.Int("imagelimit", DefaultImageCountLimit, limitUsageString)
+	imageCountLimitPtr := flag.Int("imagelimit", 0, limitUsageString)
 	clearanceUsageString := "Specify how many images should be cleared when reaching the maximum"
-	clearanceCountPtr := flag.Int("clear", DefaultClearanceCount, clearanceUsageString)
+	clearanceCountPtr := flag.Int("clear", 0, clearanceUsageString)
 	flag.Parse()
-	imageLimit := *imageCountLimitPtr
-	clearanceCount := *clearanceCountPtr
-
-	checkAndClean(db, imageLimit, clearanceCount)
-	// every hour the database is checked and old images are cleared out
-	freq := 60 * 60 * time.Second
-	for _ = range time.NewTicker(freq).C {
-		checkAndClean(db, imageLimit, clearanceCount)
+
+	c, err := settings.Load(*configPath, func(c *settings.Config) {
+		// collectors aren't needed to clean the database
+		c.HTTP.NoCollection = true
+		// only flags that were given override the other settings
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "mongo":
+				c.Storage.MongoURL = *mongoURL
+			case "imagelimit":
+				c.Cleaning.ImageLimit = *imageCountLimitPtr
+			case "clear":
+				c.Cleaning.ClearCount = *clearanceCountPtr
+			}
+		})
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	imageLimit := c.Cleaning.ImageLimit
+	clearanceCount := c.Cleaning.ClearCount
+	logger := c.Logging.NewLogger()
+	reporting.SetDefault(logger)
+	stopTracing, err := c.Tracing.Start("hancleaner")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// connect to mongo
+	db := hanapi.NewMongoInterfaceWithURL(c.Storage.MongoURL)
+
+	// stop cleaning when interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	metrics.RegisterDatabaseSize(func() int {
+		session := db.Copy()
+		defer session.Close()
+		return session.Size()
+	})
+	if len(c.Metrics.Address) > 0 {
+		go func() {
+			if err := metrics.Serve(ctx, c.Metrics.Address); err != nil {
+				logger.Log(reporting.Error, "Metrics server failed",
+					reporting.Fields{"error": err})
+			}
+		}()
+	}
+
+	checkAndClean(db, logger, imageLimit, clearanceCount)
+	// the database is periodically checked and old images are cleared out
+	ticker := time.NewTicker(settings.Seconds(c.Cleaning.Frequency))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log(reporting.Info, "Shutting down", nil)
+			db.Close()
+			if err := stopTracing(); err != nil {
+				logger.Log(reporting.Warn, "Spans weren't exported before shutting down",
+					reporting.Fields{"error": err})
+			}
+			logger.Close()
+			return
+		case <-ticker.C:
+			checkAndClean(db, logger, imageLimit, clearanceCount)
+		}
 	}
 }
 
-func checkAndClean(db hanapi.DatabaseInterface, limit int, clear int) {
-	if db.Size() >= limit {
-		fmt.Println("Cleaning up", clear, "images")
+func checkAndClean(db hanapi.DatabaseInterface, logger reporting.Logger, limit int, clear int) {
+	ctx, span := tracer.Start(context.Background(), "clean")
+	defer span.End()
+	db = hanapi.WithContext(ctx, db)
+	size := db.Size()
+	if size >= limit {
+		logger.Log(reporting.Info, "Cleaning up images", reporting.Fields{"count": clear})
 		db.DeleteOldImages(clear)
+		// images may have been added while cleaning, so this is approximate
+		if deleted := size - db.Size(); deleted > 0 {
+			metrics.CleanerDeletions.Add(float64(deleted))
+		}
 	}
 }
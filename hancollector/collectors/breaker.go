@@ -0,0 +1,194 @@
+package collectors
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// retryAttempts is the most times a query is made before giving up on
+// transient failures
+const retryAttempts = 3
+
+// retryBaseDelay and retryMaxDelay bound the backoff between attempts
+const retryBaseDelay = 500 * time.Millisecond
+const retryMaxDelay = 10 * time.Second
+
+// circuitFailureThreshold is the amount of consecutive transient failures
+// that will open a collector's circuit
+const circuitFailureThreshold = 5
+
+// circuitCooldown is how long a circuit stays open before a trial query is
+// made. This doubles each time the trial fails, up to circuitMaxCooldown
+const circuitCooldown = time.Minute
+const circuitMaxCooldown = time.Hour
+
+// sleep is used to wait between attempts and can be replaced in tests. This
+// returns early if the context is cancelled
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retry calls the function until it succeeds, waiting with exponential
+// backoff and jitter between attempts. Only transient failures are retried
+// and retrying stops once the context is cancelled
+func retry(ctx context.Context, attempts int, f func() error) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if sleepErr := sleep(ctx, backoff(attempt)); sleepErr != nil {
+				return sleepErr
+			}
+		}
+		err = f()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || ClassifyError(err) != ErrorTransient {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns a random delay of up to the base delay doubled for each
+// attempt, so that collectors don't retry in lockstep
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt-1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// CircuitState is whether a collector is currently making queries
+type CircuitState int
+
+const (
+	// CircuitClosed is used when queries are being made as usual
+	CircuitClosed CircuitState = iota
+	// CircuitOpen is used when queries aren't made after repeated failures
+	CircuitOpen
+	// CircuitHalfOpen is used once the cooldown has passed, a single trial
+	// query is allowed to decide whether to close the circuit
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// MarshalText is used so that states are readable in JSON
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitBreaker stops a collector from querying a provider that keeps
+// failing, or that has rejected its credentials
+type CircuitBreaker struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	cooldown time.Duration
+	// whether the half-open trial query is being made
+	trial bool
+	mutex sync.Mutex
+	// used to control time in tests
+	now func() time.Time
+}
+
+// NewCircuitBreaker creates a closed `CircuitBreaker`
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		cooldown: circuitCooldown,
+		now:      time.Now,
+	}
+}
+
+// Allow returns true if a query should be made. Once the cooldown has
+// passed only one query is allowed until its result is recorded
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.currentState() {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		b.trial = true
+	}
+	return true
+}
+
+// Record updates the circuit using the result of an allowed query
+func (b *CircuitBreaker) Record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trial = false
+	if err == nil {
+		b.state = CircuitClosed
+		b.failures = 0
+		b.cooldown = circuitCooldown
+		return
+	}
+	switch ClassifyError(err) {
+	case ErrorCredentials:
+		// these won't fix themselves, so only check occasionally
+		b.open(circuitMaxCooldown)
+	case ErrorTransient:
+		b.failures++
+		if b.state == CircuitHalfOpen {
+			b.open(b.cooldown * 2)
+		} else if b.failures >= circuitFailureThreshold {
+			b.open(b.cooldown)
+		}
+	}
+}
+
+// Release is used when an allowed query wasn't completed, such as when it
+// was cancelled, so that its result says nothing about the provider
+func (b *CircuitBreaker) Release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trial = false
+}
+
+// State returns whether queries are currently being made
+func (b *CircuitBreaker) State() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.currentState()
+}
+
+func (b *CircuitBreaker) currentState() CircuitState {
+	if b.state == CircuitOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) open(cooldown time.Duration) {
+	if cooldown > circuitMaxCooldown {
+		cooldown = circuitMaxCooldown
+	}
+	b.state = CircuitOpen
+	b.openedAt = b.now()
+	b.cooldown = cooldown
+}
@@ -1,8 +1,18 @@
 package collectors
 
 import (
+	"context"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
 	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
@@ -10,63 +20,204 @@ import (
 // QueryRange is the maximum radius of each query in metres
 const QueryRange = 5000
 
+// tracer starts a span for each query to a provider
+var tracer = otel.Tracer("github.com/oliveroneill/hanserver/hancollector/collectors")
+
+// htmlTagPattern matches tags so that HTML can be displayed as plain text
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
 // ImageCollector is an interface used for collecting images
 // This should be implemented for each media source
 type ImageCollector interface {
 	// a configuration must be implemented for each collector
 	GetConfig() config.CollectorConfiguration
-	GetImages(Lat float64, Lng float64) ([]hanapi.ImageData, error)
-	ableToQuery(config config.CollectorConfiguration) bool
+	// GetImages should return images covering the region's shape that are
+	// newer than the cursors stored for each cell. Queries should stop once
+	// the context is cancelled
+	GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error)
+	// SetQuotaManager is used to share quotas between collectors
+	SetQuotaManager(quota *QuotaManager)
+	// CircuitState is whether the collector has stopped querying after
+	// repeated failures
+	CircuitState() CircuitState
+}
+
+// CursorStore persists the latest content retrieved within each cell of a
+// region, so that collectors only request newer content. This is implemented
+// by `hanapi.DatabaseInterface` so that it survives restarts
+type CursorStore interface {
+	GetCursor(collector string, region string, cell string) string
+	SetCursor(collector string, region string, cell string, cursor string)
+}
+
+// PendingCursors holds the cursors set during a search until `Commit` is
+// called, so that they can be stored once the images they cover have been
+// written. Otherwise a failed write or a cancelled population would skip
+// those images for good
+type PendingCursors struct {
+	store   CursorStore
+	pending map[[3]string]string
+	mutex   sync.Mutex
+}
+
+// NewPendingCursors creates `PendingCursors` that are committed to `store`
+func NewPendingCursors(store CursorStore) *PendingCursors {
+	return &PendingCursors{
+		store:   store,
+		pending: map[[3]string]string{},
+	}
+}
+
+// GetCursor returns the pending cursor, or the stored one if it hasn't been
+// set
+func (c *PendingCursors) GetCursor(collector string, region string, cell string) string {
+	c.mutex.Lock()
+	cursor, ok := c.pending[[3]string{collector, region, cell}]
+	c.mutex.Unlock()
+	if ok {
+		return cursor
+	}
+	return c.store.GetCursor(collector, region, cell)
+}
+
+// SetCursor keeps the cursor until `Commit` is called
+func (c *PendingCursors) SetCursor(collector string, region string, cell string, cursor string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pending[[3]string{collector, region, cell}] = cursor
+}
+
+// Commit stores every pending cursor
+func (c *PendingCursors) Commit() {
+	c.mutex.Lock()
+	pending := c.pending
+	c.pending = map[[3]string]string{}
+	c.mutex.Unlock()
+	for key, cursor := range pending {
+		c.store.SetCursor(key[0], key[1], key[2], cursor)
+	}
 }
 
 // APIRestrictedCollector is an implementation of ImageCollector that monitors
 // query calls. This should be extended since it does not implement GetImages
 // or GetConfig. See `instagramcollector.go` for example
 type APIRestrictedCollector struct {
-	receivedError bool
-	queryCount    int
-	lastQueryTime int64
-	mutex         sync.Mutex
+	quota   *QuotaManager
+	breaker *CircuitBreaker
+	mutex   sync.Mutex
 }
 
 // NewAPIRestrictedCollector creates a simple implementation of ImageCollector
-// that monitors API calls
+// that monitors API calls. Quotas are only tracked by this collector until
+// `SetQuotaManager` is called
 func NewAPIRestrictedCollector() *APIRestrictedCollector {
 	return &APIRestrictedCollector{
-		receivedError: false,
-		queryCount:    0,
-		lastQueryTime: 0,
-		mutex:         sync.Mutex{},
+		quota:   NewQuotaManager(NewMemoryQuotaStore()),
+		breaker: NewCircuitBreaker(),
+		mutex:   sync.Mutex{},
 	}
 }
 
-// ableToQuery will return true if the collector hasn't reached its API limit
-// This will assume that a query will be made if the call is true, therefore
-// increasing the query count
-func (c *APIRestrictedCollector) ableToQuery(config config.CollectorConfiguration) bool {
+// SetQuotaManager shares a quota manager between collectors
+func (c *APIRestrictedCollector) SetQuotaManager(quota *QuotaManager) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if c.queryCount < config.GetQueryLimit() && !c.receivedError {
-		c.queryCount++
-		c.lastQueryTime = time.Now().Unix()
-		return true
+	c.quota = quota
+}
+
+// CircuitState is whether the collector has stopped querying after repeated
+// failures
+func (c *APIRestrictedCollector) CircuitState() CircuitState {
+	return c.breaker.State()
+}
+
+// query makes a request to the endpoint, retrying transient failures with
+// backoff. Each attempt uses up part of the endpoint's quota and the result
+// is recorded by the collector's circuit breaker
+func (c *APIRestrictedCollector) query(ctx context.Context, config config.CollectorConfiguration, endpoint string, request func() error) (err error) {
+	name := config.GetCollectorName()
+	ctx, span := tracer.Start(ctx, "collector.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("collector", name),
+			attribute.String("endpoint", endpoint),
+		))
+	attempts := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("attempts", attempts))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	if !c.breaker.Allow() {
+		metrics.CollectorQueries.WithLabelValues(name, endpoint, "rejected").Inc()
+		return errCircuitOpen
+	}
+	start := time.Now()
+	defer func() {
+		metrics.CollectorQueryDuration.WithLabelValues(name, endpoint).
+			Observe(time.Since(start).Seconds())
+	}()
+	err = retry(ctx, retryAttempts, func() error {
+		if !c.acquireQuota(config, endpoint) {
+			return errQueryLimitReached
+		}
+		attempts++
+		return request()
+	})
+	if ctx.Err() != nil {
+		// the query was cancelled, which says nothing about the provider
+		c.breaker.Release()
+		return ctx.Err()
 	}
-	timeSinceLastQuery := time.Now().Unix() - c.lastQueryTime
-	if timeSinceLastQuery > config.GetQueryWindow() {
-		c.queryCount = 0
-		c.receivedError = false
-		c.lastQueryTime = time.Now().Unix()
-		return true
+	c.breaker.Record(err)
+	result := "ok"
+	if err != nil {
+		result = "error"
 	}
-	return false
+	metrics.CollectorQueries.WithLabelValues(name, endpoint, result).Inc()
+	return err
+}
+
+// acquireQuota will return true if the endpoint hasn't reached its API limit
+// This will assume that a query will be made if the call is true, therefore
+// using up part of the quota
+func (c *APIRestrictedCollector) acquireQuota(config config.CollectorConfiguration, endpoint string) bool {
+	return c.getQuotaManager().Acquire(config, endpoint)
+}
+
+// updateQuota reads the rate limits returned with the endpoint's response
+func (c *APIRestrictedCollector) updateQuota(config config.CollectorConfiguration, endpoint string, res *http.Response) {
+	c.getQuotaManager().Update(config, endpoint, res)
+}
+
+func (c *APIRestrictedCollector) getQuotaManager() *QuotaManager {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.quota
 }
 
 // GetConfig placeholder method to be overriden
 func (c *APIRestrictedCollector) GetConfig() config.CollectorConfiguration {
-	return config.CollectorConfig{}
+	return &config.CollectorConfig{}
 }
 
 // GetImages placeholder method to be overriden
-func (c *APIRestrictedCollector) GetImages(Lat float64, Lng float64) ([]hanapi.ImageData, error) {
+func (c *APIRestrictedCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
 	return []hanapi.ImageData{}, nil
 }
+
+// newHTTPClient creates a client that gives up on requests once the
+// collector's timeout has passed
+func newHTTPClient(config config.CollectorConfiguration) *http.Client {
+	return &http.Client{Timeout: config.GetTimeout()}
+}
+
+// plainText converts HTML returned by a source into plain text, suitable for a
+// caption
+func plainText(s string) string {
+	text := html.UnescapeString(htmlTagPattern.ReplaceAllString(s, " "))
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -1,9 +1,28 @@
 package collectors
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
 	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 type MockCollector struct {
@@ -39,36 +58,1077 @@ func (c *MockCollector) GetConfig() config.CollectorConfiguration {
 	}
 }
 
-func (c *MockCollector) GetImages(lat float64, lng float64) ([]hanapi.ImageData, error) {
+func (c *MockCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
 	return []hanapi.ImageData{}, nil
 }
 
-func TestAbleToQuery(t *testing.T) {
+func TestAcquireQuota(t *testing.T) {
 	queryLimit := 5
 	collector := NewMockCollector(queryLimit)
 	for i := 0; i < queryLimit; i++ {
 		// make queries until reaching limit
-		if !collector.ableToQuery(collector.GetConfig()) {
+		if !collector.acquireQuota(collector.GetConfig(), "search") {
 			t.Error("Expected to be able to query on", i)
 		}
 	}
 	// check that we can't query anymore
-	if collector.ableToQuery(collector.GetConfig()) {
+	if collector.acquireQuota(collector.GetConfig(), "search") {
 		t.Error("Expected not to be able to query after reaching limit")
 	}
+	// other endpoints have their own budget
+	if !collector.acquireQuota(collector.GetConfig(), "other") {
+		t.Error("Expected to be able to query a different endpoint")
+	}
 }
 
-func TestAbleToQueryWhenReceivedErrorSet(t *testing.T) {
-	queryLimit := 5
-	collector := NewMockCollector(queryLimit)
-	// Check that we can query at the start
-	if !collector.ableToQuery(collector.GetConfig()) {
-		t.Error("Expected to be able to query")
+func newTestQuotaManager(now *time.Time) *QuotaManager {
+	q := NewQuotaManager(NewMemoryQuotaStore())
+	q.now = func() time.Time {
+		return *now
 	}
-	// Set error
-	collector.APIRestrictedCollector.receivedError = true
-	// check that we can't query anymore
-	if collector.ableToQuery(collector.GetConfig()) {
-		t.Error("Expected not to be able to query after receiving error")
+	return q
+}
+
+func TestQuotaSlidingWindow(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	q := newTestQuotaManager(&now)
+	c := &config.CollectorConfig{CollectorName: "test", QueryLimit: 2, QueryWindow: 60}
+	q.Acquire(c, "search")
+	now = now.Add(30 * time.Second)
+	q.Acquire(c, "search")
+	if q.Acquire(c, "search") {
+		t.Error("Expected not to be able to query after reaching limit")
+	}
+	// the first query leaves the window, but the second is still within it
+	now = now.Add(31 * time.Second)
+	if !q.Acquire(c, "search") {
+		t.Error("Expected to be able to query once the first query expired")
+	}
+	if q.Acquire(c, "search") {
+		t.Error("Expected not to be able to query while the window is full")
+	}
+}
+
+func TestQuotaEndpointBudget(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	q := newTestQuotaManager(&now)
+	c := &config.CollectorConfig{
+		CollectorName: "test",
+		QueryLimit:    10,
+		QueryWindow:   60,
+		Endpoints: map[string]config.EndpointBudget{
+			"search": {QueryLimit: 1},
+		},
+	}
+	q.Acquire(c, "search")
+	if q.Acquire(c, "search") {
+		t.Error("Expected the endpoint's own limit to be used")
+	}
+	if !q.Acquire(c, "other") {
+		t.Error("Expected other endpoints to use the collector's limit")
+	}
+}
+
+func TestQuotaHonoursRateLimitHeaders(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	q := newTestQuotaManager(&now)
+	c := &config.CollectorConfig{CollectorName: "test", QueryLimit: 10, QueryWindow: 60}
+	res := &http.Response{StatusCode: 200, Header: http.Header{}}
+	res.Header.Set("X-Rate-Limit-Remaining", "1")
+	res.Header.Set("X-Rate-Limit-Reset", strconv.FormatInt(now.Unix()+900, 10))
+	q.Update(c, "search", res)
+	if !q.Acquire(c, "search") {
+		t.Error("Expected to be able to use the remaining query")
+	}
+	if q.Acquire(c, "search") {
+		t.Error("Expected not to be able to query once the provider's limit is used")
+	}
+	state := q.State()
+	if len(state) != 1 || state[0].Remaining != 0 || state[0].Reset != now.Unix()+900 {
+		t.Error("Expected provider's limit in state but was", state)
+	}
+	// the provider's limit no longer applies after it resets
+	now = now.Add(901 * time.Second)
+	if !q.Acquire(c, "search") {
+		t.Error("Expected to be able to query after the limit reset")
+	}
+}
+
+func TestQuotaTooManyRequests(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	q := newTestQuotaManager(&now)
+	c := &config.CollectorConfig{CollectorName: "test", QueryLimit: 10, QueryWindow: 60}
+	res := &http.Response{StatusCode: 429, Header: http.Header{}}
+	res.Header.Set("Retry-After", "120")
+	q.Update(c, "search", res)
+	if q.Acquire(c, "search") {
+		t.Error("Expected not to be able to query after being rate limited")
+	}
+	// unlike errors, rate limiting only lasts until the provider says so
+	now = now.Add(121 * time.Second)
+	if !q.Acquire(c, "search") {
+		t.Error("Expected to be able to query after Retry-After")
+	}
+}
+
+func TestQuotaSharedStore(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	store := NewMemoryQuotaStore()
+	c := &config.CollectorConfig{CollectorName: "test", QueryLimit: 1, QueryWindow: 60}
+	first := NewQuotaManager(store)
+	first.now = func() time.Time { return now }
+	second := NewQuotaManager(store)
+	second.now = func() time.Time { return now }
+	first.Acquire(c, "search")
+	if second.Acquire(c, "search") {
+		t.Error("Expected queries to be shared between managers using a store")
+	}
+}
+
+// staleQuotaStore reports that the provider's quota is unknown, as if another
+// process used it up after it was read
+type staleQuotaStore struct {
+	QuotaStore
+}
+
+func (s *staleQuotaStore) GetProviderQuota(key string) (int, int64) {
+	return -1, 0
+}
+
+func TestQuotaProviderRefusalReleasesQuery(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	store := NewMemoryQuotaStore()
+	store.SetProviderQuota("test/search", 0, now.Unix()+900)
+	c := &config.CollectorConfig{CollectorName: "test", QueryLimit: 1, QueryWindow: 60}
+	q := NewQuotaManager(&staleQuotaStore{store})
+	q.now = func() time.Time { return now }
+	if q.Acquire(c, "search") {
+		t.Error("Expected the provider to refuse the query")
+	}
+	if used := store.CountQueries("test/search", now.Unix()-60); used != 0 {
+		t.Error("Expected the refused query to be released but was", used)
+	}
+}
+
+func TestQuotaConcurrentAcquire(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	store := NewMemoryQuotaStore()
+	c := &config.CollectorConfig{CollectorName: "test", QueryLimit: 5, QueryWindow: 60}
+	// the provider has fewer queries left than our own limit
+	store.SetProviderQuota("test/provider", 3, now.Unix()+900)
+	var mutex sync.Mutex
+	acquired := map[string]int{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// each manager is like a separate process sharing the store
+			q := NewQuotaManager(store)
+			q.now = func() time.Time { return now }
+			for _, endpoint := range []string{"search", "provider"} {
+				if q.Acquire(c, endpoint) {
+					mutex.Lock()
+					acquired[endpoint]++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired["search"] != 5 {
+		t.Error("Expected 5 queries to be acquired but was", acquired["search"])
+	}
+	if acquired["provider"] != 3 {
+		t.Error("Expected 3 queries to be acquired but was", acquired["provider"])
+	}
+	if remaining, _ := store.GetProviderQuota("test/provider"); remaining != 0 {
+		t.Error("Expected 0 remaining but was", remaining)
+	}
+	// queries the provider refused don't use up the window
+	if used := store.CountQueries("test/provider", now.Unix()-60); used != 3 {
+		t.Error("Expected 3 queries to be recorded but was", used)
+	}
+}
+
+func TestCoveragePlannerTilesRegion(t *testing.T) {
+	// a default region is covered by a hexagon and the six surrounding it
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	planner := NewCoveragePlanner(QueryRange, 100)
+	cells := planner.Plan(region)
+	if len(cells) != 7 {
+		t.Error("Expected 7 cells but was", len(cells))
+	}
+	if cells[0].Lat != region.Lat || cells[0].Lng != region.Lng {
+		t.Error("Expected first cell to be the centre but was", cells[0])
+	}
+	// larger regions need more cells
+	region = hanapi.NewRegion("", -35.28, 149.13, 3*QueryRange)
+	if len(planner.Plan(region)) <= 7 {
+		t.Error("Expected more cells for a larger region")
+	}
+	// cells that can't overlap a polygon are skipped
+	region = hanapi.NewPolygonRegion("", []hanapi.Location{
+		*hanapi.NewLocation(-35.2, 149.0),
+		*hanapi.NewLocation(-35.2, 149.01),
+		*hanapi.NewLocation(-35.4, 149.01),
+		*hanapi.NewLocation(-35.4, 149.0),
+	})
+	for _, cell := range planner.Plan(region) {
+		if !cellIntersects(region, cell) {
+			t.Error("Expected", cell, "to intersect the polygon")
+		}
+	}
+}
+
+func TestCoveragePlannerSubdividesCappedCells(t *testing.T) {
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	planner := NewCoveragePlanner(QueryRange, 100)
+	cells := planner.Plan(region)
+	planner.Record(region, cells[0], 100)
+	subdivided := planner.Plan(region)
+	if len(subdivided) != len(cells)+6 {
+		t.Error("Expected", len(cells)+6, "cells but was", len(subdivided))
+	}
+	for i := 0; i < 7; i++ {
+		if subdivided[i].Radius != QueryRange/2 {
+			t.Error("Expected cell to be subdivided but was", subdivided[i])
+		}
+	}
+	// planners without a result cap never subdivide
+	planner = NewCoveragePlanner(QueryRange, 0)
+	planner.Record(region, cells[0], 500)
+	if len(planner.Plan(region)) != len(cells) {
+		t.Error("Expected cells to not be subdivided")
+	}
+}
+
+func TestCoveragePlannerSkipsEmptyCells(t *testing.T) {
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	planner := NewCoveragePlanner(QueryRange, 100)
+	cells := planner.Plan(region)
+	for i := 0; i < emptyLimit; i++ {
+		planner.Record(region, cells[1], 0)
+	}
+	for i := 0; i < emptyRetry; i++ {
+		if len(planner.Plan(region)) != len(cells)-1 {
+			t.Fatal("Expected empty cell to be skipped on plan", i)
+		}
+	}
+	// eventually the cell is retried
+	if len(planner.Plan(region)) != len(cells) {
+		t.Error("Expected empty cell to be retried")
+	}
+}
+
+type MockCursorStore struct {
+	cursors map[string]string
+}
+
+func (s *MockCursorStore) GetCursor(collector string, region string, cell string) string {
+	return s.cursors[collector+region+cell]
+}
+
+func (s *MockCursorStore) SetCursor(collector string, region string, cell string, cursor string) {
+	s.cursors[collector+region+cell] = cursor
+}
+
+func TestQueryCellsKeepsCappedCursor(t *testing.T) {
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	cell := tileRegion(region, QueryRange)[0]
+	store := &MockCursorStore{cursors: map[string]string{}}
+	query := func(c Cell, cursor string) (*cellResponse, error) {
+		results := 1
+		if c.ID == cell.ID {
+			results = 2
+		}
+		return &cellResponse{
+			images:       []hanapi.ImageData{},
+			results:      results,
+			cursor:       "newest",
+			cappedCursor: "oldest",
+		}, nil
+	}
+	_, err := queryCells(context.Background(), NewCoveragePlanner(QueryRange, 2),
+		store, "mock", region, query)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// older results may not have been returned by the capped cell
+	key := RegionKey(region)
+	if cursor := store.GetCursor("mock", key, cell.ID); cursor != "oldest" {
+		t.Error("Expected the capped cell's cursor to be oldest but was", cursor)
+	}
+	other := tileRegion(region, QueryRange)[1]
+	if cursor := store.GetCursor("mock", key, other.ID); cursor != "newest" {
+		t.Error("Expected the cursor to be newest but was", cursor)
+	}
+}
+
+func TestPendingCursors(t *testing.T) {
+	store := &MockCursorStore{cursors: map[string]string{"mockregioncell": "stored"}}
+	cursors := NewPendingCursors(store)
+	if cursor := cursors.GetCursor("mock", "region", "cell"); cursor != "stored" {
+		t.Error("Expected the stored cursor but was", cursor)
+	}
+	cursors.SetCursor("mock", "region", "cell", "pending")
+	if cursor := cursors.GetCursor("mock", "region", "cell"); cursor != "pending" {
+		t.Error("Expected the pending cursor but was", cursor)
+	}
+	if store.cursors["mockregioncell"] != "stored" {
+		t.Error("Expected the cursor to wait to be committed but was", store.cursors)
+	}
+	cursors.Commit()
+	if store.cursors["mockregioncell"] != "pending" {
+		t.Error("Expected the pending cursor to be stored but was", store.cursors)
+	}
+}
+
+func TestQueryCellsUsesCursors(t *testing.T) {
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	planner := NewCoveragePlanner(QueryRange, 100)
+	store := &MockCursorStore{cursors: map[string]string{}}
+	queried := 0
+	query := func(cell Cell, cursor string) (*cellResponse, error) {
+		queried++
+		// each cell returns one new image the first time
+		if len(cursor) > 0 {
+			return &cellResponse{images: []hanapi.ImageData{}}, nil
+		}
+		return &cellResponse{
+			images:  []hanapi.ImageData{*hanapi.NewImage("", 0, "", "", cell.ID, 0, 0, "", "", "", "")},
+			results: 1,
+			cursor:  cell.ID,
+		}, nil
+	}
+	images, err := queryCells(context.Background(), planner, store, "mock", region, query)
+	if err != nil || len(images) != 7 {
+		t.Error("Expected 7 images but was", len(images), err)
+	}
+	if len(store.cursors) != 7 {
+		t.Error("Expected a cursor for each cell but was", store.cursors)
+	}
+	// the second time around there's nothing new
+	images, err = queryCells(context.Background(), planner, store, "mock", region, query)
+	if err != nil || len(images) != 0 {
+		t.Error("Expected no images but was", len(images), err)
+	}
+	if queried != 14 {
+		t.Error("Expected 14 queries but was", queried)
+	}
+}
+
+func TestFlickrCollectorUsesSearchExtras(t *testing.T) {
+	requests := []url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Query())
+		fmt.Fprint(w, `{"stat": "ok", "photos": {"page": 1, "pages": 1, "total": "2", "photo": [
+			{"id": "1", "owner": "o", "secret": "s", "server": "1", "farm": 1, "title": "first",
+			 "license": "4", "dateupload": "1500000000", "ownername": "owner",
+			 "latitude": -35.28, "longitude": 149.13, "url_b": "b.jpg", "url_t": "t.jpg"},
+			{"id": "2", "owner": "o", "secret": "s", "server": "1", "farm": 1, "title": "reserved",
+			 "license": "0", "dateupload": "1500000001", "ownername": "owner",
+			 "latitude": -35.28, "longitude": 149.13}
+		]}}`)
+	}))
+	defer server.Close()
+	flickrConfig := &config.FlickrConfiguration{
+		CollectorConfig: config.CollectorConfig{
+			CollectorName: "flickr",
+			Enabled:       true,
+			QueryLimit:    100,
+			QueryWindow:   60 * 60,
+		},
+	}
+	collector := NewFlickrCollector(flickrConfig)
+	collector.apiURL = server.URL
+	response, err := collector.queryImages(context.Background(), http.DefaultClient, Cell{Lat: -35.28, Lng: 149.13, Radius: QueryRange}, "")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// a single request is made per page
+	if len(requests) != 1 {
+		t.Error("Expected 1 request but was", len(requests))
+	}
+	if requests[0].Get("extras") != flickrExtras || requests[0].Get("license") != flickrLicenses {
+		t.Error("Expected extras and license to be requested but was", requests[0])
+	}
+	if len(requests[0].Get("bbox")) == 0 {
+		t.Error("Expected search to be bounded")
+	}
+	if len(response.images) != 1 {
+		t.Fatal("Expected all rights reserved photo to be skipped but was", response.images)
+	}
+	image := response.images[0]
+	if image.ImageURL != "b.jpg" || image.User.Username != "owner" || image.CreatedTime != 1500000000 {
+		t.Error("Unexpected image", image)
+	}
+	if response.cursor != "1500000000" || response.results != 2 {
+		t.Error("Unexpected cursor", response.cursor, "or results", response.results)
+	}
+}
+
+func TestMastodonCollectorFiltersByRegion(t *testing.T) {
+	requests := []url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Query())
+		if len(r.URL.Query().Get("min_id")) > 0 {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"id": "110", "uri": "https://example.com/1", "url": "https://example.com/@a/1",
+			 "created_at": "2017-07-14T02:40:00.000Z", "content": "<p>Lake geo:-35.29,149.12</p>",
+			 "account": {"acct": "a", "avatar": "avatar.png"},
+			 "media_attachments": [{"type": "image", "url": "image.jpg", "preview_url": "thumb.jpg"}]},
+			{"id": "99", "uri": "https://example.com/2", "url": "https://example.com/@a/2",
+			 "created_at": "2017-07-14T02:30:00.000Z", "content": "<p>Sydney</p>",
+			 "location": {"latitude": -33.86, "longitude": 151.2},
+			 "account": {"acct": "a", "avatar": "avatar.png"},
+			 "media_attachments": [{"type": "image", "url": "image.jpg", "preview_url": "thumb.jpg"}]},
+			{"id": "98", "uri": "https://example.com/3", "url": "https://example.com/@a/3",
+			 "created_at": "2017-07-14T02:20:00.000Z", "content": "<p>No location</p>",
+			 "account": {"acct": "a", "avatar": "avatar.png"},
+			 "media_attachments": [{"type": "image", "url": "image.jpg", "preview_url": "thumb.jpg"}]}
+		]`)
+	}))
+	defer server.Close()
+	mastodonConfig := &config.MastodonConfiguration{
+		CollectorConfig: config.CollectorConfig{
+			CollectorName: "mastodon",
+			Enabled:       true,
+			QueryLimit:    100,
+			QueryWindow:   60 * 60,
+		},
+		Instances: []string{server.URL},
+	}
+	collector := NewMastodonCollector(mastodonConfig)
+	store := &MockCursorStore{cursors: map[string]string{}}
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	images, err := collector.getImagesWithClient(context.Background(), http.DefaultClient, region, store)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(images) != 1 {
+		t.Fatal("Expected 1 image within the region but was", images)
+	}
+	image := images[0]
+	if image.ID != "https://example.com/1" || image.Caption != "Lake geo:-35.29,149.12" ||
+		image.Location.Lat != -35.29 || image.CreatedTime != 1500000000 {
+		t.Error("Unexpected image", image)
+	}
+	// the newest status should be the cursor regardless of location
+	cursor := store.GetCursor("mastodon", RegionKey(region), server.URL)
+	if cursor != "110" {
+		t.Error("Expected cursor to be 110 but was", cursor)
+	}
+	images, err = collector.getImagesWithClient(context.Background(), http.DefaultClient, region, store)
+	if err != nil || len(images) != 0 {
+		t.Error("Expected no new images but was", images, err)
+	}
+	if requests[1].Get("min_id") != "110" {
+		t.Error("Expected cursor to be sent but was", requests[1])
+	}
+}
+
+func TestWikimediaCollectorCarriesAttribution(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ggsnamespace") != "6" || len(r.Header.Get("User-Agent")) == 0 {
+			t.Error("Expected a file search with a user agent but was", r.URL.Query(), r.Header)
+		}
+		fmt.Fprint(w, `{"query": {"pages": [
+			{"pageid": 1, "title": "File:Lake.jpg", "coordinates": [{"lat": -35.29, "lon": 149.12}],
+			 "imageinfo": [{"timestamp": "2017-07-14T02:40:00Z", "user": "uploader",
+			  "url": "https://upload.wikimedia.org/a/ab/Lake.jpg",
+			  "thumburl": "https://upload.wikimedia.org/thumb/a/ab/Lake.jpg/1024px-Lake.jpg",
+			  "descriptionurl": "https://commons.wikimedia.org/wiki/File:Lake.jpg", "mime": "image/jpeg",
+			  "extmetadata": {"LicenseShortName": {"value": "CC BY-SA 4.0"},
+			   "Artist": {"value": "<a href=\"//commons.wikimedia.org/wiki/User:A\">Author</a>"}}}]},
+			{"pageid": 2, "title": "File:Map.pdf", "coordinates": [{"lat": -35.29, "lon": 149.12}],
+			 "imageinfo": [{"timestamp": "2017-07-14T02:40:00Z", "mime": "application/pdf",
+			  "extmetadata": {"LicenseShortName": {"value": "CC0"}}}]}
+		]}}`)
+	}))
+	defer server.Close()
+	wikimediaConfig := &config.WikimediaConfiguration{
+		CollectorConfig: config.CollectorConfig{
+			CollectorName: "wikimedia",
+			Enabled:       true,
+			QueryLimit:    100,
+			QueryWindow:   60 * 60,
+		},
+		UserAgent: "test",
+	}
+	collector := NewWikimediaCollector(wikimediaConfig)
+	collector.apiURL = server.URL
+	cell := Cell{Lat: -35.28, Lng: 149.13, Radius: wikimediaSearchRadius}
+	response, err := collector.queryImages(context.Background(), http.DefaultClient, cell, "")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(response.images) != 1 {
+		t.Fatal("Expected only photos to be returned but was", response.images)
+	}
+	image := response.images[0]
+	if image.License != "CC BY-SA 4.0" || image.User.Username != "Author" || image.Caption != "Lake" {
+		t.Error("Unexpected attribution", image.License, image.User.Username, image.Caption)
+	}
+	if image.ThumbnailURL != "https://upload.wikimedia.org/thumb/a/ab/Lake.jpg/320px-Lake.jpg" {
+		t.Error("Unexpected thumbnail", image.ThumbnailURL)
+	}
+	// files that were already seen are dropped
+	response, err = collector.queryImages(context.Background(), http.DefaultClient, cell, response.cursor)
+	if err != nil || len(response.images) != 0 {
+		t.Error("Expected no new images but was", response.images, err)
+	}
+}
+
+func TestFeedCollectorReadsGeoRSS(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `<?xml version="1.0"?>
+		<rss version="2.0" xmlns:georss="http://www.georss.org/georss"
+			xmlns:geo="http://www.w3.org/2003/01/geo/wgs84_pos#"
+			xmlns:media="http://search.yahoo.com/mrss/">
+		<channel>
+			<item>
+				<title>Lake</title>
+				<link>https://example.com/lake</link>
+				<guid>lake</guid>
+				<pubDate>Fri, 14 Jul 2017 02:40:00 +0000</pubDate>
+				<georss:point>-35.29 149.12</georss:point>
+				<media:content url="https://example.com/lake.jpg" medium="image"/>
+				<media:thumbnail url="https://example.com/lake_t.jpg"/>
+			</item>
+			<item>
+				<title>Harbour</title>
+				<guid>harbour</guid>
+				<pubDate>Fri, 14 Jul 2017 02:50:00 +0000</pubDate>
+				<geo:lat>-33.86</geo:lat><geo:long>151.2</geo:long>
+				<enclosure url="https://example.com/harbour.jpg" type="image/jpeg"/>
+			</item>
+			<item>
+				<title>No image</title>
+				<guid>text</guid>
+				<pubDate>Fri, 14 Jul 2017 03:00:00 +0000</pubDate>
+				<georss:point>-35.29 149.12</georss:point>
+			</item>
+		</channel>
+		</rss>`)
+	}))
+	defer server.Close()
+	feedConfig := &config.FeedConfiguration{
+		CollectorConfig: config.CollectorConfig{
+			CollectorName: "feed",
+			Enabled:       true,
+			QueryLimit:    100,
+			QueryWindow:   60 * 60,
+		},
+		Feeds: []string{server.URL},
+	}
+	collector := NewFeedCollector(feedConfig)
+	store := &MockCursorStore{cursors: map[string]string{}}
+	canberra := hanapi.NewRegion("", -35.28, 149.13, 0)
+	images, err := collector.getImagesWithClient(context.Background(), http.DefaultClient, canberra, store)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(images) != 1 {
+		t.Fatal("Expected 1 image within the region but was", images)
+	}
+	image := images[0]
+	if image.ID != "lake" || image.ThumbnailURL != "https://example.com/lake_t.jpg" ||
+		image.Link != "https://example.com/lake" || image.CreatedTime != 1500000000 {
+		t.Error("Unexpected image", image)
+	}
+	sydney := hanapi.NewRegion("", -33.86, 151.2, 0)
+	images, err = collector.getImagesWithClient(context.Background(), http.DefaultClient, sydney, store)
+	if err != nil || len(images) != 1 || images[0].ThumbnailURL != "https://example.com/harbour.jpg" {
+		t.Error("Expected enclosure to be used for Sydney but was", images, err)
+	}
+	// the feed is only fetched once for both regions
+	if requests != 1 {
+		t.Error("Expected feed to be cached but was requested", requests, "times")
+	}
+	// nothing is new the second time around
+	images, err = collector.getImagesWithClient(context.Background(), http.DefaultClient, canberra, store)
+	if err != nil || len(images) != 0 {
+		t.Error("Expected no new images but was", images, err)
+	}
+}
+
+func TestFeedEntryReadsAtom(t *testing.T) {
+	document := feedDocument{}
+	err := xml.Unmarshal([]byte(`<feed xmlns="http://www.w3.org/2005/Atom"
+		xmlns:georss="http://www.georss.org/georss">
+		<entry>
+			<title>Lake</title>
+			<id>tag:example.com,2017:lake</id>
+			<link rel="alternate" href="https://example.com/lake"/>
+			<link rel="enclosure" type="image/jpeg" href="https://example.com/lake.jpg"/>
+			<published>2017-07-14T02:40:00Z</published>
+			<author><name>Author</name></author>
+			<georss:point>-35.29 149.12</georss:point>
+		</entry>
+	</feed>`), &document)
+	if err != nil || len(document.Entries) != 1 {
+		t.Fatal("Expected 1 entry but was", document.Entries, err)
+	}
+	collector := NewFeedCollector(config.NewFeedConfig())
+	image := collector.convertEntry(document.Entries[0])
+	if image == nil {
+		t.Fatal("Expected entry to be converted")
+	}
+	if image.ImageURL != "https://example.com/lake.jpg" || image.Link != "https://example.com/lake" ||
+		image.User.Username != "Author" || image.ID != "tag:example.com,2017:lake" {
+		t.Error("Unexpected image", image)
+	}
+}
+
+// exifTIFF builds EXIF data placing a photo at -35.29, 149.12 and taken at
+// 2017-07-14 02:40:00 UTC
+func exifTIFF() []byte {
+	buf := new(bytes.Buffer)
+	le := binary.LittleEndian
+	write := func(values ...interface{}) {
+		for _, v := range values {
+			binary.Write(buf, le, v)
+		}
+	}
+	entry := func(tag uint16, fieldType uint16, count uint32, value uint32) {
+		write(tag, fieldType, count, value)
+	}
+	// header followed by IFD0 at 8, the Exif IFD at 38 and the GPS IFD at 56
+	buf.WriteString("II")
+	write(uint16(42), uint32(8))
+	write(uint16(2))
+	entry(exifIFDPointer, 4, 1, 38)
+	entry(gpsIFDPointer, 4, 1, 56)
+	write(uint32(0))
+	write(uint16(1))
+	entry(dateTimeOriginalTag, 2, 20, 110)
+	write(uint32(0))
+	write(uint16(4))
+	entry(gpsLatitudeRefTag, 2, 2, uint32('S'))
+	entry(gpsLatitudeTag, 5, 3, 130)
+	entry(gpsLongitudeRefTag, 2, 2, uint32('E'))
+	entry(gpsLongitudeTag, 5, 3, 154)
+	write(uint32(0))
+	buf.WriteString("2017:07:14 02:40:00\x00")
+	write(uint32(35), uint32(1), uint32(17), uint32(1), uint32(24), uint32(1))
+	write(uint32(149), uint32(1), uint32(7), uint32(1), uint32(12), uint32(1))
+	return buf.Bytes()
+}
+
+// jpegWithEXIF encodes a JPEG, inserting the EXIF data if it's not nil
+func jpegWithEXIF(exif []byte) []byte {
+	encoded := new(bytes.Buffer)
+	jpeg.Encode(encoded, image.NewRGBA(image.Rect(0, 0, 640, 480)), nil)
+	if exif == nil {
+		return encoded.Bytes()
+	}
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(2+6+len(exif)))
+	data = append(data, length...)
+	data = append(data, []byte("Exif\x00\x00")...)
+	data = append(data, exif...)
+	return append(data, encoded.Bytes()[2:]...)
+}
+
+func isobmffBox(boxType string, payload []byte) []byte {
+	box := make([]byte, 8)
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
+
+func TestReadEXIF(t *testing.T) {
+	check := func(format string, data []byte) {
+		exif, err := readEXIF(data)
+		if err != nil {
+			t.Fatal("Unexpected error reading", format, err)
+		}
+		if !exif.hasLocation || math.Abs(exif.lat+35.29) > 0.0001 || math.Abs(exif.lng-149.12) > 0.0001 {
+			t.Error("Expected", format, "location to be -35.29, 149.12 but was", exif.lat, exif.lng)
+		}
+		if exif.taken.Unix() != 1500000000 {
+			t.Error("Expected", format, "capture time to be 1500000000 but was", exif.taken.Unix())
+		}
+	}
+	check("JPEG", jpegWithEXIF(exifTIFF()))
+
+	// a HEIC file whose Exif item is stored in mdat
+	ftyp := isobmffBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	infe := isobmffBox("infe", []byte("\x02\x00\x00\x00\x00\x01\x00\x00Exif\x00"))
+	iinf := isobmffBox("iinf", append([]byte{0, 0, 0, 0, 0, 1}, infe...))
+	item := append([]byte{0, 0, 0, 0}, exifTIFF()...)
+	iloc := func(offset uint32) []byte {
+		payload := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 1, 0, 0, 0, 1}
+		extent := make([]byte, 8)
+		binary.BigEndian.PutUint32(extent, offset)
+		binary.BigEndian.PutUint32(extent[4:], uint32(len(item)))
+		return isobmffBox("iloc", append(payload, extent...))
+	}
+	meta := isobmffBox("meta", append(append([]byte{0, 0, 0, 0}, iinf...), iloc(0)...))
+	offset := uint32(len(ftyp) + len(meta) + 8)
+	meta = isobmffBox("meta", append(append([]byte{0, 0, 0, 0}, iinf...), iloc(offset)...))
+	heic := append(append(ftyp, meta...), isobmffBox("mdat", item)...)
+	check("HEIC", heic)
+
+	if _, err := readEXIF(jpegWithEXIF(nil)); err != errNoEXIF {
+		t.Error("Expected JPEG without EXIF to fail but was", err)
+	}
+}
+
+func TestReadEXIFRejectsHugeExtents(t *testing.T) {
+	ftyp := isobmffBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	infe := isobmffBox("infe", []byte("\x02\x00\x00\x00\x00\x01\x00\x00Exif\x00"))
+	iinf := isobmffBox("iinf", append([]byte{0, 0, 0, 0, 0, 1}, infe...))
+	// 8 byte offsets and lengths, where adding them together overflows
+	payload := []byte{0, 0, 0, 0, 0x88, 0x00, 0, 1, 0, 1, 0, 0, 0, 1}
+	extent := make([]byte, 16)
+	binary.BigEndian.PutUint64(extent, 16)
+	binary.BigEndian.PutUint64(extent[8:], math.MaxUint64-8)
+	iloc := isobmffBox("iloc", append(payload, extent...))
+	meta := isobmffBox("meta", append(append([]byte{0, 0, 0, 0}, iinf...), iloc...))
+	heic := append(append(ftyp, meta...), isobmffBox("mdat", make([]byte, 32))...)
+	if _, err := readEXIF(heic); err == nil {
+		t.Error("Expected the extent to be rejected")
+	}
+	// a box whose 64 bit size overflows
+	box := []byte{0, 0, 0, 1, 'm', 'e', 't', 'a'}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, math.MaxUint64-4)
+	box = append(append(box, size...), make([]byte, 16)...)
+	if _, err := readEXIF(append(ftyp, box...)); err == nil {
+		t.Error("Expected the box to be rejected")
+	}
+}
+
+func TestReadEXIFRejectsTruncatedItemInfo(t *testing.T) {
+	ftyp := isobmffBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	// version 1 has a 4 byte entry count, but the box ends after 2 bytes
+	for _, payload := range [][]byte{{1, 0, 0, 0, 0, 1}, {1, 0, 0, 0, 0, 0, 1}} {
+		meta := isobmffBox("meta", append([]byte{0, 0, 0, 0}, isobmffBox("iinf", payload)...))
+		if _, err := readEXIF(append(ftyp, meta...)); err == nil {
+			t.Error("Expected the truncated box to be rejected")
+		}
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	expected := "http://localhost/local/photos/trip/lake%20photo.jpg"
+	for _, baseURL := range []string{"http://localhost/local/", "http://localhost/local"} {
+		if u := LocalURL(baseURL, LocalPhotosPath, "trip/lake photo.jpg"); u != expected {
+			t.Error("Expected", expected, "but was", u)
+		}
+	}
+}
+
+func TestLocalCollectorReadsDirectory(t *testing.T) {
+	directory, err := ioutil.TempDir("", "hanlocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	os.MkdirAll(filepath.Join(directory, "trip"), 0755)
+	ioutil.WriteFile(filepath.Join(directory, "trip", "lake photo.jpg"), jpegWithEXIF(exifTIFF()), 0644)
+	ioutil.WriteFile(filepath.Join(directory, "untagged.jpg"), jpegWithEXIF(nil), 0644)
+	localConfig := &config.LocalConfiguration{
+		CollectorConfig: config.CollectorConfig{
+			CollectorName: "local",
+			Enabled:       true,
+			QueryLimit:    100,
+			QueryWindow:   60 * 60,
+		},
+		Directory: directory,
+		BaseURL:   "http://localhost/local/",
+	}
+	collector := NewLocalCollector(localConfig)
+	store := &MockCursorStore{cursors: map[string]string{}}
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	images, err := collector.GetImages(context.Background(), region, store)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(images) != 1 {
+		t.Fatal("Expected only the geotagged photo but was", images)
+	}
+	image := images[0]
+	if image.ImageURL != "http://localhost/local/photos/trip/lake%20photo.jpg" ||
+		image.ThumbnailURL != "http://localhost/local/thumbnails/trip/lake%20photo.jpg.jpg" ||
+		image.Source != "local" || image.CreatedTime != 1500000000 {
+		t.Error("Unexpected image", image)
+	}
+	f, err := os.Open(filepath.Join(directory, ".thumbnails", "trip", "lake photo.jpg.jpg"))
+	if err != nil {
+		t.Fatal("Expected thumbnail to be written", err)
+	}
+	defer f.Close()
+	thumbnail, err := jpeg.DecodeConfig(f)
+	if err != nil || thumbnail.Width != localThumbnailWidth {
+		t.Error("Expected thumbnail to be", localThumbnailWidth, "wide but was", thumbnail.Width, err)
+	}
+	// unchanged photos aren't returned again
+	images, err = collector.GetImages(context.Background(), region, store)
+	if err != nil || len(images) != 0 {
+		t.Error("Expected no new images but was", images, err)
+	}
+}
+
+func TestNewCollectorsCreatesEachInstance(t *testing.T) {
+	c, err := config.UnmarshalConfig(`{
+		"flickr": {"enabled": true, "api_key": "key"},
+		"twitter-news": {"type": "twitter", "enabled": true, "api_key": "key",
+			"api_secret": "secret", "access_token": "token", "access_secret": "secret"},
+		"twitter": {"enabled": false}
+	}`)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	collectorsList, err := NewCollectors(c)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	names := []string{}
+	for _, collector := range collectorsList {
+		names = append(names, collector.GetConfig().GetCollectorName())
+	}
+	expected := []string{"flickr", "twitter", "twitter-news"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Error("Expected", expected, "but was", names)
+	}
+	if _, ok := collectorsList[2].(*TwitterCollector); !ok {
+		t.Error("Expected twitter-news to be a TwitterCollector but was", collectorsList[2])
+	}
+}
+
+func TestStatusErrorClassification(t *testing.T) {
+	cases := map[int]ErrorKind{
+		429: ErrorRateLimited,
+		401: ErrorCredentials,
+		403: ErrorCredentials,
+		500: ErrorTransient,
+		503: ErrorTransient,
+		408: ErrorTransient,
+		400: ErrorPermanent,
+		404: ErrorPermanent,
+	}
+	for status, expected := range cases {
+		err := statusError(&http.Response{StatusCode: status}, fmt.Errorf("failed"))
+		if kind := ClassifyError(err); kind != expected {
+			t.Error("Expected", expected, "for", status, "but was", kind)
+		}
+	}
+	if kind := ClassifyError(errQueryLimitReached); kind != ErrorRateLimited {
+		t.Error("Expected", ErrorRateLimited, "but was", kind)
+	}
+	if kind := ClassifyError(fmt.Errorf("unknown")); kind != ErrorPermanent {
+		t.Error("Expected", ErrorPermanent, "but was", kind)
+	}
+}
+
+func TestRetryOnlyRetriesTransientErrors(t *testing.T) {
+	defer func(original func(context.Context, time.Duration) error) {
+		sleep = original
+	}(sleep)
+	delays := []time.Duration{}
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	attempts := 0
+	err := retry(context.Background(), 3, func() error {
+		attempts++
+		return &CollectorError{Kind: ErrorTransient, Err: fmt.Errorf("timeout")}
+	})
+	if attempts != 3 || err == nil {
+		t.Error("Expected 3 failed attempts but was", attempts, err)
+	}
+	if len(delays) != 2 {
+		t.Error("Expected 2 delays but was", len(delays))
+	}
+	for i, d := range delays {
+		if d <= 0 || d > retryBaseDelay<<uint(i) {
+			t.Error("Expected delay within backoff but was", d)
+		}
+	}
+	attempts = 0
+	retry(context.Background(), 3, func() error {
+		attempts++
+		return &CollectorError{Kind: ErrorCredentials, Err: fmt.Errorf("bad key")}
+	})
+	if attempts != 1 {
+		t.Error("Expected credential errors not to be retried but was", attempts)
+	}
+	attempts = 0
+	err = retry(context.Background(), 3, func() error {
+		attempts++
+		if attempts < 2 {
+			return &CollectorError{Kind: ErrorTransient, Err: fmt.Errorf("timeout")}
+		}
+		return nil
+	})
+	if attempts != 2 || err != nil {
+		t.Error("Expected to succeed on the second attempt but was", attempts, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := NewCircuitBreaker()
+	b.now = func() time.Time { return now }
+	transient := &CollectorError{Kind: ErrorTransient, Err: fmt.Errorf("timeout")}
+	for i := 0; i < circuitFailureThreshold; i++ {
+		if !b.Allow() {
+			t.Error("Expected circuit to be closed on", i)
+		}
+		b.Record(transient)
+	}
+	if b.State() != CircuitOpen || b.Allow() {
+		t.Error("Expected circuit to be open but was", b.State())
+	}
+	now = now.Add(circuitCooldown)
+	if b.State() != CircuitHalfOpen {
+		t.Error("Expected circuit to be half-open but was", b.State())
+	}
+	// only a single trial query is allowed
+	if !b.Allow() || b.Allow() {
+		t.Error("Expected a single trial query to be allowed")
+	}
+	b.Record(transient)
+	// a failed trial doubles the cooldown
+	now = now.Add(circuitCooldown)
+	if b.State() != CircuitOpen {
+		t.Error("Expected circuit to be open but was", b.State())
+	}
+	now = now.Add(circuitCooldown)
+	if !b.Allow() {
+		t.Error("Expected trial query after the longer cooldown")
+	}
+	b.Record(nil)
+	if b.State() != CircuitClosed {
+		t.Error("Expected circuit to be closed but was", b.State())
+	}
+}
+
+func TestCircuitBreakerOpensOnCredentialError(t *testing.T) {
+	b := NewCircuitBreaker()
+	b.Allow()
+	b.Record(&CollectorError{Kind: ErrorCredentials, Err: fmt.Errorf("bad key")})
+	if b.State() != CircuitOpen {
+		t.Error("Expected circuit to be open but was", b.State())
+	}
+}
+
+func TestQueryRetriesTransientFailures(t *testing.T) {
+	defer func(original func(context.Context, time.Duration) error) {
+		sleep = original
+	}(sleep)
+	sleep = func(ctx context.Context, d time.Duration) error {
+		return nil
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte(`{"query": {"pages": []}}`))
+	}))
+	defer server.Close()
+	c := NewWikimediaCollector(config.NewWikimediaConfig())
+	c.config.QueryLimit = 10
+	c.config.QueryWindow = 60
+	c.apiURL = server.URL
+	_, err := c.queryImages(context.Background(), server.Client(), Cell{Lat: -35.28, Lng: 149.13, Radius: 1000}, "")
+	if err != nil {
+		t.Error("Expected the retry to succeed but was", err)
+	}
+	if requests != 2 {
+		t.Error("Expected 2 requests but was", requests)
+	}
+}
+
+func TestQueryCellsStopsOnCredentialError(t *testing.T) {
+	planner := NewCoveragePlanner(QueryRange, 100)
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	queries := 0
+	_, err := queryCells(context.Background(), planner, nil, "test", region,
+		func(cell Cell, cursor string) (*cellResponse, error) {
+			queries++
+			if queries == 1 {
+				return &cellResponse{}, nil
+			}
+			return nil, &CollectorError{Kind: ErrorCredentials, Err: fmt.Errorf("bad key")}
+		})
+	if ClassifyError(err) != ErrorCredentials {
+		t.Error("Expected credential error but was", err)
+	}
+	if queries != 2 {
+		t.Error("Expected to stop after the credential error but made", queries, "queries")
+	}
+}
+
+func TestQueryCellsStopsWhenCancelled(t *testing.T) {
+	planner := NewCoveragePlanner(QueryRange, 100)
+	region := hanapi.NewRegion("", -35.28, 149.13, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	queries := 0
+	images, err := queryCells(ctx, planner, nil, "test", region,
+		func(cell Cell, cursor string) (*cellResponse, error) {
+			queries++
+			// cancel after the first cell
+			cancel()
+			return &cellResponse{images: []hanapi.ImageData{{ID: cell.ID}}}, nil
+		})
+	if err != context.Canceled {
+		t.Error("Expected", context.Canceled, "but was", err)
+	}
+	if queries != 1 || len(images) != 1 {
+		t.Error("Expected the first cell's images but was", queries, images)
+	}
+}
+
+func TestCancelledQueryDoesNotTripCircuit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// hang until the client gives up
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	c := NewWikimediaCollector(config.NewWikimediaConfig())
+	c.apiURL = server.URL
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.queryImages(ctx, newHTTPClient(c.config), Cell{Lat: -35.28, Lng: 149.13, Radius: 1000}, "")
+	if err != context.DeadlineExceeded {
+		t.Error("Expected", context.DeadlineExceeded, "but was", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Expected the query to stop once cancelled but took", time.Since(start))
+	}
+	if c.CircuitState() != CircuitClosed {
+		t.Error("Expected circuit to be closed but was", c.CircuitState())
+	}
+}
+
+func TestQueryRecordsMetrics(t *testing.T) {
+	c := NewMockCollector(10)
+	config := c.GetConfig()
+	c.query(context.Background(), config, "metrics", func() error {
+		return nil
+	})
+	c.query(context.Background(), config, "metrics", func() error {
+		return &CollectorError{Kind: ErrorPermanent, Err: fmt.Errorf("bad request")}
+	})
+	for _, result := range []string{"ok", "error"} {
+		count := testutil.ToFloat64(metrics.CollectorQueries.WithLabelValues("", "metrics", result))
+		if count != 1 {
+			t.Error("Expected 1", result, "query but was", count)
+		}
 	}
 }
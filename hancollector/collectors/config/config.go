@@ -3,34 +3,151 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi/secrets"
+	"sort"
+	"strings"
 	"time"
 )
 
-// CollectionConfig holds configuration information for each collector
-type CollectionConfig struct {
-	InstagramConfig *InstagramConfiguration `json:"instagram"`
-	FlickrConfig    *FlickrConfiguration    `json:"flickr"`
-	TwitterConfig   *TwitterConfiguration   `json:"twitter"`
+// CollectionConfig maps the name of each configured collector to its
+// configuration. Names are unique, so multiple collectors of the same type
+// can be configured by giving each a different name and setting `type`
+type CollectionConfig map[string]CollectorConfiguration
+
+// ConfigurationFactory creates a configuration with default values, that the
+// json configuration is decoded into
+type ConfigurationFactory func() CollectorConfiguration
+
+var configurationTypes = map[string]ConfigurationFactory{}
+
+// defaultTimeout is used for requests when a collector doesn't set a timeout
+const defaultTimeout = 30 * time.Second
+
+// RegisterType makes a type of collector configurable, this is called when
+// registering a collector
+func RegisterType(collectorType string, factory ConfigurationFactory) {
+	configurationTypes[collectorType] = factory
+}
+
+// Names returns the configured collector names in a consistent order
+func (c CollectionConfig) Names() []string {
+	names := []string{}
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-// UnmarshalConfig will convert a json string into the CollectionConfig struct
-func UnmarshalConfig(jsonString string) CollectionConfig {
+// Enabled returns whether at least one collector is enabled
+func (c CollectionConfig) Enabled() bool {
+	for _, collector := range c {
+		if collector.IsEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks problems between collectors, each collector's own
+// configuration is validated as it's decoded. Enabled local collectors must
+// serve their photos at different paths
+func (c CollectionConfig) Validate() []string {
+	problems := []string{}
+	served := map[string]string{}
+	for _, name := range c.Names() {
+		local, ok := c[name].(*LocalConfiguration)
+		if !ok || !local.IsEnabled() || len(local.ServePath()) == 0 {
+			continue
+		}
+		path := local.ServePath()
+		if other, ok := served[path]; ok {
+			problems = append(problems, fmt.Sprintf(
+				"%s: base_url is already used by %s", name, other))
+			continue
+		}
+		served[path] = name
+	}
+	return problems
+}
+
+// Errors lists every problem found in the configuration
+type Errors []string
+
+func (e Errors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// UnmarshalConfig will convert a json string into the CollectionConfig type.
+// Each key is the collector's name, which is also used as its type unless
+// `type` is specified. Values can reference secrets, see `secrets.Resolve`.
+// The collectors that could be decoded are returned along with `Errors`
+// listing every problem found, so that they can all be fixed at once
+func UnmarshalConfig(jsonString string) (CollectionConfig, error) {
 	c := CollectionConfig{}
-	c.InstagramConfig = InstagramConfig
-	c.FlickrConfig = FlickrConfig
-	c.TwitterConfig = TwitterConfig
-	err := json.Unmarshal([]byte(jsonString), &c)
+	raw := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(jsonString), &raw)
 	if err != nil {
-		// TODO: send error back
-		fmt.Println(err)
+		return c, Errors{err.Error()}
+	}
+	problems := Errors{}
+	for _, name := range sortedKeys(raw) {
+		collectorConfig, err := decodeCollectorConfig(name, raw[name])
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		collectorProblems := append(secrets.ResolveFields(collectorConfig),
+			collectorConfig.Validate()...)
+		for _, problem := range collectorProblems {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, problem))
+		}
+		c[name] = collectorConfig
+	}
+	if len(problems) > 0 {
+		return c, problems
+	}
+	return c, nil
+}
+
+func sortedKeys(raw map[string]json.RawMessage) []string {
+	keys := []string{}
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func decodeCollectorConfig(name string, value json.RawMessage) (CollectorConfiguration, error) {
+	header := struct {
+		Type string `json:"type"`
+	}{}
+	if err := json.Unmarshal(value, &header); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	collectorType := header.Type
+	if len(collectorType) == 0 {
+		collectorType = name
+	}
+	factory, ok := configurationTypes[collectorType]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown collector type %q", name, collectorType)
+	}
+	collectorConfig := factory()
+	if err := json.Unmarshal(value, collectorConfig); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
 	}
-	return c
+	collectorConfig.setIdentity(name, collectorType)
+	return collectorConfig, nil
 }
 
 // CollectorConfiguration is the base configuration
 type CollectorConfiguration interface {
 	IsEnabled() bool
 	GetCollectorName() string
+	// The type of collector, this is the name that it was registered with
+	GetCollectorType() string
 	// The frequency in seconds at which the collector should be updated for
 	// all regions
 	GetUpdateFrequency() time.Duration
@@ -38,16 +155,34 @@ type CollectorConfiguration interface {
 	GetQueryLimit() int
 	// in seconds
 	GetQueryWindow() int64
+	// The limit and window in seconds for a single endpoint
+	GetEndpointBudget(endpoint string) (int, int64)
+	// How long a single request can take before it's given up on
+	GetTimeout() time.Duration
+	// Validate returns each problem with the configuration
+	Validate() []string
+	setIdentity(name string, collectorType string)
 }
 
 // CollectorConfig is a type used for CollectorConfiguration interface
 type CollectorConfig struct {
-	CollectorConfiguration
-	CollectorName   string
-	Enabled         bool          `json:"enabled"`
-	UpdateFrequency time.Duration `json:"update_frequency"`
-	QueryLimit      int           `json:"query_limit"`
-	QueryWindow     int64         `json:"query_window"`
+	CollectorConfiguration `json:"-"`
+	CollectorName          string        `json:"-"`
+	CollectorType          string        `json:"type"`
+	Enabled                bool          `json:"enabled"`
+	UpdateFrequency        time.Duration `json:"update_frequency"`
+	QueryLimit             int           `json:"query_limit"`
+	QueryWindow            int64         `json:"query_window"`
+	// Endpoints overrides the query limit and window for specific endpoints
+	Endpoints map[string]EndpointBudget `json:"endpoints"`
+	// Timeout in seconds for each request
+	Timeout int64 `json:"timeout"`
+}
+
+// EndpointBudget limits the queries made to a single endpoint
+type EndpointBudget struct {
+	QueryLimit  int   `json:"query_limit"`
+	QueryWindow int64 `json:"query_window"`
 }
 
 // IsEnabled if this collector should be used
@@ -60,6 +195,11 @@ func (c CollectorConfig) GetCollectorName() string {
 	return c.CollectorName
 }
 
+// GetCollectorType returns the type that the collector was registered with
+func (c CollectorConfig) GetCollectorType() string {
+	return c.CollectorType
+}
+
 // GetUpdateFrequency returns the frequency which the collector should be
 // updated
 func (c CollectorConfig) GetUpdateFrequency() time.Duration {
@@ -75,3 +215,78 @@ func (c CollectorConfig) GetQueryLimit() int {
 func (c CollectorConfig) GetQueryWindow() int64 {
 	return c.QueryWindow
 }
+
+// GetEndpointBudget returns the limit of queries per window for the endpoint,
+// this is the collector's limit unless the endpoint has its own
+func (c CollectorConfig) GetEndpointBudget(endpoint string) (int, int64) {
+	budget, ok := c.Endpoints[endpoint]
+	if !ok {
+		return c.QueryLimit, c.QueryWindow
+	}
+	if budget.QueryWindow == 0 {
+		budget.QueryWindow = c.QueryWindow
+	}
+	return budget.QueryLimit, budget.QueryWindow
+}
+
+// GetTimeout returns how long a request can take, this is 30 seconds unless
+// the collector sets its own timeout
+func (c CollectorConfig) GetTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// Validate returns each problem with the limits set. Collectors should
+// extend this to check the settings they require when enabled
+func (c CollectorConfig) Validate() []string {
+	problems := []string{}
+	if c.UpdateFrequency <= 0 {
+		problems = append(problems, "update_frequency must be greater than 0")
+	}
+	if c.QueryLimit <= 0 {
+		problems = append(problems, "query_limit must be greater than 0")
+	}
+	if c.QueryWindow <= 0 {
+		problems = append(problems, "query_window must be greater than 0")
+	}
+	if c.Timeout < 0 {
+		problems = append(problems, "timeout can't be negative")
+	}
+	endpoints := []string{}
+	for endpoint := range c.Endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		budget := c.Endpoints[endpoint]
+		if budget.QueryLimit < 0 || budget.QueryWindow < 0 {
+			problems = append(problems, fmt.Sprintf("endpoints.%s can't be negative", endpoint))
+		}
+	}
+	return problems
+}
+
+// required adds a problem for each empty field when the collector is enabled
+func (c CollectorConfig) required(problems []string, fields map[string]string) []string {
+	if !c.Enabled {
+		return problems
+	}
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(fields[name]) == 0 {
+			problems = append(problems, name+" is required")
+		}
+	}
+	return problems
+}
+
+func (c *CollectorConfig) setIdentity(name string, collectorType string) {
+	c.CollectorName = name
+	c.CollectorType = collectorType
+}
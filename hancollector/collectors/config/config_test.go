@@ -2,16 +2,33 @@ package config
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 )
 
+func init() {
+	// collectors register their configuration, which isn't imported here
+	RegisterType("instagram", func() CollectorConfiguration {
+		return NewInstagramConfig()
+	})
+	RegisterType("twitter", func() CollectorConfiguration {
+		return NewTwitterConfig()
+	})
+}
+
 func TestUnmarshalConfig(t *testing.T) {
 	queryLimit := 140
 	accessToken := "testApiToken"
 	json := `{"instagram": {"enabled": true, "query_limit": %d, "access_token": "%s"}}`
 	testStr := fmt.Sprintf(json, queryLimit, accessToken)
-	result := UnmarshalConfig(testStr)
-	instagram := result.InstagramConfig
+	result, err := UnmarshalConfig(testStr)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	instagram, ok := result["instagram"].(*InstagramConfiguration)
+	if !ok {
+		t.Fatal("Expected instagram config but was", result["instagram"])
+	}
 	if !instagram.IsEnabled() {
 		t.Error("Expected instagram config to be enabled")
 	}
@@ -23,14 +40,106 @@ func TestUnmarshalConfig(t *testing.T) {
 		t.Error("Expected query limit to be", accessToken, "but was", instagram.AccessToken)
 	}
 	// ensure that default values are used for missing fields
-	if InstagramConfig.UpdateFrequency != instagram.GetUpdateFrequency() {
+	defaults := NewInstagramConfig()
+	if defaults.UpdateFrequency != instagram.GetUpdateFrequency() {
 		t.Error("Expected update frequency to be",
-			InstagramConfig.UpdateFrequency, "but was",
+			defaults.UpdateFrequency, "but was",
 			instagram.GetUpdateFrequency())
 	}
-	// test that no other configs are enabled since they're missing from
+	// test that no other configs are created since they're missing from
 	// the json
-	if result.FlickrConfig.IsEnabled() {
-		t.Error("Expected flickr config to be disabled")
+	if len(result) != 1 {
+		t.Error("Expected only instagram to be configured but was", result.Names())
+	}
+}
+
+func TestUnmarshalConfigWithMultipleInstances(t *testing.T) {
+	json := `{
+		"twitter": {"enabled": false, "api_key": "first"},
+		"twitter-news": {"type": "twitter", "enabled": false, "api_key": "second"},
+		"unknown": {"enabled": true}
+	}`
+	result, err := UnmarshalConfig(json)
+	// unknown types are reported but the other collectors are still returned
+	expectedErr := `unknown: unknown collector type "unknown"`
+	if errs, ok := err.(Errors); !ok || len(errs) != 1 || errs[0] != expectedErr {
+		t.Error("Expected", expectedErr, "but was", err)
+	}
+	names := result.Names()
+	if len(names) != 2 || names[0] != "twitter" || names[1] != "twitter-news" {
+		t.Fatal("Expected both twitter collectors but was", names)
+	}
+	for _, name := range names {
+		twitter, ok := result[name].(*TwitterConfiguration)
+		if !ok {
+			t.Fatal("Expected", name, "to be a twitter config but was", result[name])
+		}
+		if twitter.GetCollectorName() != name || twitter.GetCollectorType() != "twitter" {
+			t.Error("Unexpected name", twitter.GetCollectorName(), "or type",
+				twitter.GetCollectorType())
+		}
+	}
+	if result["twitter-news"].(*TwitterConfiguration).APIKey != "second" {
+		t.Error("Expected each instance to have its own settings")
+	}
+}
+
+func TestUnmarshalConfigReportsAllErrors(t *testing.T) {
+	json := `{
+		"twitter": {"enabled": true, "api_key": "key", "api_secret": "secret"},
+		"instagram": {"enabled": true, "query_limit": 0, "access_token": "token"},
+		"instagram-disabled": {"type": "instagram", "enabled": false},
+		"flickr": {"enabled": true}
+	}`
+	result, err := UnmarshalConfig(json)
+	expected := Errors{
+		`flickr: unknown collector type "flickr"`,
+		"instagram: query_limit must be greater than 0",
+		"twitter: access_secret is required",
+		"twitter: access_token is required",
+	}
+	if fmt.Sprint(err) != fmt.Sprint(expected) {
+		t.Error("Expected", expected, "but was", err)
+	}
+	if len(result) != 3 {
+		t.Error("Expected the decoded collectors to be returned but was", result.Names())
+	}
+}
+
+func TestUnmarshalConfigResolvesSecrets(t *testing.T) {
+	t.Setenv("HAN_TEST_INSTAGRAM_TOKEN", "secret-token")
+	json := `{
+		"instagram": {"enabled": true, "access_token": "env:HAN_TEST_INSTAGRAM_TOKEN"},
+		"twitter": {"enabled": false, "api_key": "env:HAN_TEST_MISSING"}
+	}`
+	result, err := UnmarshalConfig(json)
+	expected := "twitter: api_key: environment variable HAN_TEST_MISSING is not set"
+	if fmt.Sprint(err) != expected {
+		t.Error("Expected", expected, "but was", err)
+	}
+	instagram := result["instagram"].(*InstagramConfiguration)
+	if instagram.AccessToken != "secret-token" {
+		t.Error("Expected secret to be resolved but was", instagram.AccessToken)
+	}
+}
+
+func TestValidateRejectsDuplicateLocalPaths(t *testing.T) {
+	newLocal := func(baseURL string, enabled bool) *LocalConfiguration {
+		c := NewLocalConfig()
+		c.Enabled = enabled
+		c.Directory = "photos"
+		c.BaseURL = baseURL
+		return c
+	}
+	c := CollectionConfig{
+		"first":    newLocal("http://localhost/local/", true),
+		"second":   newLocal("http://example.com/local", true),
+		"third":    newLocal("http://localhost/other/", true),
+		"disabled": newLocal("http://localhost/local/", false),
+	}
+	problems := c.Validate()
+	expected := []string{"second: base_url is already used by first"}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Error("Expected", expected, "but was", problems)
 	}
 }
@@ -0,0 +1,36 @@
+package config
+
+// FeedConfiguration is a Configuration type specifying information about
+// RSS, Atom and GeoRSS feed collection
+type FeedConfiguration struct {
+	CollectorConfig
+	// Feeds are the URLs of each feed that is polled
+	Feeds []string `json:"feeds"`
+}
+
+// NewFeedConfig returns the default configuration
+func NewFeedConfig() *FeedConfiguration {
+	c := &FeedConfiguration{
+		CollectorConfig: CollectorConfig{},
+		Feeds:           []string{},
+	}
+	c.CollectorConfig.CollectorName = "feed"
+	c.CollectorConfig.CollectorType = "feed"
+	// easily turn on or off each collector
+	c.CollectorConfig.Enabled = false
+
+	// update every 30 minutes
+	c.CollectorConfig.UpdateFrequency = 30 * 60
+	c.CollectorConfig.QueryWindow = 1 * 60 * 60
+	c.CollectorConfig.QueryLimit = 1000
+	return c
+}
+
+// Validate checks that feeds are listed when enabled
+func (c *FeedConfiguration) Validate() []string {
+	problems := c.CollectorConfig.Validate()
+	if c.Enabled && len(c.Feeds) == 0 {
+		problems = append(problems, "feeds must list at least one feed")
+	}
+	return problems
+}
@@ -4,22 +4,30 @@ package config
 // Flickr collection
 type FlickrConfiguration struct {
 	CollectorConfig
-	APIKey string `json:"api_key"`
-	Secret string `json:"secret"`
+	APIKey string `json:"api_key" secret:"true"`
+	Secret string `json:"secret" secret:"true"`
 }
 
-// FlickrConfig is the current configuration
-var FlickrConfig = &FlickrConfiguration{
-	CollectorConfig: CollectorConfig{},
-}
-
-func init() {
-	FlickrConfig.CollectorConfig.CollectorName = "flickr"
+// NewFlickrConfig returns the default configuration
+func NewFlickrConfig() *FlickrConfiguration {
+	c := &FlickrConfiguration{
+		CollectorConfig: CollectorConfig{},
+	}
+	c.CollectorConfig.CollectorName = "flickr"
+	c.CollectorConfig.CollectorType = "flickr"
 	// easily turn on or off each collector
-	FlickrConfig.CollectorConfig.Enabled = false
+	c.CollectorConfig.Enabled = false
 
 	// update every hour
-	FlickrConfig.CollectorConfig.UpdateFrequency = 1 * 60 * 60
-	FlickrConfig.CollectorConfig.QueryWindow = 1 * 60 * 60
-	FlickrConfig.CollectorConfig.QueryLimit = 3000
+	c.CollectorConfig.UpdateFrequency = 1 * 60 * 60
+	c.CollectorConfig.QueryWindow = 1 * 60 * 60
+	c.CollectorConfig.QueryLimit = 3000
+	return c
+}
+
+// Validate checks that the API key is set when enabled
+func (c *FlickrConfiguration) Validate() []string {
+	return c.required(c.CollectorConfig.Validate(), map[string]string{
+		"api_key": c.APIKey,
+	})
 }
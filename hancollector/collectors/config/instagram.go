@@ -4,21 +4,29 @@ package config
 // Instagram collection
 type InstagramConfiguration struct {
 	CollectorConfig
-	AccessToken string `json:"access_token"`
+	AccessToken string `json:"access_token" secret:"true"`
 }
 
-// InstagramConfig is the current configuration
-var InstagramConfig = &InstagramConfiguration{
-	CollectorConfig: CollectorConfig{},
-}
-
-func init() {
-	InstagramConfig.CollectorConfig.CollectorName = "instagram"
+// NewInstagramConfig returns the default configuration
+func NewInstagramConfig() *InstagramConfiguration {
+	c := &InstagramConfiguration{
+		CollectorConfig: CollectorConfig{},
+	}
+	c.CollectorConfig.CollectorName = "instagram"
+	c.CollectorConfig.CollectorType = "instagram"
 	// easily turn on or off each collector
-	InstagramConfig.CollectorConfig.Enabled = false
+	c.CollectorConfig.Enabled = false
 
 	// update every minute
-	InstagramConfig.CollectorConfig.UpdateFrequency = 1 * 60
-	InstagramConfig.CollectorConfig.QueryWindow = 1 * 60 * 60
-	InstagramConfig.CollectorConfig.QueryLimit = 4500
+	c.CollectorConfig.UpdateFrequency = 1 * 60
+	c.CollectorConfig.QueryWindow = 1 * 60 * 60
+	c.CollectorConfig.QueryLimit = 4500
+	return c
+}
+
+// Validate checks that the access token is set when enabled
+func (c *InstagramConfiguration) Validate() []string {
+	return c.required(c.CollectorConfig.Validate(), map[string]string{
+		"access_token": c.AccessToken,
+	})
 }
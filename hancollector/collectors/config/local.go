@@ -0,0 +1,77 @@
+package config
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// LocalConfiguration is a Configuration type specifying information about
+// collecting photos from a local directory
+type LocalConfiguration struct {
+	CollectorConfig
+	// Directory is scanned for JPEG and HEIC photos, including its
+	// subdirectories. This can be a bucket that's mounted or synced locally
+	Directory string `json:"directory"`
+	// ThumbnailDirectory is where generated thumbnails are stored, this
+	// defaults to `.thumbnails` within Directory
+	ThumbnailDirectory string `json:"thumbnail_directory"`
+	// BaseURL is the public URL that hanhttpserver serves the photos at
+	BaseURL string `json:"base_url"`
+	// Username is shown as the owner of each photo
+	Username string `json:"username"`
+}
+
+// NewLocalConfig returns the default configuration
+func NewLocalConfig() *LocalConfiguration {
+	c := &LocalConfiguration{
+		CollectorConfig: CollectorConfig{},
+	}
+	c.CollectorConfig.CollectorName = "local"
+	c.CollectorConfig.CollectorType = "local"
+	// easily turn on or off each collector
+	c.CollectorConfig.Enabled = false
+
+	// update every 5 minutes
+	c.CollectorConfig.UpdateFrequency = 5 * 60
+	// scanning the directory isn't restricted
+	c.CollectorConfig.QueryWindow = 1 * 60 * 60
+	c.CollectorConfig.QueryLimit = 1000000
+	c.BaseURL = "http://localhost/local/"
+	return c
+}
+
+// GetThumbnailDirectory returns where thumbnails should be stored
+func (c *LocalConfiguration) GetThumbnailDirectory() string {
+	if len(c.ThumbnailDirectory) > 0 {
+		return c.ThumbnailDirectory
+	}
+	return filepath.Join(c.Directory, ".thumbnails")
+}
+
+// ServePath returns the path of the base URL, which hanhttpserver serves the
+// photos under, with a leading and trailing slash. This is empty if the base
+// URL is invalid
+func (c *LocalConfiguration) ServePath() string {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return ""
+	}
+	path := strings.Trim(base.Path, "/")
+	if len(path) == 0 {
+		return "/"
+	}
+	return "/" + path + "/"
+}
+
+// Validate checks that the directory is set when enabled
+func (c *LocalConfiguration) Validate() []string {
+	problems := c.required(c.CollectorConfig.Validate(), map[string]string{
+		"directory": c.Directory,
+		"base_url":  c.BaseURL,
+	})
+	if c.Enabled && len(c.BaseURL) > 0 && len(c.ServePath()) == 0 {
+		problems = append(problems, "base_url is invalid")
+	}
+	return problems
+}
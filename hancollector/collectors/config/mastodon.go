@@ -0,0 +1,43 @@
+package config
+
+// MastodonConfiguration is a Configuration type specifying information about
+// Mastodon collection
+type MastodonConfiguration struct {
+	CollectorConfig
+	// Instances are the base URLs of the instances whose public timelines are
+	// read, eg. https://mastodon.social
+	Instances []string `json:"instances"`
+	// AccessToken is optional, some instances require it for public timelines
+	AccessToken string `json:"access_token" secret:"true"`
+	// Local restricts timelines to posts made on each instance, rather than
+	// everything the instance has federated
+	Local bool `json:"local"`
+}
+
+// NewMastodonConfig returns the default configuration
+func NewMastodonConfig() *MastodonConfiguration {
+	c := &MastodonConfiguration{
+		CollectorConfig: CollectorConfig{},
+		Instances:       []string{},
+	}
+	c.CollectorConfig.CollectorName = "mastodon"
+	c.CollectorConfig.CollectorType = "mastodon"
+	// easily turn on or off each collector
+	c.CollectorConfig.Enabled = false
+
+	// update every 10 minutes
+	c.CollectorConfig.UpdateFrequency = 10 * 60
+	c.CollectorConfig.QueryWindow = 5 * 60
+	c.CollectorConfig.QueryLimit = 300
+	c.Local = true
+	return c
+}
+
+// Validate checks that instances are listed when enabled
+func (c *MastodonConfiguration) Validate() []string {
+	problems := c.CollectorConfig.Validate()
+	if c.Enabled && len(c.Instances) == 0 {
+		problems = append(problems, "instances must list at least one instance")
+	}
+	return problems
+}
@@ -4,24 +4,35 @@ package config
 // Twitter collection
 type TwitterConfiguration struct {
 	CollectorConfig
-	APIKey       string `json:"api_key"`
-	APISecret    string `json:"api_secret"`
-	AccessToken  string `json:"access_token"`
-	AccessSecret string `json:"access_secret"`
+	APIKey       string `json:"api_key" secret:"true"`
+	APISecret    string `json:"api_secret" secret:"true"`
+	AccessToken  string `json:"access_token" secret:"true"`
+	AccessSecret string `json:"access_secret" secret:"true"`
 }
 
-// TwitterConfig is the current configuration
-var TwitterConfig = &TwitterConfiguration{
-	CollectorConfig: CollectorConfig{},
-}
-
-func init() {
-	TwitterConfig.CollectorConfig.CollectorName = "twitter"
+// NewTwitterConfig returns the default configuration
+func NewTwitterConfig() *TwitterConfiguration {
+	c := &TwitterConfiguration{
+		CollectorConfig: CollectorConfig{},
+	}
+	c.CollectorConfig.CollectorName = "twitter"
+	c.CollectorConfig.CollectorType = "twitter"
 	// easily turn on or off each collector
-	TwitterConfig.CollectorConfig.Enabled = false
+	c.CollectorConfig.Enabled = false
 
 	// update every minute
-	TwitterConfig.CollectorConfig.UpdateFrequency = 1 * 60 * 60
-	TwitterConfig.CollectorConfig.QueryWindow = 15 * 60
-	TwitterConfig.CollectorConfig.QueryLimit = 150
+	c.CollectorConfig.UpdateFrequency = 1 * 60 * 60
+	c.CollectorConfig.QueryWindow = 15 * 60
+	c.CollectorConfig.QueryLimit = 150
+	return c
+}
+
+// Validate checks that keys are set when enabled
+func (c *TwitterConfiguration) Validate() []string {
+	return c.required(c.CollectorConfig.Validate(), map[string]string{
+		"api_key":       c.APIKey,
+		"api_secret":    c.APISecret,
+		"access_token":  c.AccessToken,
+		"access_secret": c.AccessSecret,
+	})
 }
@@ -0,0 +1,35 @@
+package config
+
+// WikimediaConfiguration is a Configuration type specifying information about
+// Wikimedia Commons collection
+type WikimediaConfiguration struct {
+	CollectorConfig
+	// UserAgent identifies requests as required by Wikimedia's User-Agent
+	// policy, this should include contact information
+	UserAgent string `json:"user_agent"`
+}
+
+// NewWikimediaConfig returns the default configuration
+func NewWikimediaConfig() *WikimediaConfiguration {
+	c := &WikimediaConfiguration{
+		CollectorConfig: CollectorConfig{},
+	}
+	c.CollectorConfig.CollectorName = "wikimedia"
+	c.CollectorConfig.CollectorType = "wikimedia"
+	// easily turn on or off each collector
+	c.CollectorConfig.Enabled = false
+
+	// update every day, since Commons changes slowly
+	c.CollectorConfig.UpdateFrequency = 24 * 60 * 60
+	c.CollectorConfig.QueryWindow = 1 * 60 * 60
+	c.CollectorConfig.QueryLimit = 1000
+	c.UserAgent = "hanserver (https://github.com/oliveroneill/hanserver)"
+	return c
+}
+
+// Validate checks that the user agent is set when enabled
+func (c *WikimediaConfiguration) Validate() []string {
+	return c.required(c.CollectorConfig.Validate(), map[string]string{
+		"user_agent": c.UserAgent,
+	})
+}
@@ -0,0 +1,327 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"github.com/kellydunn/golang-geo"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"math"
+	"sync"
+)
+
+// maxCellDepth is the amount of times a cell can be subdivided
+const maxCellDepth = 3
+
+// emptyLimit is the amount of consecutive empty results before a cell is
+// skipped
+const emptyLimit = 3
+
+// emptyRetry is the amount of plans an empty cell is skipped for before it's
+// queried again, in case new content has appeared
+const emptyRetry = 10
+
+// Cell is a circular area that's searched with a single query
+type Cell struct {
+	// ID is unique within a region and stays the same between plans
+	ID     string
+	Lat    float64
+	Lng    float64
+	Radius float64
+}
+
+type cellState struct {
+	subdivided bool
+	emptyCount int
+	skipCount  int
+}
+
+// CoveragePlanner tiles regions with hexagonal cells sized to a source's
+// search radius. Cells that return at least `resultCap` results are split
+// into smaller cells and cells that repeatedly return nothing are skipped
+type CoveragePlanner struct {
+	searchRadius float64
+	resultCap    int
+	cells        map[string]*cellState
+	mutex        sync.Mutex
+}
+
+// NewCoveragePlanner creates a `CoveragePlanner`
+// @param searchRadius - the radius of a single query in meters
+// @param resultCap    - the most results a query can return, cells are never
+// subdivided if this is 0
+func NewCoveragePlanner(searchRadius float64, resultCap int) *CoveragePlanner {
+	return &CoveragePlanner{
+		searchRadius: searchRadius,
+		resultCap:    resultCap,
+		cells:        map[string]*cellState{},
+	}
+}
+
+// Plan returns the cells that should be queried to cover the region, ordered
+// from the region's centre outwards
+func (p *CoveragePlanner) Plan(region *hanapi.Region) []Cell {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	cells := []Cell{}
+	for _, cell := range tileRegion(region, p.searchRadius) {
+		cells = append(cells, p.plan(region, cell, 0)...)
+	}
+	return cells
+}
+
+func (p *CoveragePlanner) plan(region *hanapi.Region, cell Cell, depth int) []Cell {
+	state := p.getState(region, cell)
+	if state.subdivided && depth < maxCellDepth {
+		cells := []Cell{}
+		for _, child := range subdivide(cell) {
+			if cellIntersects(region, child) {
+				cells = append(cells, p.plan(region, child, depth+1)...)
+			}
+		}
+		return cells
+	}
+	if state.emptyCount >= emptyLimit {
+		state.skipCount++
+		if state.skipCount <= emptyRetry {
+			return []Cell{}
+		}
+		state.skipCount = 0
+	}
+	return []Cell{cell}
+}
+
+// Record should be called with the amount of results that a cell's query
+// returned so that future plans can adapt
+func (p *CoveragePlanner) Record(region *hanapi.Region, cell Cell, results int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	state := p.getState(region, cell)
+	if results == 0 {
+		state.emptyCount++
+		return
+	}
+	state.emptyCount = 0
+	state.skipCount = 0
+	if p.capped(results) {
+		state.subdivided = true
+	}
+}
+
+// capped returns whether a query returned as many results as it could, so
+// there may be more that weren't returned
+func (p *CoveragePlanner) capped(results int) bool {
+	return p.resultCap > 0 && results >= p.resultCap
+}
+
+func (p *CoveragePlanner) getState(region *hanapi.Region, cell Cell) *cellState {
+	key := RegionKey(region) + "|" + cell.ID
+	state, ok := p.cells[key]
+	if !ok {
+		state = &cellState{}
+		p.cells[key] = state
+	}
+	return state
+}
+
+// RegionKey returns a key that identifies the region, regions that haven't
+// been stored are identified by their centre
+func RegionKey(region *hanapi.Region) string {
+	if len(region.ID) > 0 {
+		return region.ID.Hex()
+	}
+	return fmt.Sprintf("%f,%f", region.Lat, region.Lng)
+}
+
+// tileRegion covers the region in pointy-top hexagons whose circumradius is
+// the search radius, so that each hexagon is covered by one query
+func tileRegion(region *hanapi.Region, searchRadius float64) []Cell {
+	centre := geo.NewPoint(region.Lat, region.Lng)
+	// hexagons are sqrt(3) * searchRadius apart
+	rings := int(math.Ceil((region.GetRadius()+searchRadius)/(math.Sqrt(3)*searchRadius))) + 1
+	cells := []Cell{}
+	for ring := 0; ring <= rings; ring++ {
+		for _, axial := range hexRing(ring) {
+			q, r := float64(axial[0]), float64(axial[1])
+			x := searchRadius * math.Sqrt(3) * (q + r/2)
+			y := searchRadius * 1.5 * r
+			p := centre
+			if ring > 0 {
+				bearing := math.Atan2(x, y) * 180 / math.Pi
+				p = centre.PointAtDistanceAndBearing(math.Hypot(x, y)/1000, bearing)
+			}
+			cell := Cell{
+				ID:     fmt.Sprintf("%d,%d", axial[0], axial[1]),
+				Lat:    p.Lat(),
+				Lng:    p.Lng(),
+				Radius: searchRadius,
+			}
+			if cellIntersects(region, cell) {
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells
+}
+
+// hexRing returns the axial coordinates of the hexagons `ring` steps away
+// from the origin
+func hexRing(ring int) [][2]int {
+	if ring == 0 {
+		return [][2]int{{0, 0}}
+	}
+	directions := [][2]int{{1, 0}, {1, -1}, {0, -1}, {-1, 0}, {-1, 1}, {0, 1}}
+	hexes := [][2]int{}
+	q, r := -ring, ring
+	for _, d := range directions {
+		for i := 0; i < ring; i++ {
+			hexes = append(hexes, [2]int{q, r})
+			q += d[0]
+			r += d[1]
+		}
+	}
+	return hexes
+}
+
+// subdivide splits a cell into seven cells of half the radius, which
+// together cover the original cell
+func subdivide(cell Cell) []Cell {
+	centre := geo.NewPoint(cell.Lat, cell.Lng)
+	children := []Cell{{
+		ID:     cell.ID + "/0",
+		Lat:    cell.Lat,
+		Lng:    cell.Lng,
+		Radius: cell.Radius / 2,
+	}}
+	distance := math.Sqrt(3) * cell.Radius / 2
+	for i := 0; i < 6; i++ {
+		p := centre.PointAtDistanceAndBearing(distance/1000, float64(i*60))
+		children = append(children, Cell{
+			ID:     fmt.Sprintf("%s/%d", cell.ID, i+1),
+			Lat:    p.Lat(),
+			Lng:    p.Lng(),
+			Radius: cell.Radius / 2,
+		})
+	}
+	return children
+}
+
+// cellIntersects returns whether any part of the cell could be within the
+// region
+func cellIntersects(region *hanapi.Region, cell Cell) bool {
+	cellCentre := geo.NewPoint(cell.Lat, cell.Lng)
+	if len(region.Polygon) == 0 {
+		distance := cellCentre.GreatCircleDistance(geo.NewPoint(region.Lat, region.Lng)) * 1000
+		return distance-cell.Radius <= region.GetRadius()
+	}
+	if region.Contains(cell.Lat, cell.Lng) {
+		return true
+	}
+	// check the hexagon's corners
+	for degrees := float64(0); degrees < 360; degrees += 60 {
+		p := cellCentre.PointAtDistanceAndBearing(cell.Radius/1000, degrees)
+		if region.Contains(p.Lat(), p.Lng()) {
+			return true
+		}
+	}
+	// the polygon may be small enough to fit within the cell
+	for _, vertex := range region.Polygon {
+		distance := cellCentre.GreatCircleDistance(geo.NewPoint(vertex.Lat, vertex.Lng)) * 1000
+		if distance <= cell.Radius {
+			return true
+		}
+	}
+	return false
+}
+
+// cellResponse is the result of querying a single cell
+type cellResponse struct {
+	images []hanapi.ImageData
+	// the amount of results the source returned before any were filtered out
+	results int
+	// the latest content that was returned, empty if nothing new was found
+	cursor string
+	// the cursor used instead when the results reach the planner's cap, since
+	// the source may not have returned content between the previous cursor
+	// and the oldest content it did return. This is usually the oldest
+	// content returned and the cursor isn't advanced if it's empty
+	cappedCursor string
+}
+
+// queryCells queries each planned cell of the region, passing in the cell's
+// stored cursor and recording the response. Cursors should be committed by the
+// caller once the images have been stored, see `PendingCursors`. An error is only returned if the
+// first query fails, since this likely means that the source is unavailable,
+// or if the source rejects the collector's credentials. Images found before
+// the context is cancelled are returned along with the context's error
+// @param cursors - optional storage of each cell's cursor
+func queryCells(ctx context.Context, planner *CoveragePlanner, cursors CursorStore,
+	collectorName string, region *hanapi.Region,
+	query func(cell Cell, cursor string) (*cellResponse, error)) ([]hanapi.ImageData, error) {
+	images := []hanapi.ImageData{}
+	regionKey := RegionKey(region)
+	for i, cell := range planner.Plan(region) {
+		if ctx.Err() != nil {
+			return images, ctx.Err()
+		}
+		cursor := ""
+		if cursors != nil {
+			cursor = cursors.GetCursor(collectorName, regionKey, cell.ID)
+		}
+		response, err := query(cell, cursor)
+		if err == errQueryLimitReached || err == errCircuitOpen {
+			break
+		}
+		if err != nil {
+			// the remaining cells would be rejected the same way
+			if i == 0 || ClassifyError(err) == ErrorCredentials {
+				return images, err
+			}
+			continue
+		}
+		planner.Record(region, cell, response.results)
+		next := response.cursor
+		if planner.capped(response.results) {
+			next = response.cappedCursor
+		}
+		if cursors != nil && len(next) > 0 && next != cursor {
+			cursors.SetCursor(collectorName, regionKey, cell.ID, next)
+		}
+		images = append(images, response.images...)
+	}
+	return images, nil
+}
+
+// querySources is used by collectors that can't search by location, instead
+// reading every source (such as a feed) and keeping what's within the region.
+// Each source's cursor is stored in place of a cell. An error is only returned
+// if the first source fails or the context is cancelled
+func querySources(ctx context.Context, cursors CursorStore, collectorName string,
+	region *hanapi.Region, sources []string,
+	query func(source string, cursor string) ([]hanapi.ImageData, string, error)) ([]hanapi.ImageData, error) {
+	images := []hanapi.ImageData{}
+	regionKey := RegionKey(region)
+	for i, source := range sources {
+		if ctx.Err() != nil {
+			return images, ctx.Err()
+		}
+		cursor := ""
+		if cursors != nil {
+			cursor = cursors.GetCursor(collectorName, regionKey, source)
+		}
+		sourceImages, newCursor, err := query(source, cursor)
+		if err == errQueryLimitReached || err == errCircuitOpen {
+			break
+		}
+		if err != nil {
+			if i == 0 {
+				return images, err
+			}
+			continue
+		}
+		if cursors != nil && len(newCursor) > 0 && newCursor != cursor {
+			cursors.SetCursor(collectorName, regionKey, source, newCursor)
+		}
+		images = append(images, sourceImages...)
+	}
+	return images, nil
+}
@@ -0,0 +1,90 @@
+package collectors
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// errQueryLimitReached is returned when a query isn't made because the
+// collector has reached its API limit
+var errQueryLimitReached = errors.New("query limit reached")
+
+// errCircuitOpen is returned when a query isn't made because the collector's
+// circuit breaker is open
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// ErrorKind describes why a query failed, so that it can be decided whether
+// it's worth retrying
+type ErrorKind int
+
+const (
+	// ErrorTransient is used for failures such as timeouts and server errors
+	// which are likely to succeed if retried
+	ErrorTransient ErrorKind = iota
+	// ErrorRateLimited is used when the provider or quota is limiting queries
+	ErrorRateLimited
+	// ErrorCredentials is used when the provider rejects the collector's
+	// keys, the collector won't work until its configuration is fixed
+	ErrorCredentials
+	// ErrorPermanent is used for failures such as bad requests that won't
+	// succeed if retried
+	ErrorPermanent
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorTransient:
+		return "transient"
+	case ErrorRateLimited:
+		return "rate limited"
+	case ErrorCredentials:
+		return "credentials"
+	}
+	return "permanent"
+}
+
+// CollectorError is a failed query along with why it failed
+type CollectorError struct {
+	Kind ErrorKind
+	// StatusCode is the HTTP status returned, this is 0 if there wasn't a
+	// response
+	StatusCode int
+	Err        error
+}
+
+func (e *CollectorError) Error() string {
+	return e.Err.Error()
+}
+
+// statusError classifies an unsuccessful response using its status code
+func statusError(res *http.Response, err error) error {
+	kind := ErrorPermanent
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		kind = ErrorRateLimited
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		kind = ErrorCredentials
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode >= 500:
+		kind = ErrorTransient
+	}
+	return &CollectorError{Kind: kind, StatusCode: res.StatusCode, Err: err}
+}
+
+// ClassifyError returns the kind of failure. Network failures are transient
+// and errors that haven't been classified are considered permanent
+func ClassifyError(err error) ErrorKind {
+	var collectorErr *CollectorError
+	if errors.As(err, &collectorErr) {
+		return collectorErr.Kind
+	}
+	if err == errQueryLimitReached {
+		return ErrorRateLimited
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorTransient
+	}
+	return ErrorPermanent
+}
@@ -0,0 +1,401 @@
+package collectors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errNoEXIF is returned when a file doesn't contain any EXIF data
+var errNoEXIF = errors.New("no EXIF data")
+
+// EXIF tags that are used
+const (
+	exifIFDPointer      = 0x8769
+	gpsIFDPointer       = 0x8825
+	thumbnailOffsetTag  = 0x0201
+	thumbnailLengthTag  = 0x0202
+	dateTimeOriginalTag = 0x9003
+	offsetTimeOrigTag   = 0x9011
+	gpsLatitudeRefTag   = 0x0001
+	gpsLatitudeTag      = 0x0002
+	gpsLongitudeRefTag  = 0x0003
+	gpsLongitudeTag     = 0x0004
+)
+
+// exifTypeSizes are the sizes in bytes of each TIFF field type
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8,
+}
+
+// exifData is the subset of EXIF that's needed to place a photo
+type exifData struct {
+	hasLocation bool
+	lat         float64
+	lng         float64
+	// zero if the capture time isn't specified
+	taken time.Time
+	// the embedded JPEG thumbnail, this is nil if there isn't one
+	thumbnail []byte
+}
+
+type exifEntry struct {
+	fieldType uint16
+	count     uint32
+	// the raw value, or the offset of the value if it doesn't fit
+	value []byte
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// readEXIF reads EXIF from a JPEG or HEIC file's contents
+func readEXIF(data []byte) (*exifData, error) {
+	var tiff []byte
+	var err error
+	if len(data) > 2 && data[0] == 0xFF && data[1] == 0xD8 {
+		tiff, err = jpegEXIF(data)
+	} else if len(data) > 12 && string(data[4:8]) == "ftyp" {
+		tiff, err = heicEXIF(data)
+	} else {
+		return nil, errors.New("unsupported file format")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseTIFF(tiff)
+}
+
+// jpegEXIF returns the TIFF structure within the JPEG's APP1 segment
+func jpegEXIF(data []byte) ([]byte, error) {
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker := data[offset+1]
+		// the image data follows start of scan, so there's no metadata after
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		end := offset + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		segment := data[offset+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		offset = end
+	}
+	return nil, errNoEXIF
+}
+
+// heicEXIF returns the TIFF structure stored in the HEIF `Exif` item
+func heicEXIF(data []byte) ([]byte, error) {
+	meta := findBox(data, "meta")
+	// meta is a full box so skip its version and flags
+	if len(meta) < 4 {
+		return nil, errNoEXIF
+	}
+	meta = meta[4:]
+	itemID, ok := findEXIFItem(findBox(meta, "iinf"))
+	if !ok {
+		return nil, errNoEXIF
+	}
+	offset, length, ok := findItemLocation(findBox(meta, "iloc"), itemID)
+	// offsets and lengths can be 8 bytes, so these are compared without
+	// adding them together in case that overflows
+	if !ok || offset > uint64(len(data)) || length > uint64(len(data))-offset || length < 4 {
+		return nil, errors.New("invalid HEIC Exif location")
+	}
+	item := data[offset : offset+length]
+	// the item begins with the offset of the TIFF header
+	headerOffset := uint64(binary.BigEndian.Uint32(item)) + 4
+	if headerOffset >= uint64(len(item)) {
+		return nil, errors.New("invalid HEIC Exif item")
+	}
+	return item[headerOffset:], nil
+}
+
+// findBox returns the contents of the first ISOBMFF box of the type
+func findBox(data []byte, boxType string) []byte {
+	offset := uint64(0)
+	for offset+8 <= uint64(len(data)) {
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		header := uint64(8)
+		if size == 1 && offset+16 <= uint64(len(data)) {
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			header = 16
+		} else if size == 0 {
+			size = uint64(len(data)) - offset
+		}
+		if size < header || size > uint64(len(data))-offset {
+			return nil
+		}
+		if string(data[offset+4:offset+8]) == boxType {
+			return data[offset+header : offset+size]
+		}
+		offset += size
+	}
+	return nil
+}
+
+// findEXIFItem returns the ID of the `Exif` item listed in an iinf box
+func findEXIFItem(iinf []byte) (uint32, bool) {
+	// skip version, flags and entry count, which is 4 bytes after version 0
+	header := 6
+	if len(iinf) > 0 && iinf[0] > 0 {
+		header = 8
+	}
+	if len(iinf) < header {
+		return 0, false
+	}
+	entries := iinf[header:]
+	for len(entries) >= 8 {
+		size := binary.BigEndian.Uint32(entries)
+		if size < 8 || int(size) > len(entries) {
+			return 0, false
+		}
+		infe := entries[8:size]
+		entries = entries[size:]
+		if len(infe) < 12 {
+			continue
+		}
+		version := infe[0]
+		if version == 2 && string(infe[8:12]) == "Exif" {
+			return uint32(binary.BigEndian.Uint16(infe[4:])), true
+		}
+		if version == 3 && len(infe) >= 14 && string(infe[10:14]) == "Exif" {
+			return binary.BigEndian.Uint32(infe[4:]), true
+		}
+	}
+	return 0, false
+}
+
+// findItemLocation returns the file offset and length of the item's first
+// extent from an iloc box
+func findItemLocation(iloc []byte, itemID uint32) (uint64, uint64, bool) {
+	if len(iloc) < 8 {
+		return 0, 0, false
+	}
+	version := iloc[0]
+	offsetSize := int(iloc[4] >> 4)
+	lengthSize := int(iloc[4] & 0x0F)
+	baseOffsetSize := int(iloc[5] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(iloc[5] & 0x0F)
+	}
+	r := &boxReader{data: iloc, offset: 6}
+	itemCount := r.read(2)
+	if version == 2 {
+		itemCount = r.read(4)
+	}
+	for i := uint64(0); i < itemCount && r.err == nil; i++ {
+		id := r.read(2)
+		if version == 2 {
+			id = r.read(4)
+		}
+		if version == 1 || version == 2 {
+			// construction method, only file offsets are supported
+			if r.read(2)&0x0F != 0 && uint32(id) == itemID {
+				return 0, 0, false
+			}
+		}
+		// data reference index
+		r.read(2)
+		baseOffset := r.read(baseOffsetSize)
+		extentCount := r.read(2)
+		for e := uint64(0); e < extentCount; e++ {
+			r.read(indexSize)
+			extentOffset := r.read(offsetSize)
+			extentLength := r.read(lengthSize)
+			if uint32(id) == itemID && e == 0 && r.err == nil {
+				return baseOffset + extentOffset, extentLength, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// boxReader reads big endian integers of varying sizes, recording the first
+// error so that it only needs to be checked once
+type boxReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *boxReader) read(size int) uint64 {
+	if r.err != nil || size == 0 {
+		return 0
+	}
+	if r.offset+size > len(r.data) {
+		r.err = errors.New("unexpected end of box")
+		return 0
+	}
+	value := uint64(0)
+	for _, b := range r.data[r.offset : r.offset+size] {
+		value = value<<8 | uint64(b)
+	}
+	r.offset += size
+	return value
+}
+
+// parseTIFF reads the location, capture time and thumbnail from the TIFF
+// structure that EXIF is stored in
+func parseTIFF(data []byte) (*exifData, error) {
+	if len(data) < 8 {
+		return nil, errNoEXIF
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid TIFF byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, errors.New("invalid TIFF header")
+	}
+	ifd0, next, err := t.readIFD(t.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+	exif := &exifData{}
+	if pointer, ok := ifd0[exifIFDPointer]; ok {
+		entries, _, err := t.readIFD(t.uint32Value(pointer))
+		if err == nil {
+			exif.taken = t.captureTime(entries)
+		}
+	}
+	if pointer, ok := ifd0[gpsIFDPointer]; ok {
+		entries, _, err := t.readIFD(t.uint32Value(pointer))
+		if err == nil {
+			exif.lat, exif.lng, exif.hasLocation = t.gpsLocation(entries)
+		}
+	}
+	// IFD1 describes the embedded thumbnail
+	if next > 0 {
+		ifd1, _, err := t.readIFD(next)
+		offset, hasOffset := ifd1[thumbnailOffsetTag]
+		length, hasLength := ifd1[thumbnailLengthTag]
+		if err == nil && hasOffset && hasLength {
+			start := t.uint32Value(offset)
+			end := start + t.uint32Value(length)
+			if end > start && end <= uint32(len(data)) {
+				exif.thumbnail = data[start:end]
+			}
+		}
+	}
+	return exif, nil
+}
+
+// readIFD returns the IFD's entries keyed by tag and the offset of the next IFD
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]exifEntry, uint32, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, 0, errors.New("invalid IFD offset")
+	}
+	count := uint32(t.order.Uint16(t.data[offset:]))
+	end := uint64(offset) + 2 + uint64(count)*12
+	if end+4 > uint64(len(t.data)) {
+		return nil, 0, errors.New("invalid IFD")
+	}
+	entries := map[uint16]exifEntry{}
+	for i := uint32(0); i < count; i++ {
+		entry := t.data[offset+2+i*12:]
+		fieldType := t.order.Uint16(entry[2:])
+		valueCount := t.order.Uint32(entry[4:])
+		size := uint64(exifTypeSizes[fieldType]) * uint64(valueCount)
+		value := entry[8:12]
+		if size > 4 {
+			valueOffset := uint64(t.order.Uint32(entry[8:]))
+			if valueOffset+size > uint64(len(t.data)) {
+				continue
+			}
+			value = t.data[valueOffset : valueOffset+size]
+		}
+		entries[t.order.Uint16(entry)] = exifEntry{
+			fieldType: fieldType,
+			count:     valueCount,
+			value:     value,
+		}
+	}
+	return entries, t.order.Uint32(t.data[end:]), nil
+}
+
+func (t *tiffReader) uint32Value(entry exifEntry) uint32 {
+	if entry.fieldType == 3 {
+		return uint32(t.order.Uint16(entry.value))
+	}
+	return t.order.Uint32(entry.value)
+}
+
+func (t *tiffReader) stringValue(entry exifEntry) string {
+	if entry.fieldType != 2 {
+		return ""
+	}
+	return strings.TrimRight(string(entry.value), "\x00 ")
+}
+
+// captureTime reads DateTimeOriginal, which is in the camera's local time.
+// UTC is assumed unless the camera also recorded its offset
+func (t *tiffReader) captureTime(entries map[uint16]exifEntry) time.Time {
+	value := t.stringValue(entries[dateTimeOriginalTag])
+	if offset := t.stringValue(entries[offsetTimeOrigTag]); len(offset) > 0 {
+		taken, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset)
+		if err == nil {
+			return taken
+		}
+	}
+	taken, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return time.Time{}
+	}
+	return taken
+}
+
+// gpsLocation converts the GPS IFD's degrees, minutes and seconds into a
+// decimal lat and lng
+func (t *tiffReader) gpsLocation(entries map[uint16]exifEntry) (float64, float64, bool) {
+	lat, latErr := t.degrees(entries[gpsLatitudeTag])
+	lng, lngErr := t.degrees(entries[gpsLongitudeTag])
+	if latErr != nil || lngErr != nil {
+		return 0, 0, false
+	}
+	if t.stringValue(entries[gpsLatitudeRefTag]) == "S" {
+		lat = -lat
+	}
+	if t.stringValue(entries[gpsLongitudeRefTag]) == "W" {
+		lng = -lng
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
+
+func (t *tiffReader) degrees(entry exifEntry) (float64, error) {
+	if entry.fieldType != 5 || entry.count != 3 {
+		return 0, fmt.Errorf("invalid GPS coordinate type %d", entry.fieldType)
+	}
+	values := [3]float64{}
+	for i := range values {
+		numerator := t.order.Uint32(entry.value[i*8:])
+		denominator := t.order.Uint32(entry.value[i*8+4:])
+		if denominator == 0 {
+			return 0, errors.New("invalid GPS coordinate")
+		}
+		values[i] = float64(numerator) / float64(denominator)
+	}
+	return values[0] + values[1]/60 + values[2]/3600, nil
+}
@@ -0,0 +1,340 @@
+package collectors
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// feedCacheDuration is how long a fetched feed is reused for, since each feed
+// is read for every region
+const feedCacheDuration = 5 * time.Minute
+
+// feedTimeFormats are the date formats used by RSS, Atom and Dublin Core
+var feedTimeFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+}
+
+// FeedCollector implements the collector interface for RSS and Atom feeds
+// that specify locations using GeoRSS or W3C geo tags and include images
+// using Media RSS or enclosures
+type FeedCollector struct {
+	*APIRestrictedCollector
+	config *config.FeedConfiguration
+	cache  map[string]*cachedFeed
+	mutex  sync.Mutex
+}
+
+type cachedFeed struct {
+	entries   []feedEntry
+	fetchedAt time.Time
+}
+
+func init() {
+	Register("feed", func() config.CollectorConfiguration {
+		return config.NewFeedConfig()
+	}, func(c config.CollectorConfiguration) ImageCollector {
+		return NewFeedCollector(c.(*config.FeedConfiguration))
+	})
+}
+
+// NewFeedCollector creates a new `FeedCollector`
+func NewFeedCollector(config *config.FeedConfiguration) *FeedCollector {
+	c := &FeedCollector{
+		APIRestrictedCollector: NewAPIRestrictedCollector(),
+		config:                 config,
+		cache:                  map[string]*cachedFeed{},
+	}
+	return c
+}
+
+// GetConfig returns the configuration for the feed source
+// Use this to store api keys and enable/disable collectors
+func (c *FeedCollector) GetConfig() config.CollectorConfiguration {
+	return c.config
+}
+
+// GetImages returns new images from each feed that are located within the
+// region
+func (c *FeedCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	if !c.GetConfig().IsEnabled() {
+		return []hanapi.ImageData{}, nil
+	}
+	return c.getImagesWithClient(ctx, newHTTPClient(c.config), region, cursors)
+}
+
+func (c *FeedCollector) getImagesWithClient(ctx context.Context, client *http.Client, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	return querySources(ctx, cursors, c.config.CollectorName, region, c.config.Feeds,
+		func(feed string, cursor string) ([]hanapi.ImageData, string, error) {
+			return c.queryFeed(ctx, client, feed, region, cursor)
+		})
+}
+
+type feedLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type feedMedia struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
+}
+
+type feedMediaGroup struct {
+	Content   []feedMedia `xml:"http://search.yahoo.com/mrss/ content"`
+	Thumbnail []feedMedia `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+type feedGeoPoint struct {
+	Lat  string `xml:"http://www.w3.org/2003/01/geo/wgs84_pos# lat"`
+	Long string `xml:"http://www.w3.org/2003/01/geo/wgs84_pos# long"`
+}
+
+// feedEntry is either an RSS item or an Atom entry
+type feedEntry struct {
+	Title       string     `xml:"title"`
+	Links       []feedLink `xml:"link"`
+	GUID        string     `xml:"guid"`
+	ID          string     `xml:"id"`
+	PubDate     string     `xml:"pubDate"`
+	Published   string     `xml:"published"`
+	Updated     string     `xml:"updated"`
+	Date        string     `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Description string     `xml:"description"`
+	Summary     string     `xml:"summary"`
+	Author      struct {
+		Name string `xml:"name"`
+		Text string `xml:",chardata"`
+	} `xml:"author"`
+	Creator string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	// GeoRSS simple, eg. <georss:point>45.256 -71.92</georss:point>
+	Point string `xml:"http://www.georss.org/georss point"`
+	// W3C geo, either directly within the entry or within a geo:Point
+	Lat        string         `xml:"http://www.w3.org/2003/01/geo/wgs84_pos# lat"`
+	Long       string         `xml:"http://www.w3.org/2003/01/geo/wgs84_pos# long"`
+	GeoPoint   *feedGeoPoint  `xml:"http://www.w3.org/2003/01/geo/wgs84_pos# Point"`
+	Content    []feedMedia    `xml:"http://search.yahoo.com/mrss/ content"`
+	Thumbnail  []feedMedia    `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	Group      feedMediaGroup `xml:"http://search.yahoo.com/mrss/ group"`
+	Enclosures []feedMedia    `xml:"enclosure"`
+}
+
+// feedDocument handles RSS 2.0, RSS 1.0 and Atom, only the entries are used
+type feedDocument struct {
+	Channel struct {
+		Items []feedEntry `xml:"item"`
+	} `xml:"channel"`
+	// RSS 1.0 items are outside of the channel
+	Items   []feedEntry `xml:"item"`
+	Entries []feedEntry `xml:"entry"`
+}
+
+// queryFeed returns entries within the region that were published after the
+// cursor, and the newest publish time in the feed
+// @param lastPublished - the unix time of the newest entry previously seen,
+// this is optional and should be empty if the feed hasn't been read before
+func (c *FeedCollector) queryFeed(ctx context.Context, client *http.Client, feed string,
+	region *hanapi.Region, lastPublished string) ([]hanapi.ImageData, string, error) {
+	entries, err := c.getEntries(ctx, client, feed)
+	if err != nil {
+		return nil, "", err
+	}
+	// an invalid cursor is ignored so that the feed is read from scratch
+	latest, _ := strconv.ParseInt(lastPublished, 10, 64)
+	newest := latest
+	images := []hanapi.ImageData{}
+	for _, entry := range entries {
+		image := c.convertEntry(entry)
+		if image == nil || image.CreatedTime <= latest {
+			continue
+		}
+		if image.CreatedTime > newest {
+			newest = image.CreatedTime
+		}
+		if region.Contains(image.Location.Lat, image.Location.Lng) {
+			images = append(images, *image)
+		}
+	}
+	cursor := ""
+	if newest > latest {
+		cursor = strconv.FormatInt(newest, 10)
+	}
+	return images, cursor, nil
+}
+
+// getEntries returns the feed's entries, using a recently fetched copy if
+// there is one
+func (c *FeedCollector) getEntries(ctx context.Context, client *http.Client, feed string) ([]feedEntry, error) {
+	c.mutex.Lock()
+	cached, ok := c.cache[feed]
+	c.mutex.Unlock()
+	if ok && time.Since(cached.fetchedAt) < feedCacheDuration {
+		return cached.entries, nil
+	}
+	// each feed is usually on its own host, so has its own quota
+	var entries []feedEntry
+	err := c.query(ctx, c.GetConfig(), feed, func() error {
+		var err error
+		entries, err = c.fetchFeed(ctx, client, feed)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.cache[feed] = &cachedFeed{entries: entries, fetchedAt: time.Now()}
+	c.mutex.Unlock()
+	return entries, nil
+}
+
+func (c *FeedCollector) fetchFeed(ctx context.Context, client *http.Client, feed string) ([]feedEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", feed, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	c.updateQuota(c.GetConfig(), feed, res)
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res, fmt.Errorf("Feed %s failed with status %d", feed, res.StatusCode))
+	}
+	document := feedDocument{}
+	decoder := xml.NewDecoder(res.Body)
+	// feeds are often not UTF-8 but are close enough for captions
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	entries := []feedEntry{}
+	entries = append(entries, document.Channel.Items...)
+	entries = append(entries, document.Items...)
+	return append(entries, document.Entries...), nil
+}
+
+// convertEntry returns nil if the entry has no image, location or publish time
+func (c *FeedCollector) convertEntry(entry feedEntry) *hanapi.ImageData {
+	lat, lng, ok := entry.location()
+	if !ok {
+		return nil
+	}
+	imageURL, thumbnailURL := entry.images()
+	if len(imageURL) == 0 {
+		return nil
+	}
+	published, ok := entry.published()
+	if !ok {
+		return nil
+	}
+	link := entry.link()
+	id := firstNonEmpty(entry.GUID, entry.ID, link, imageURL)
+	caption := firstNonEmpty(plainText(entry.Title),
+		plainText(entry.Description), plainText(entry.Summary))
+	author := firstNonEmpty(strings.TrimSpace(entry.Author.Name),
+		strings.TrimSpace(entry.Creator), strings.TrimSpace(entry.Author.Text))
+	return hanapi.NewImage(caption, published, imageURL, thumbnailURL, id,
+		lat, lng, link, author, "", c.config.CollectorName)
+}
+
+// location reads either a georss:point or W3C geo:lat and geo:long
+func (e *feedEntry) location() (float64, float64, bool) {
+	lat, lng := "", ""
+	if fields := strings.Fields(e.Point); len(fields) == 2 {
+		lat, lng = fields[0], fields[1]
+	} else if len(e.Lat) > 0 {
+		lat, lng = e.Lat, e.Long
+	} else if e.GeoPoint != nil {
+		lat, lng = e.GeoPoint.Lat, e.GeoPoint.Long
+	}
+	latValue, latErr := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	lngValue, lngErr := strconv.ParseFloat(strings.TrimSpace(lng), 64)
+	if latErr != nil || lngErr != nil || latValue < -90 || latValue > 90 ||
+		lngValue < -180 || lngValue > 180 {
+		return 0, 0, false
+	}
+	return latValue, lngValue, true
+}
+
+// images returns the entry's image and thumbnail, the image is used as the
+// thumbnail if there isn't one
+func (e *feedEntry) images() (string, string) {
+	media := []feedMedia{}
+	media = append(media, e.Content...)
+	media = append(media, e.Group.Content...)
+	media = append(media, e.Enclosures...)
+	// Atom uses links for enclosures
+	for _, l := range e.Links {
+		if l.Rel == "enclosure" {
+			media = append(media, feedMedia{URL: l.Href, Type: l.Type})
+		}
+	}
+	imageURL := ""
+	for _, m := range media {
+		if m.Medium == "image" || strings.HasPrefix(m.Type, "image/") {
+			imageURL = m.URL
+			break
+		}
+	}
+	thumbnailURL := imageURL
+	thumbnails := append([]feedMedia{}, e.Thumbnail...)
+	thumbnails = append(thumbnails, e.Group.Thumbnail...)
+	if len(thumbnails) > 0 && len(thumbnails[0].URL) > 0 {
+		thumbnailURL = thumbnails[0].URL
+	}
+	return imageURL, thumbnailURL
+}
+
+// published returns the entry's publish time as a unix time
+func (e *feedEntry) published() (int64, bool) {
+	value := strings.TrimSpace(firstNonEmpty(e.PubDate, e.Published, e.Date, e.Updated))
+	for _, format := range feedTimeFormats {
+		t, err := time.Parse(format, value)
+		if err == nil {
+			return t.Unix(), true
+		}
+	}
+	return 0, false
+}
+
+// link returns the entry's web page, which is the link's text in RSS and its
+// href in Atom
+func (e *feedEntry) link() string {
+	for _, l := range e.Links {
+		if len(l.Href) > 0 && (len(l.Rel) == 0 || l.Rel == "alternate") {
+			return l.Href
+		}
+		if text := strings.TrimSpace(l.Text); len(text) > 0 {
+			return text
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
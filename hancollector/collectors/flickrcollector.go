@@ -1,18 +1,53 @@
 package collectors
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/oliveroneill/flickgo"
+	"github.com/kellydunn/golang-geo"
 	"github.com/oliveroneill/hanserver/hanapi"
 	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
+// flickrAPIURL is Flickr's REST endpoint
+const flickrAPIURL = "https://api.flickr.com/services/rest/"
+
+// flickrSearchEndpoint is the method that quotas are tracked against
+const flickrSearchEndpoint = "flickr.photos.search"
+
+// flickrLicenses are the licenses that allow us to show photos, this is every
+// license except 0 = All Rights Reserved
+const flickrLicenses = "1,2,3,4,5,6,7,8,9,10"
+
+// flickrExtras are returned with each search result so that no further
+// requests are needed per photo
+const flickrExtras = "license,owner_name,date_upload,geo,url_b,url_t"
+
+// flickrPerPage is the most results Flickr returns per page for geo queries
+const flickrPerPage = 250
+
+// flickrMaxPages is the most pages that will be requested per cell, cells
+// with more results than this are subdivided
+const flickrMaxPages = 4
+
 // FlickrCollector implements the collector interface for Flickr
 type FlickrCollector struct {
 	*APIRestrictedCollector
-	config *config.FlickrConfiguration
+	config  *config.FlickrConfiguration
+	planner *CoveragePlanner
+	apiURL  string
+}
+
+func init() {
+	Register("flickr", func() config.CollectorConfiguration {
+		return config.NewFlickrConfig()
+	}, func(c config.CollectorConfiguration) ImageCollector {
+		return NewFlickrCollector(c.(*config.FlickrConfiguration))
+	})
 }
 
 // NewFlickrCollector creates a new `FlickrCollector`
@@ -20,6 +55,8 @@ func NewFlickrCollector(config *config.FlickrConfiguration) *FlickrCollector {
 	c := &FlickrCollector{
 		APIRestrictedCollector: NewAPIRestrictedCollector(),
 		config:                 config,
+		planner:                NewCoveragePlanner(QueryRange, flickrPerPage*flickrMaxPages),
+		apiURL:                 flickrAPIURL,
 	}
 	return c
 }
@@ -31,115 +68,216 @@ func (c *FlickrCollector) GetConfig() config.CollectorConfiguration {
 }
 
 // GetImages returns new images queried by location on Flickr
-func (c *FlickrCollector) GetImages(lat float64, lng float64) ([]hanapi.ImageData, error) {
+func (c *FlickrCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
 	if !c.GetConfig().IsEnabled() {
 		return []hanapi.ImageData{}, nil
 	}
-	client := flickgo.New(c.config.APIKey, c.config.Secret, http.DefaultClient)
-	return c.getImagesWithClient(client, lat, lng)
+	return c.getImagesWithClient(ctx, newHTTPClient(c.config), region, cursors)
 }
 
-func (c *FlickrCollector) getImagesWithClient(client *flickgo.Client, lat float64, lng float64) ([]hanapi.ImageData, error) {
-	images, err := c.queryImages(client, lat, lng)
-	if err != nil {
-		return images, err
-	}
-	points := GetSurroundingPoints(lat, lng, QueryRange)
-	// continue search until we have at least 100 images
-	for i := 0; i < len(points) && len(images) < 100; i++ {
-		queryResponse, err := c.queryImages(client, points[i].Lat, points[i].Lng)
-		if err != nil {
-			continue
-		}
-		images = append(images, queryResponse...)
-	}
-	return images, nil
+func (c *FlickrCollector) getImagesWithClient(ctx context.Context, client *http.Client, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	return queryCells(ctx, c.planner, cursors, c.config.CollectorName, region,
+		func(cell Cell, cursor string) (*cellResponse, error) {
+			return c.queryImages(ctx, client, cell, cursor)
+		})
 }
 
-func (c *FlickrCollector) queryImages(client *flickgo.Client, lat float64, lng float64) ([]hanapi.ImageData, error) {
-	// check that we haven't reached query limits
-	if !c.ableToQuery(c.GetConfig()) {
-		return []hanapi.ImageData{}, nil
-	}
-	request := flickgo.PhotosSearchParams{
-		Lat:     fmt.Sprintf("%f", lat),
-		Lon:     fmt.Sprintf("%f", lng),
-		PerPage: 500,
-	}
-	response, err := client.PhotosSearch(request)
-	if err != nil {
-		c.APIRestrictedCollector.receivedError = true
-		// we failed so just return the error
-		return []hanapi.ImageData{}, err
-	}
+// flickrValue is used since Flickr returns some numbers as strings
+type flickrValue string
 
-	images := []hanapi.ImageData{}
-	for _, m := range response.Photos {
-		// check that we haven't reached query limits
-		if !c.ableToQuery(c.GetConfig()) {
-			break
-		}
-		secret, err := strconv.Atoi(m.Secret)
-		// we then have to request for user info and licensing info
-		// TODO: this extra request slows everything down
-		res, err := client.PhotosGetInfo(flickgo.PhotosGetInfoParams{
-			PhotoID: m.ID,
-			Secret:  secret,
+func (v *flickrValue) UnmarshalJSON(b []byte) error {
+	*v = flickrValue(strings.Trim(string(b), `"`))
+	return nil
+}
+
+type flickrPhoto struct {
+	ID         string      `json:"id"`
+	Owner      string      `json:"owner"`
+	Secret     string      `json:"secret"`
+	Server     string      `json:"server"`
+	Farm       flickrValue `json:"farm"`
+	Title      string      `json:"title"`
+	License    flickrValue `json:"license"`
+	DateUpload flickrValue `json:"dateupload"`
+	OwnerName  string      `json:"ownername"`
+	Latitude   flickrValue `json:"latitude"`
+	Longitude  flickrValue `json:"longitude"`
+	URLLarge   string      `json:"url_b"`
+	URLThumb   string      `json:"url_t"`
+}
+
+type flickrSearchResponse struct {
+	Stat    string `json:"stat"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Photos  struct {
+		Page  int           `json:"page"`
+		Pages int           `json:"pages"`
+		Total flickrValue   `json:"total"`
+		Photo []flickrPhoto `json:"photo"`
+	} `json:"photos"`
+}
+
+// queryImages searches for photos within the cell, requesting each page of
+// results
+// @param minUploadDate - only photos uploaded at or after this unix time are
+// returned, this is optional and should be empty if the cell hasn't been
+// queried before
+func (c *FlickrCollector) queryImages(ctx context.Context, client *http.Client, cell Cell, minUploadDate string) (*cellResponse, error) {
+	result := &cellResponse{images: []hanapi.ImageData{}}
+	// an invalid cursor is ignored so that the cell is queried from scratch
+	latest, _ := strconv.ParseInt(minUploadDate, 10, 64)
+	newest := latest
+	oldest := int64(0)
+	for page := 1; page <= flickrMaxPages; page++ {
+		var response *flickrSearchResponse
+		err := c.query(ctx, c.GetConfig(), flickrSearchEndpoint, func() error {
+			var err error
+			response, err = c.search(ctx, client, cell, latest, page)
+			return err
 		})
 		if err != nil {
-			continue
-		}
-		photoInfo := res.PhotoInfo
-		license, err := strconv.ParseFloat(photoInfo.License, 64)
-		if err != nil {
-			fmt.Println(err)
-			continue
+			if page == 1 {
+				// we failed so just return the error
+				return nil, err
+			}
+			// keep the pages we have, since they're sorted oldest first when
+			// there's a cursor the remaining photos will be requested next time
+			break
 		}
-		// ensure the license allows us to show it
-		// 0 = All Rights Reserved
-		if license == 0 {
-			continue
+		total, _ := strconv.Atoi(string(response.Photos.Total))
+		result.results = total
+		for _, m := range response.Photos.Photo {
+			image := c.convertPhoto(m)
+			if image == nil {
+				continue
+			}
+			if image.CreatedTime > newest {
+				newest = image.CreatedTime
+			}
+			if oldest == 0 || image.CreatedTime < oldest {
+				oldest = image.CreatedTime
+			}
+			result.images = append(result.images, *image)
 		}
-		// check that we haven't reached query limits
-		if !c.ableToQuery(c.GetConfig()) {
+		if page >= response.Photos.Pages {
 			break
 		}
-		// we then have to request the exact location
-		// TODO: so many requests...
-		location, err := client.GetLocation(
-			map[string]string{
-				"api_key":  c.config.APIKey,
-				"photo_id": m.ID,
-			},
-		)
-		if err != nil {
-			fmt.Println(err)
-			continue
+	}
+	if newest > latest {
+		result.cursor = strconv.FormatInt(newest, 10)
+		result.cappedCursor = result.cursor
+		if latest == 0 {
+			// without a cursor the newest photos are returned first, so
+			// older photos may be missing
+			result.cappedCursor = strconv.FormatInt(oldest, 10)
 		}
+	}
+	return result, nil
+}
 
-		url := fmt.Sprintf("https://farm%s.staticflickr.com/%s/%s_%s",
-			m.Farm, m.Server, m.ID, m.Secret)
-		// add the extension, this will be formatted using Sprintf
-		url += "_%s.jpg"
-		userLink := fmt.Sprintf("https://www.flickr.com/photos/%s/%s", m.Owner, m.ID)
-		// convert location to floats
-		lat, err := strconv.ParseFloat(location.Location.Latitude, 64)
-		if err != nil {
-			continue
-		}
-		lng, err := strconv.ParseFloat(location.Location.Longitude, 64)
-		if err != nil {
-			continue
-		}
-		createdAt, err := strconv.ParseInt(photoInfo.DateUploaded, 0, 64)
-		if err != nil {
-			continue
+func (c *FlickrCollector) search(ctx context.Context, client *http.Client, cell Cell, minUploadDate int64, page int) (*flickrSearchResponse, error) {
+	params := url.Values{}
+	params.Set("method", "flickr.photos.search")
+	params.Set("api_key", c.config.APIKey)
+	params.Set("format", "json")
+	params.Set("nojsoncallback", "1")
+	params.Set("bbox", cellBoundingBox(cell))
+	params.Set("license", flickrLicenses)
+	params.Set("extras", flickrExtras)
+	params.Set("per_page", strconv.Itoa(flickrPerPage))
+	params.Set("page", strconv.Itoa(page))
+	if minUploadDate > 0 {
+		params.Set("min_upload_date", strconv.FormatInt(minUploadDate, 10))
+		// oldest first so that the cursor never skips photos
+		params.Set("sort", "date-posted-asc")
+	} else {
+		params.Set("sort", "date-posted-desc")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.apiURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	c.updateQuota(c.GetConfig(), flickrSearchEndpoint, res)
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res, fmt.Errorf("Flickr search failed with status %d", res.StatusCode))
+	}
+	response := new(flickrSearchResponse)
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		return nil, err
+	}
+	if response.Stat != "ok" {
+		return nil, &CollectorError{
+			Kind: flickrErrorKind(response.Code),
+			Err: fmt.Errorf("Flickr search failed with code %d: %s",
+				response.Code, response.Message),
 		}
-		newImage := hanapi.NewImage(m.Title, createdAt,
-			fmt.Sprintf(url, "b"), fmt.Sprintf(url, "t"), m.ID,
-			lat, lng, userLink, photoInfo.Owner.UserName, "",
-			c.config.CollectorName)
-		images = append(images, *newImage)
 	}
-	return images, nil
+	return response, nil
+}
+
+// flickrErrorKind classifies the error codes returned by the Flickr API
+func flickrErrorKind(code int) ErrorKind {
+	switch code {
+	// invalid API key, or the key has been disabled
+	case 100:
+		return ErrorCredentials
+	// search or the service is unavailable
+	case 10, 105:
+		return ErrorTransient
+	}
+	return ErrorPermanent
+}
+
+// convertPhoto returns nil if the photo is missing required information
+func (c *FlickrCollector) convertPhoto(m flickrPhoto) *hanapi.ImageData {
+	// ensure the license allows us to show it
+	// 0 = All Rights Reserved
+	if len(m.License) == 0 || m.License == "0" {
+		return nil
+	}
+	lat, err := strconv.ParseFloat(string(m.Latitude), 64)
+	if err != nil {
+		return nil
+	}
+	lng, err := strconv.ParseFloat(string(m.Longitude), 64)
+	if err != nil {
+		return nil
+	}
+	createdAt, err := strconv.ParseInt(string(m.DateUpload), 0, 64)
+	if err != nil {
+		return nil
+	}
+	// the size URLs are missing if the photo is too small
+	farmURL := fmt.Sprintf("https://farm%s.staticflickr.com/%s/%s_%s",
+		m.Farm, m.Server, m.ID, m.Secret)
+	// add the extension, this will be formatted using Sprintf
+	farmURL += "_%s.jpg"
+	imageURL := m.URLLarge
+	if len(imageURL) == 0 {
+		imageURL = fmt.Sprintf(farmURL, "b")
+	}
+	thumbnailURL := m.URLThumb
+	if len(thumbnailURL) == 0 {
+		thumbnailURL = fmt.Sprintf(farmURL, "t")
+	}
+	userLink := fmt.Sprintf("https://www.flickr.com/photos/%s/%s", m.Owner, m.ID)
+	return hanapi.NewImage(m.Title, createdAt, imageURL, thumbnailURL, m.ID,
+		lat, lng, userLink, m.OwnerName, "", c.config.CollectorName)
+}
+
+// cellBoundingBox returns the cell's bounds formatted for Flickr as
+// min lng, min lat, max lng, max lat
+func cellBoundingBox(cell Cell) string {
+	centre := geo.NewPoint(cell.Lat, cell.Lng)
+	north := centre.PointAtDistanceAndBearing(cell.Radius/1000, 0)
+	east := centre.PointAtDistanceAndBearing(cell.Radius/1000, 90)
+	south := centre.PointAtDistanceAndBearing(cell.Radius/1000, 180)
+	west := centre.PointAtDistanceAndBearing(cell.Radius/1000, 270)
+	return fmt.Sprintf("%f,%f,%f,%f", west.Lng(), south.Lat(), east.Lng(), north.Lat())
 }
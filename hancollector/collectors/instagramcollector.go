@@ -1,15 +1,32 @@
 package collectors
 
 import (
+	"context"
 	"github.com/gedex/go-instagram/instagram"
 	"github.com/oliveroneill/hanserver/hanapi"
 	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"strconv"
 )
 
+// instagramResultCap is the most media that a single search can return
+const instagramResultCap = 20
+
+// instagramSearchEndpoint is the endpoint that quotas are tracked against
+const instagramSearchEndpoint = "media/search"
+
 // InstagramCollector implements the collector interface for Instagram
 type InstagramCollector struct {
 	*APIRestrictedCollector
-	config *config.InstagramConfiguration
+	config  *config.InstagramConfiguration
+	planner *CoveragePlanner
+}
+
+func init() {
+	Register("instagram", func() config.CollectorConfiguration {
+		return config.NewInstagramConfig()
+	}, func(c config.CollectorConfiguration) ImageCollector {
+		return NewInstagramCollector(c.(*config.InstagramConfiguration))
+	})
 }
 
 // NewInstagramCollector creates a new `InstagramCollector`
@@ -17,6 +34,7 @@ func NewInstagramCollector(config *config.InstagramConfiguration) *InstagramColl
 	c := &InstagramCollector{
 		APIRestrictedCollector: NewAPIRestrictedCollector(),
 		config:                 config,
+		planner:                NewCoveragePlanner(QueryRange, instagramResultCap),
 	}
 	return c
 }
@@ -28,51 +46,64 @@ func (c *InstagramCollector) GetConfig() config.CollectorConfiguration {
 }
 
 // GetImages returns new images queried by location on Instagram
-func (c *InstagramCollector) GetImages(lat float64, lng float64) ([]hanapi.ImageData, error) {
+func (c *InstagramCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
 	if !c.GetConfig().IsEnabled() {
 		return []hanapi.ImageData{}, nil
 	}
-	client := instagram.NewClient(nil)
+	client := instagram.NewClient(newHTTPClient(c.config))
 	client.AccessToken = c.config.AccessToken
-	return c.getImagesWithClient(client, lat, lng)
+	return c.getImagesWithClient(ctx, client, region, cursors)
 }
 
-func (c *InstagramCollector) getImagesWithClient(client *instagram.Client, lat float64, lng float64) ([]hanapi.ImageData, error) {
-	images, err := c.queryImages(client, lat, lng)
-	if err != nil {
-		return images, err
-	}
-	points := GetSurroundingPoints(lat, lng, QueryRange)
-	// continue search until we have at least 100 images
-	for i := 0; i < len(points) && len(images) < 100; i++ {
-		queryResponse, err := c.queryImages(client, points[i].Lat, points[i].Lng)
-		if err != nil {
-			continue
-		}
-		images = append(images, queryResponse...)
-	}
-	return images, nil
+func (c *InstagramCollector) getImagesWithClient(ctx context.Context, client *instagram.Client, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	return queryCells(ctx, c.planner, cursors, c.config.CollectorName, region,
+		func(cell Cell, cursor string) (*cellResponse, error) {
+			return c.queryImages(ctx, client, cell, cursor)
+		})
 }
 
-func (c *InstagramCollector) queryImages(client *instagram.Client, lat float64, lng float64) ([]hanapi.ImageData, error) {
-	// check that we haven't reached query limits
-	if !c.ableToQuery(c.GetConfig()) {
-		return []hanapi.ImageData{}, nil
-	}
+// queryImages searches for media within the cell
+// @param minTimestamp - only media created after this unix time is returned,
+// this is optional and should be empty if the cell hasn't been queried before
+func (c *InstagramCollector) queryImages(ctx context.Context, client *instagram.Client, cell Cell, minTimestamp string) (*cellResponse, error) {
+	// an invalid cursor is ignored so that the cell is queried from scratch
+	latest, _ := strconv.ParseInt(minTimestamp, 10, 64)
 	opt := &instagram.Parameters{
-		Lat:      lat,
-		Lng:      lng,
-		Distance: QueryRange,
+		Lat:          cell.Lat,
+		Lng:          cell.Lng,
+		Distance:     cell.Radius,
+		MinTimestamp: latest,
 	}
-	media, _, err := client.Media.Search(opt)
+	var media []instagram.Media
+	err := c.query(ctx, c.GetConfig(), instagramSearchEndpoint, func() error {
+		var err error
+		media, _, err = client.Media.Search(opt)
+		if e, ok := err.(*instagram.ErrorResponse); ok && e.Response != nil {
+			return statusError(e.Response, err)
+		}
+		return err
+	})
 	if err != nil {
-		c.APIRestrictedCollector.receivedError = true
 		// we failed so just return the error
-		return []hanapi.ImageData{}, err
+		return nil, err
 	}
 
-	images := []hanapi.ImageData{}
+	response := &cellResponse{
+		images:  []hanapi.ImageData{},
+		results: len(media),
+	}
+	oldest := int64(0)
 	for _, m := range media {
+		// the newest media will be the cursor for the next query
+		if m.CreatedTime > latest {
+			latest = m.CreatedTime
+			response.cursor = strconv.FormatInt(m.CreatedTime, 10)
+		}
+		// unless the results were capped, then older media may be missing
+		if oldest == 0 || m.CreatedTime < oldest {
+			oldest = m.CreatedTime
+			response.cappedCursor = strconv.FormatInt(m.CreatedTime, 10)
+		}
 		// make sure the caption is not nil
 		text := ""
 		if m.Caption != nil {
@@ -83,7 +114,7 @@ func (c *InstagramCollector) queryImages(client *instagram.Client, lat float64,
 			m.Location.Latitude, m.Location.Longitude, m.Link,
 			m.User.Username, m.User.ProfilePicture,
 			c.config.CollectorName)
-		images = append(images, *newImage)
+		response.images = append(response.images, *newImage)
 	}
-	return images, nil
+	return response, nil
 }
@@ -0,0 +1,261 @@
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LocalPhotosPath and LocalThumbnailsPath are appended to the configured base
+// URL to serve photos and thumbnails from hanhttpserver
+const (
+	LocalPhotosPath     = "photos/"
+	LocalThumbnailsPath = "thumbnails/"
+)
+
+// localThumbnailWidth is the width in pixels of generated thumbnails
+const localThumbnailWidth = 320
+
+// localScanEndpoint is what quotas are tracked against, limiting how often the
+// directory is scanned
+const localScanEndpoint = "scan"
+
+// localExtensions are the file types that are read
+var localExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".heic": true, ".heif": true,
+}
+
+// LocalCollector implements the collector interface for photos stored in a
+// local directory, placing them using their EXIF GPS coordinates
+type LocalCollector struct {
+	*APIRestrictedCollector
+	config *config.LocalConfiguration
+	// photos that have already been read, keyed by path relative to the
+	// directory
+	photos map[string]*localPhoto
+	mutex  sync.Mutex
+}
+
+type localPhoto struct {
+	modTime int64
+	// nil if the photo couldn't be placed
+	image *hanapi.ImageData
+}
+
+func init() {
+	Register("local", func() config.CollectorConfiguration {
+		return config.NewLocalConfig()
+	}, func(c config.CollectorConfiguration) ImageCollector {
+		return NewLocalCollector(c.(*config.LocalConfiguration))
+	})
+}
+
+// NewLocalCollector creates a new `LocalCollector`
+func NewLocalCollector(config *config.LocalConfiguration) *LocalCollector {
+	c := &LocalCollector{
+		APIRestrictedCollector: NewAPIRestrictedCollector(),
+		config:                 config,
+		photos:                 map[string]*localPhoto{},
+	}
+	return c
+}
+
+// GetConfig returns the configuration for the local source
+// Use this to store api keys and enable/disable collectors
+func (c *LocalCollector) GetConfig() config.CollectorConfiguration {
+	return c.config
+}
+
+// GetImages returns photos within the region that were added or changed since
+// the directory was last scanned
+func (c *LocalCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	if !c.GetConfig().IsEnabled() || len(c.config.Directory) == 0 {
+		return []hanapi.ImageData{}, nil
+	}
+	return querySources(ctx, cursors, c.config.CollectorName, region,
+		[]string{c.config.Directory},
+		func(directory string, cursor string) ([]hanapi.ImageData, string, error) {
+			return c.scan(ctx, region, cursor)
+		})
+}
+
+// scan walks the directory, reading any photos that are new or have changed
+// @param lastModified - the newest modification time previously seen in
+// nanoseconds, this is optional and should be empty if the directory hasn't
+// been scanned before
+func (c *LocalCollector) scan(ctx context.Context, region *hanapi.Region, lastModified string) ([]hanapi.ImageData, string, error) {
+	// check that we haven't reached query limits
+	if !c.acquireQuota(c.GetConfig(), localScanEndpoint) {
+		return nil, "", errQueryLimitReached
+	}
+	// an invalid cursor is ignored so that the directory is scanned from
+	// scratch
+	latest, _ := strconv.ParseInt(lastModified, 10, 64)
+	newest := latest
+	images := []hanapi.ImageData{}
+	thumbnailDirectory := c.config.GetThumbnailDirectory()
+	err := filepath.Walk(c.config.Directory, func(p string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// skip files that can't be read rather than stopping the scan
+			return nil
+		}
+		if info.IsDir() {
+			if p == thumbnailDirectory || (p != c.config.Directory && strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !localExtensions[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		modTime := info.ModTime().UnixNano()
+		if modTime <= latest {
+			return nil
+		}
+		if modTime > newest {
+			newest = modTime
+		}
+		rel, err := filepath.Rel(c.config.Directory, p)
+		if err != nil {
+			return nil
+		}
+		image := c.getPhoto(filepath.ToSlash(rel), p, info)
+		if image != nil && region.Contains(image.Location.Lat, image.Location.Lng) {
+			images = append(images, *image)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	cursor := ""
+	if newest > latest {
+		cursor = strconv.FormatInt(newest, 10)
+	}
+	return images, cursor, nil
+}
+
+// getPhoto returns the photo's image, only reading the file if it hasn't
+// been read since it was last modified
+func (c *LocalCollector) getPhoto(rel string, p string, info os.FileInfo) *hanapi.ImageData {
+	modTime := info.ModTime().UnixNano()
+	c.mutex.Lock()
+	photo, ok := c.photos[rel]
+	c.mutex.Unlock()
+	if ok && photo.modTime == modTime {
+		return photo.image
+	}
+	photo = &localPhoto{modTime: modTime, image: c.readPhoto(rel, p, info)}
+	c.mutex.Lock()
+	c.photos[rel] = photo
+	c.mutex.Unlock()
+	return photo.image
+}
+
+// readPhoto returns nil if the photo has no location
+func (c *LocalCollector) readPhoto(rel string, p string, info os.FileInfo) *hanapi.ImageData {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	exif, err := readEXIF(data)
+	if err != nil || !exif.hasLocation {
+		return nil
+	}
+	createdTime := info.ModTime().Unix()
+	if !exif.taken.IsZero() {
+		createdTime = exif.taken.Unix()
+	}
+	imageURL := LocalURL(c.config.BaseURL, LocalPhotosPath, rel)
+	thumbnailURL := imageURL
+	if c.writeThumbnail(rel, data, exif) == nil {
+		thumbnailURL = LocalURL(c.config.BaseURL, LocalThumbnailsPath, LocalThumbnailName(rel))
+	}
+	caption := strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	return hanapi.NewImage(caption, createdTime, imageURL, thumbnailURL,
+		"local:"+rel, exif.lat, exif.lng, imageURL, c.config.Username, "",
+		c.config.CollectorName)
+}
+
+// writeThumbnail scales JPEGs down, for other formats the thumbnail embedded
+// in the EXIF data is used
+func (c *LocalCollector) writeThumbnail(rel string, data []byte, exif *exifData) error {
+	thumbnailPath := filepath.Join(c.config.GetThumbnailDirectory(),
+		filepath.FromSlash(LocalThumbnailName(rel)))
+	if err := os.MkdirAll(filepath.Dir(thumbnailPath), 0755); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		if exif.thumbnail == nil {
+			return err
+		}
+		return ioutil.WriteFile(thumbnailPath, exif.thumbnail, 0644)
+	}
+	f, err := os.Create(thumbnailPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return jpeg.Encode(f, scaleImage(src, localThumbnailWidth), nil)
+}
+
+// LocalThumbnailName returns the path of the photo's thumbnail relative to
+// the thumbnail directory
+func LocalThumbnailName(rel string) string {
+	return rel + ".jpg"
+}
+
+// scaleImage resizes the image to the width, keeping its aspect ratio. Images
+// that are already small enough are returned as is
+func scaleImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() <= width {
+		return src
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// nearest neighbour is good enough for thumbnails
+			srcX := bounds.Min.X + x*bounds.Dx()/width
+			srcY := bounds.Min.Y + y*bounds.Dy()/height
+			dst.Set(x, y, src.At(srcX, srcY))
+		}
+	}
+	return dst
+}
+
+// LocalURL returns the URL that hanhttpserver serves a file at
+// @param baseURL - the configured base URL, with or without a trailing slash
+// @param filesPath - `LocalPhotosPath` or `LocalThumbnailsPath`
+// @param rel - the file's path relative to the photo or thumbnail directory
+func LocalURL(baseURL string, filesPath string, rel string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + filesPath + escapePath(rel)
+}
+
+// escapePath escapes each segment of a slash separated path for use in a URL
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,241 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mastodonPerPage is the most statuses Mastodon returns per timeline request
+const mastodonPerPage = 40
+
+// mastodonMaxPages is the most pages that will be requested per instance each
+// time a region is collected
+const mastodonMaxPages = 5
+
+// geoURIPattern matches RFC 5870 geo URIs such as `geo:-35.28,149.13`
+var geoURIPattern = regexp.MustCompile(`geo:(-?\d+(?:\.\d+)?),(-?\d+(?:\.\d+)?)`)
+
+// MastodonCollector implements the collector interface for Mastodon
+// instances. Timelines aren't searchable by location, so each instance's
+// public timeline is read and only posts located within the region are kept.
+// Mastodon has no location field, so posts are located using a geo URI in
+// their content or the `location` that some ActivityPub servers include
+type MastodonCollector struct {
+	*APIRestrictedCollector
+	config *config.MastodonConfiguration
+}
+
+func init() {
+	Register("mastodon", func() config.CollectorConfiguration {
+		return config.NewMastodonConfig()
+	}, func(c config.CollectorConfiguration) ImageCollector {
+		return NewMastodonCollector(c.(*config.MastodonConfiguration))
+	})
+}
+
+// NewMastodonCollector creates a new `MastodonCollector`
+func NewMastodonCollector(config *config.MastodonConfiguration) *MastodonCollector {
+	c := &MastodonCollector{
+		APIRestrictedCollector: NewAPIRestrictedCollector(),
+		config:                 config,
+	}
+	return c
+}
+
+// GetConfig returns the configuration for the Mastodon source
+// Use this to store api keys and enable/disable collectors
+func (c *MastodonCollector) GetConfig() config.CollectorConfiguration {
+	return c.config
+}
+
+// GetImages returns new images from each instance's public timeline that are
+// located within the region
+func (c *MastodonCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	if !c.GetConfig().IsEnabled() {
+		return []hanapi.ImageData{}, nil
+	}
+	return c.getImagesWithClient(ctx, newHTTPClient(c.config), region, cursors)
+}
+
+func (c *MastodonCollector) getImagesWithClient(ctx context.Context, client *http.Client, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	return querySources(ctx, cursors, c.config.CollectorName, region, c.config.Instances,
+		func(instance string, cursor string) ([]hanapi.ImageData, string, error) {
+			return c.queryTimeline(ctx, client, instance, region, cursor)
+		})
+}
+
+type mastodonAttachment struct {
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+	PreviewURL string `json:"preview_url"`
+}
+
+type mastodonAccount struct {
+	Acct   string `json:"acct"`
+	Avatar string `json:"avatar"`
+}
+
+type mastodonLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type mastodonStatus struct {
+	ID        string               `json:"id"`
+	URI       string               `json:"uri"`
+	URL       string               `json:"url"`
+	CreatedAt string               `json:"created_at"`
+	Content   string               `json:"content"`
+	Sensitive bool                 `json:"sensitive"`
+	Account   mastodonAccount      `json:"account"`
+	Media     []mastodonAttachment `json:"media_attachments"`
+	Location  *mastodonLocation    `json:"location"`
+}
+
+// queryTimeline reads the instance's public timeline, returning images within
+// the region and the newest status ID that was seen
+// @param minID - only statuses after this ID are returned, this is optional
+// and should be empty if the instance hasn't been read before
+func (c *MastodonCollector) queryTimeline(ctx context.Context, client *http.Client, instance string,
+	region *hanapi.Region, minID string) ([]hanapi.ImageData, string, error) {
+	images := []hanapi.ImageData{}
+	cursor := minID
+	for page := 0; page < mastodonMaxPages; page++ {
+		// each instance has its own rate limit
+		var statuses []mastodonStatus
+		err := c.query(ctx, c.GetConfig(), instance, func() error {
+			var err error
+			statuses, err = c.getTimeline(ctx, client, instance, cursor)
+			return err
+		})
+		if err != nil {
+			if page == 0 {
+				// we failed so just return the error
+				return nil, "", err
+			}
+			// keep what we have, the rest will be requested next time
+			break
+		}
+		for _, status := range statuses {
+			if compareStatusIDs(status.ID, cursor) > 0 {
+				cursor = status.ID
+			}
+			image := c.convertStatus(status)
+			if image == nil || !region.Contains(image.Location.Lat, image.Location.Lng) {
+				continue
+			}
+			images = append(images, *image)
+		}
+		// without a cursor only the latest page is read, since there's
+		// nothing to catch up on
+		if len(minID) == 0 || len(statuses) < mastodonPerPage {
+			break
+		}
+	}
+	return images, cursor, nil
+}
+
+func (c *MastodonCollector) getTimeline(ctx context.Context, client *http.Client, instance string, minID string) ([]mastodonStatus, error) {
+	params := url.Values{}
+	params.Set("only_media", "true")
+	params.Set("limit", strconv.Itoa(mastodonPerPage))
+	if c.config.Local {
+		params.Set("local", "true")
+	}
+	if len(minID) > 0 {
+		// min_id returns the statuses immediately after the cursor so that
+		// none are skipped when catching up
+		params.Set("min_id", minID)
+	}
+	endpoint := strings.TrimRight(instance, "/") + "/api/v1/timelines/public?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.config.AccessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	c.updateQuota(c.GetConfig(), instance, res)
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res, fmt.Errorf("Mastodon timeline %s failed with status %d",
+			instance, res.StatusCode))
+	}
+	statuses := []mastodonStatus{}
+	if err := json.NewDecoder(res.Body).Decode(&statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// convertStatus returns nil if the status has no image or location
+func (c *MastodonCollector) convertStatus(status mastodonStatus) *hanapi.ImageData {
+	// sensitive media is hidden behind a warning on Mastodon, so we shouldn't
+	// show it either
+	if status.Sensitive {
+		return nil
+	}
+	var attachment *mastodonAttachment
+	for i := range status.Media {
+		if status.Media[i].Type == "image" {
+			attachment = &status.Media[i]
+			break
+		}
+	}
+	if attachment == nil {
+		return nil
+	}
+	lat, lng, ok := statusLocation(status)
+	if !ok {
+		return nil
+	}
+	createdAt, err := time.Parse(time.RFC3339, status.CreatedAt)
+	if err != nil {
+		return nil
+	}
+	caption := plainText(status.Content)
+	// the URI is used since status IDs are only unique within an instance
+	return hanapi.NewImage(caption, createdAt.Unix(), attachment.URL,
+		attachment.PreviewURL, status.URI, lat, lng, status.URL,
+		status.Account.Acct, status.Account.Avatar, c.config.CollectorName)
+}
+
+// statusLocation returns the status' location, preferring an explicit
+// location over a geo URI in its content
+func statusLocation(status mastodonStatus) (float64, float64, bool) {
+	if status.Location != nil {
+		return status.Location.Latitude, status.Location.Longitude, true
+	}
+	match := geoURIPattern.FindStringSubmatch(status.Content)
+	if match == nil {
+		return 0, 0, false
+	}
+	lat, latErr := strconv.ParseFloat(match[1], 64)
+	lng, lngErr := strconv.ParseFloat(match[2], 64)
+	if latErr != nil || lngErr != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
+
+// compareStatusIDs compares Mastodon's numeric string IDs, which can't be
+// compared lexically since they aren't padded
+func compareStatusIDs(a string, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
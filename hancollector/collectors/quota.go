@@ -0,0 +1,331 @@
+package collectors
+
+import (
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is how long an endpoint is paused after being rate
+// limited, when the provider doesn't say when to retry
+const defaultRetryAfter = 60
+
+// rateLimitRemainingHeaders and rateLimitResetHeaders are the headers used by
+// providers to report their limits, in order of preference
+var rateLimitRemainingHeaders = []string{
+	"X-Rate-Limit-Remaining",
+	"X-RateLimit-Remaining",
+	"RateLimit-Remaining",
+}
+var rateLimitResetHeaders = []string{
+	"X-Rate-Limit-Reset",
+	"X-RateLimit-Reset",
+	"RateLimit-Reset",
+}
+
+// QuotaStore records queries so that quotas can be shared between processes.
+// This is implemented by `hanapi.DatabaseInterface`
+type QuotaStore interface {
+	// AcquireQuery records a query if there were fewer than limit since the
+	// specified time. This must be atomic so that processes sharing the store
+	// can't exceed the limit together
+	AcquireQuery(key string, time int64, since int64, limit int) bool
+	// ReleaseQuery removes a query recorded by AcquireQuery that wasn't made
+	ReleaseQuery(key string, time int64)
+	CountQueries(key string, since int64) int
+	// remaining is -1 if the provider hasn't reported it
+	GetProviderQuota(key string) (remaining int, reset int64)
+	SetProviderQuota(key string, remaining int, reset int64)
+	// TakeProviderQuota atomically takes one of the provider's remaining
+	// queries, returning false if the provider reported that none are left
+	// before the reset
+	TakeProviderQuota(key string, now int64) bool
+}
+
+// QuotaState describes the current budget of an endpoint
+type QuotaState struct {
+	Collector string `json:"collector"`
+	Endpoint  string `json:"endpoint"`
+	Limit     int    `json:"limit"`
+	// Window is the length of the sliding window in seconds
+	Window int64 `json:"window"`
+	Used   int   `json:"used"`
+	// Remaining also takes into account what the provider last reported
+	Remaining int `json:"remaining"`
+	// Reset is when the provider's limit resets, this is 0 if unknown
+	Reset int64 `json:"reset"`
+}
+
+type quotaBudget struct {
+	collector string
+	endpoint  string
+	config    config.CollectorConfiguration
+}
+
+// QuotaManager tracks queries to each collector's endpoints using sliding
+// windows, along with the limits that providers report in their responses.
+// The store is atomic, so the mutex only guards the budgets
+type QuotaManager struct {
+	store   QuotaStore
+	budgets map[string]quotaBudget
+	mutex   sync.Mutex
+	// used to control time in tests
+	now func() time.Time
+}
+
+// NewQuotaManager creates a `QuotaManager`
+// @param store - where queries are recorded, use a shared store such as the
+// database to share quotas between processes
+func NewQuotaManager(store QuotaStore) *QuotaManager {
+	return &QuotaManager{
+		store:   store,
+		budgets: map[string]quotaBudget{},
+		now:     time.Now,
+	}
+}
+
+// Acquire returns true and records a query if the endpoint has budget left
+func (q *QuotaManager) Acquire(c config.CollectorConfiguration, endpoint string) bool {
+	key := q.register(c, endpoint)
+	limit, window := c.GetEndpointBudget(endpoint)
+	now := q.now().Unix()
+	// avoid using up the window while the provider is rate limiting us
+	remaining, reset := q.store.GetProviderQuota(key)
+	if remaining == 0 && now < reset {
+		return false
+	}
+	if !q.store.AcquireQuery(key, now, now-window, limit) {
+		return false
+	}
+	if !q.store.TakeProviderQuota(key, now) {
+		// the query isn't made, so it shouldn't use up the window
+		q.store.ReleaseQuery(key, now)
+		return false
+	}
+	return true
+}
+
+// Update records the limits reported in a provider's response, if the
+// response says that the endpoint is rate limited then it won't be queried
+// until the limit resets
+func (q *QuotaManager) Update(c config.CollectorConfiguration, endpoint string, res *http.Response) {
+	if res == nil {
+		return
+	}
+	key := q.register(c, endpoint)
+	_, window := c.GetEndpointBudget(endpoint)
+	now := q.now()
+	remaining, reset, ok := parseRateLimitHeaders(res.Header, now)
+	if res.StatusCode == http.StatusTooManyRequests {
+		remaining = 0
+		if retry, hasRetry := parseRetryAfter(res.Header.Get("Retry-After"), now); hasRetry {
+			reset = retry
+		} else if !ok || reset <= now.Unix() {
+			reset = now.Unix() + defaultRetryAfter
+		}
+		ok = true
+	}
+	if !ok {
+		return
+	}
+	if reset <= now.Unix() {
+		// assume the provider's window matches ours
+		reset = now.Unix() + window
+	}
+	q.store.SetProviderQuota(key, remaining, reset)
+}
+
+// State returns the budget of each endpoint that has been used
+func (q *QuotaManager) State() []QuotaState {
+	q.mutex.Lock()
+	budgets := map[string]quotaBudget{}
+	keys := []string{}
+	for key, budget := range q.budgets {
+		budgets[key] = budget
+		keys = append(keys, key)
+	}
+	q.mutex.Unlock()
+	sort.Strings(keys)
+	now := q.now().Unix()
+	states := []QuotaState{}
+	for _, key := range keys {
+		budget := budgets[key]
+		limit, window := budget.config.GetEndpointBudget(budget.endpoint)
+		state := QuotaState{
+			Collector: budget.collector,
+			Endpoint:  budget.endpoint,
+			Limit:     limit,
+			Window:    window,
+			Used:      q.store.CountQueries(key, now-window),
+		}
+		state.Remaining = limit - state.Used
+		if state.Remaining < 0 {
+			state.Remaining = 0
+		}
+		remaining, reset := q.store.GetProviderQuota(key)
+		if remaining >= 0 && now < reset {
+			state.Reset = reset
+			if remaining < state.Remaining {
+				state.Remaining = remaining
+			}
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// register keeps track of the endpoint so that its state can be reported
+func (q *QuotaManager) register(c config.CollectorConfiguration, endpoint string) string {
+	key := c.GetCollectorName() + "/" + endpoint
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.budgets[key] = quotaBudget{
+		collector: c.GetCollectorName(),
+		endpoint:  endpoint,
+		config:    c,
+	}
+	return key
+}
+
+// parseRateLimitHeaders returns the remaining queries and when they reset
+func parseRateLimitHeaders(header http.Header, now time.Time) (int, int64, bool) {
+	remaining := -1
+	for _, name := range rateLimitRemainingHeaders {
+		value, err := strconv.Atoi(header.Get(name))
+		if err == nil {
+			remaining = value
+			break
+		}
+	}
+	if remaining < 0 {
+		return 0, 0, false
+	}
+	reset := int64(0)
+	for _, name := range rateLimitResetHeaders {
+		if value, ok := parseResetTime(header.Get(name), now); ok {
+			reset = value
+			break
+		}
+	}
+	return remaining, reset, true
+}
+
+// parseResetTime handles unix times (Twitter), seconds from now (the IETF
+// draft) and timestamps (Mastodon)
+func parseResetTime(value string, now time.Time) (int64, bool) {
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		// anything before 2001 must be relative
+		if seconds < 1000000000 {
+			return now.Unix() + seconds, true
+		}
+		return seconds, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), true
+	}
+	return 0, false
+}
+
+// parseRetryAfter handles both delay seconds and HTTP dates
+func parseRetryAfter(value string, now time.Time) (int64, bool) {
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return now.Unix() + seconds, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Unix(), true
+	}
+	return 0, false
+}
+
+// memoryQuotaStore is used when quotas don't need to be shared
+type memoryQuotaStore struct {
+	queries   map[string][]int64
+	providers map[string][2]int64
+	mutex     sync.Mutex
+}
+
+// NewMemoryQuotaStore creates a `QuotaStore` that's only used by this process
+func NewMemoryQuotaStore() QuotaStore {
+	return &memoryQuotaStore{
+		queries:   map[string][]int64{},
+		providers: map[string][2]int64{},
+	}
+}
+
+func (s *memoryQuotaStore) AcquireQuery(key string, time int64, since int64, limit int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.countQueries(key, since) >= limit {
+		return false
+	}
+	s.queries[key] = append(s.queries[key], time)
+	return true
+}
+
+func (s *memoryQuotaStore) ReleaseQuery(key string, time int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	queries := s.queries[key]
+	for i := len(queries) - 1; i >= 0; i-- {
+		if queries[i] == time {
+			s.queries[key] = append(queries[:i:i], queries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *memoryQuotaStore) CountQueries(key string, since int64) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.countQueries(key, since)
+}
+
+// countQueries must be called while holding the mutex
+func (s *memoryQuotaStore) countQueries(key string, since int64) int {
+	// queries are recorded in order, so drop the ones outside of the window
+	queries := s.queries[key]
+	i := sort.Search(len(queries), func(i int) bool {
+		return queries[i] >= since
+	})
+	s.queries[key] = queries[i:]
+	return len(queries) - i
+}
+
+func (s *memoryQuotaStore) GetProviderQuota(key string) (int, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	quota, ok := s.providers[key]
+	if !ok {
+		return -1, 0
+	}
+	return int(quota[0]), quota[1]
+}
+
+func (s *memoryQuotaStore) SetProviderQuota(key string, remaining int, reset int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.providers[key] = [2]int64{int64(remaining), reset}
+}
+
+func (s *memoryQuotaStore) TakeProviderQuota(key string, now int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	quota, ok := s.providers[key]
+	if !ok || quota[0] < 0 || now >= quota[1] {
+		return true
+	}
+	if quota[0] == 0 {
+		return false
+	}
+	s.providers[key] = [2]int64{quota[0] - 1, quota[1]}
+	return true
+}
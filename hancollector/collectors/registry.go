@@ -0,0 +1,40 @@
+package collectors
+
+import (
+	"fmt"
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+)
+
+// Factory creates a collector from its configuration, which will be the type
+// returned by the config factory it was registered with
+type Factory func(c config.CollectorConfiguration) ImageCollector
+
+var factories = map[string]Factory{}
+
+// Register makes a type of collector available. This should be called from
+// the collector's `init` so that it can be configured using `collectorType`
+// @param newConfig - returns a configuration with default values, that the
+// collector's json configuration is decoded into
+// @param factory - creates the collector from its configuration
+func Register(collectorType string, newConfig config.ConfigurationFactory, factory Factory) {
+	if _, ok := factories[collectorType]; ok {
+		panic("collector registered twice: " + collectorType)
+	}
+	factories[collectorType] = factory
+	config.RegisterType(collectorType, newConfig)
+}
+
+// NewCollectors creates a collector for each configuration, ordered by name
+func NewCollectors(c config.CollectionConfig) ([]ImageCollector, error) {
+	collectors := []ImageCollector{}
+	for _, name := range c.Names() {
+		collectorConfig := c[name]
+		factory, ok := factories[collectorConfig.GetCollectorType()]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown collector type %q", name,
+				collectorConfig.GetCollectorType())
+		}
+		collectors = append(collectors, factory(collectorConfig))
+	}
+	return collectors, nil
+}
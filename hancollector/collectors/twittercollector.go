@@ -1,18 +1,37 @@
 package collectors
 
 import (
+	"context"
 	"fmt"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/reporting"
 	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"net/http"
+	"strconv"
 	"time"
 )
 
+// twitterResultCap is the most tweets that a single search can return
+const twitterResultCap = 100
+
+// twitterSearchEndpoint is the endpoint that quotas are tracked against
+const twitterSearchEndpoint = "search/tweets"
+
 // TwitterCollector implements the collector interface for Twitter
 type TwitterCollector struct {
 	*APIRestrictedCollector
-	config *config.TwitterConfiguration
+	config  *config.TwitterConfiguration
+	planner *CoveragePlanner
+}
+
+func init() {
+	Register("twitter", func() config.CollectorConfiguration {
+		return config.NewTwitterConfig()
+	}, func(c config.CollectorConfiguration) ImageCollector {
+		return NewTwitterCollector(c.(*config.TwitterConfiguration))
+	})
 }
 
 // NewTwitterCollector creates a new `TwitterCollector`
@@ -20,6 +39,7 @@ func NewTwitterCollector(config *config.TwitterConfiguration) *TwitterCollector
 	c := &TwitterCollector{
 		APIRestrictedCollector: NewAPIRestrictedCollector(),
 		config:                 config,
+		planner:                NewCoveragePlanner(QueryRange, twitterResultCap),
 	}
 	return c
 }
@@ -27,11 +47,11 @@ func NewTwitterCollector(config *config.TwitterConfiguration) *TwitterCollector
 // GetConfig returns the configuration for the Twitter source
 // Use this to store api keys and enable/disable collectors
 func (c *TwitterCollector) GetConfig() config.CollectorConfiguration {
-	return config.TwitterConfig
+	return c.config
 }
 
 // GetImages returns new images queried by location on Twitter
-func (c *TwitterCollector) GetImages(lat float64, lng float64) ([]hanapi.ImageData, error) {
+func (c *TwitterCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
 	if !c.GetConfig().IsEnabled() {
 		return []hanapi.ImageData{}, nil
 	}
@@ -41,48 +61,70 @@ func (c *TwitterCollector) GetImages(lat float64, lng float64) ([]hanapi.ImageDa
 	token := oauth1.NewToken(c.config.AccessToken, c.config.AccessSecret)
 	// http.Client will automatically authorize Requests
 	httpClient := conf.Client(oauth1.NoContext, token)
-	client := twitter.NewClient(httpClient)
+	// go-twitter doesn't accept a context, so the timeout is set on the
+	// client and cancellation is only checked between cells
+	client := twitter.NewClient(&http.Client{
+		Transport: httpClient.Transport,
+		Timeout:   c.config.GetTimeout(),
+	})
 
-	return c.getImagesWithClient(client, lat, lng)
+	return c.getImagesWithClient(ctx, client, region, cursors)
 }
 
-func (c *TwitterCollector) getImagesWithClient(client *twitter.Client, lat float64, lng float64) ([]hanapi.ImageData, error) {
-	images, err := c.queryImages(client, lat, lng)
-	if err != nil {
-		return images, err
-	}
-	points := GetSurroundingPoints(lat, lng, QueryRange)
-	// continue search until we have at least 100 images
-	for i := 0; i < len(points) && len(images) < 100; i++ {
-		queryResponse, err := c.queryImages(client, points[i].Lat, points[i].Lng)
-		if err != nil {
-			continue
-		}
-		images = append(images, queryResponse...)
-	}
-	return images, nil
+func (c *TwitterCollector) getImagesWithClient(ctx context.Context, client *twitter.Client, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	return queryCells(ctx, c.planner, cursors, c.config.CollectorName, region,
+		func(cell Cell, cursor string) (*cellResponse, error) {
+			return c.queryImages(ctx, client, cell, cursor)
+		})
 }
 
-func (c *TwitterCollector) queryImages(client *twitter.Client, lat float64, lng float64) ([]hanapi.ImageData, error) {
-	// check that we haven't reached query limits
-	if !c.ableToQuery(c.GetConfig()) {
-		return []hanapi.ImageData{}, nil
-	}
+// queryImages searches for tweets within the cell
+// @param sinceID - only tweets newer than this ID are returned, this is
+// optional and should be empty if the cell hasn't been queried before
+func (c *TwitterCollector) queryImages(ctx context.Context, client *twitter.Client, cell Cell, sinceID string) (*cellResponse, error) {
 	includeEntities := true
+	radius := strconv.FormatFloat(cell.Radius/1000, 'f', -1, 64)
 	params := &twitter.SearchTweetParams{
 		Query:           "filter:images",
-		Geocode:         fmt.Sprintf("%f,%f,%dkm", lat, lng, QueryRange/1000),
+		Geocode:         fmt.Sprintf("%f,%f,%skm", cell.Lat, cell.Lng, radius),
+		Count:           twitterResultCap,
 		IncludeEntities: &includeEntities,
 	}
-	media, _, err := client.Search.Tweets(params)
+	// an invalid cursor is ignored so that the cell is queried from scratch
+	since, _ := strconv.ParseInt(sinceID, 10, 64)
+	params.SinceID = since
+	var media *twitter.Search
+	err := c.query(ctx, c.GetConfig(), twitterSearchEndpoint, func() error {
+		var res *http.Response
+		var err error
+		media, res, err = client.Search.Tweets(params)
+		c.updateQuota(c.GetConfig(), twitterSearchEndpoint, res)
+		if err != nil && res != nil {
+			return statusError(res, err)
+		}
+		return err
+	})
 	if err != nil {
-		c.APIRestrictedCollector.receivedError = true
 		// we failed so just return the error
-		return []hanapi.ImageData{}, err
+		return nil, err
 	}
 
-	images := []hanapi.ImageData{}
+	response := &cellResponse{
+		images:  []hanapi.ImageData{},
+		results: len(media.Statuses),
+	}
+	oldest := int64(0)
 	for _, m := range media.Statuses {
+		// the newest tweet will be the cursor for the next query
+		if m.ID > since {
+			since = m.ID
+			response.cursor = strconv.FormatInt(m.ID, 10)
+		}
+		// unless the results were capped, then older tweets may be missing
+		if oldest == 0 || m.ID < oldest {
+			oldest = m.ID
+			response.cappedCursor = strconv.FormatInt(m.ID, 10)
+		}
 		// if it doesn't have an image then ignore
 		if len(m.Entities.Media) == 0 {
 			continue
@@ -91,7 +133,10 @@ func (c *TwitterCollector) queryImages(client *twitter.Client, lat float64, lng
 		const longForm = "Mon Jan 2 15:04:05 -0700 2006"
 		t, err := time.Parse(longForm, m.CreatedAt)
 		if err != nil {
-			fmt.Println(err)
+			reporting.Default().Log(reporting.Warn, "Invalid tweet date", reporting.Fields{
+				"collector": c.GetConfig().GetCollectorName(),
+				"error":     err,
+			})
 			continue
 		}
 		// if it's not geotagged then we ignore it
@@ -108,7 +153,7 @@ func (c *TwitterCollector) queryImages(client *twitter.Client, lat float64, lng
 			m.Entities.Media[0].DisplayURL,
 			m.User.Name, m.User.ProfileImageURL,
 			c.config.CollectorName)
-		images = append(images, *newImage)
+		response.images = append(response.images, *newImage)
 	}
-	return images, nil
+	return response, nil
 }
@@ -0,0 +1,265 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wikimediaAPIURL is Wikimedia Commons' MediaWiki API endpoint
+const wikimediaAPIURL = "https://commons.wikimedia.org/w/api.php"
+
+// wikimediaSearchEndpoint is the module that quotas are tracked against
+const wikimediaSearchEndpoint = "geosearch"
+
+// wikimediaSearchRadius is the largest radius geosearch allows in metres
+const wikimediaSearchRadius = 10000
+
+// wikimediaResultCap is the amount of files requested per search
+const wikimediaResultCap = 100
+
+// wikimediaImageWidth and wikimediaThumbnailWidth are the widths in pixels of
+// the scaled images that are used
+const wikimediaImageWidth = 1024
+const wikimediaThumbnailWidth = 320
+
+// WikimediaCollector implements the collector interface for Wikimedia Commons
+type WikimediaCollector struct {
+	*APIRestrictedCollector
+	config  *config.WikimediaConfiguration
+	planner *CoveragePlanner
+	apiURL  string
+}
+
+func init() {
+	Register("wikimedia", func() config.CollectorConfiguration {
+		return config.NewWikimediaConfig()
+	}, func(c config.CollectorConfiguration) ImageCollector {
+		return NewWikimediaCollector(c.(*config.WikimediaConfiguration))
+	})
+}
+
+// NewWikimediaCollector creates a new `WikimediaCollector`
+func NewWikimediaCollector(config *config.WikimediaConfiguration) *WikimediaCollector {
+	c := &WikimediaCollector{
+		APIRestrictedCollector: NewAPIRestrictedCollector(),
+		config:                 config,
+		planner:                NewCoveragePlanner(wikimediaSearchRadius, wikimediaResultCap),
+		apiURL:                 wikimediaAPIURL,
+	}
+	return c
+}
+
+// GetConfig returns the configuration for the Wikimedia Commons source
+// Use this to store api keys and enable/disable collectors
+func (c *WikimediaCollector) GetConfig() config.CollectorConfiguration {
+	return c.config
+}
+
+// GetImages returns new images queried by location on Wikimedia Commons
+func (c *WikimediaCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	if !c.GetConfig().IsEnabled() {
+		return []hanapi.ImageData{}, nil
+	}
+	return c.getImagesWithClient(ctx, newHTTPClient(c.config), region, cursors)
+}
+
+func (c *WikimediaCollector) getImagesWithClient(ctx context.Context, client *http.Client, region *hanapi.Region, cursors CursorStore) ([]hanapi.ImageData, error) {
+	return queryCells(ctx, c.planner, cursors, c.config.CollectorName, region,
+		func(cell Cell, cursor string) (*cellResponse, error) {
+			return c.queryImages(ctx, client, cell, cursor)
+		})
+}
+
+type wikimediaMetadataValue struct {
+	Value string `json:"value"`
+}
+
+type wikimediaImageInfo struct {
+	Timestamp      string                            `json:"timestamp"`
+	User           string                            `json:"user"`
+	URL            string                            `json:"url"`
+	ThumbURL       string                            `json:"thumburl"`
+	DescriptionURL string                            `json:"descriptionurl"`
+	Mime           string                            `json:"mime"`
+	Metadata       map[string]wikimediaMetadataValue `json:"extmetadata"`
+}
+
+type wikimediaPage struct {
+	PageID      int    `json:"pageid"`
+	Title       string `json:"title"`
+	Coordinates []struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"coordinates"`
+	ImageInfo []wikimediaImageInfo `json:"imageinfo"`
+}
+
+type wikimediaResponse struct {
+	Error *struct {
+		Code string `json:"code"`
+		Info string `json:"info"`
+	} `json:"error"`
+	Query struct {
+		Pages []wikimediaPage `json:"pages"`
+	} `json:"query"`
+}
+
+// queryImages searches for files within the cell. Geosearch can't be filtered
+// by time, so files uploaded before the cursor are dropped instead
+// @param lastUpload - the unix time of the newest upload previously seen,
+// this is optional and should be empty if the cell hasn't been queried before
+func (c *WikimediaCollector) queryImages(ctx context.Context, client *http.Client, cell Cell, lastUpload string) (*cellResponse, error) {
+	var response *wikimediaResponse
+	err := c.query(ctx, c.GetConfig(), wikimediaSearchEndpoint, func() error {
+		var err error
+		response, err = c.search(ctx, client, cell)
+		return err
+	})
+	if err != nil {
+		// we failed so just return the error
+		return nil, err
+	}
+	// an invalid cursor is ignored so that the cell is queried from scratch
+	latest, _ := strconv.ParseInt(lastUpload, 10, 64)
+	result := &cellResponse{
+		images:  []hanapi.ImageData{},
+		results: len(response.Query.Pages),
+	}
+	newest := latest
+	oldest := int64(0)
+	for _, page := range response.Query.Pages {
+		image := c.convertPage(page)
+		if image == nil || image.CreatedTime <= latest {
+			continue
+		}
+		if image.CreatedTime > newest {
+			newest = image.CreatedTime
+		}
+		if oldest == 0 || image.CreatedTime < oldest {
+			oldest = image.CreatedTime
+		}
+		result.images = append(result.images, *image)
+	}
+	if newest > latest {
+		result.cursor = strconv.FormatInt(newest, 10)
+		// files further away than the capped results may be newer
+		result.cappedCursor = strconv.FormatInt(oldest, 10)
+	}
+	return result, nil
+}
+
+func (c *WikimediaCollector) search(ctx context.Context, client *http.Client, cell Cell) (*wikimediaResponse, error) {
+	params := url.Values{}
+	params.Set("action", "query")
+	params.Set("format", "json")
+	params.Set("formatversion", "2")
+	params.Set("generator", "geosearch")
+	params.Set("ggscoord", fmt.Sprintf("%f|%f", cell.Lat, cell.Lng))
+	params.Set("ggsradius", strconv.Itoa(int(cell.Radius)))
+	params.Set("ggslimit", strconv.Itoa(wikimediaResultCap))
+	// only search files
+	params.Set("ggsnamespace", "6")
+	params.Set("prop", "coordinates|imageinfo")
+	params.Set("iiprop", "timestamp|user|url|mime|extmetadata")
+	params.Set("iiurlwidth", strconv.Itoa(wikimediaImageWidth))
+	params.Set("iiextmetadatafilter", "LicenseShortName|Artist|ImageDescription")
+	req, err := http.NewRequestWithContext(ctx, "GET", c.apiURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.config.UserAgent)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	c.updateQuota(c.GetConfig(), wikimediaSearchEndpoint, res)
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res, fmt.Errorf("Wikimedia search failed with status %d", res.StatusCode))
+	}
+	response := new(wikimediaResponse)
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		return nil, err
+	}
+	if response.Error != nil {
+		return nil, &CollectorError{
+			Kind: wikimediaErrorKind(response.Error.Code),
+			Err: fmt.Errorf("Wikimedia search failed with code %s: %s",
+				response.Error.Code, response.Error.Info),
+		}
+	}
+	return response, nil
+}
+
+// wikimediaErrorKind classifies the error codes returned by the MediaWiki API
+func wikimediaErrorKind(code string) ErrorKind {
+	switch {
+	case code == "ratelimited":
+		return ErrorRateLimited
+	case code == "maxlag" || code == "readonly" || strings.HasPrefix(code, "internal_api_error"):
+		return ErrorTransient
+	}
+	return ErrorPermanent
+}
+
+// convertPage returns nil if the file isn't a photo or is missing required
+// information
+func (c *WikimediaCollector) convertPage(page wikimediaPage) *hanapi.ImageData {
+	if len(page.Coordinates) == 0 || len(page.ImageInfo) == 0 {
+		return nil
+	}
+	info := page.ImageInfo[0]
+	// other files, such as videos and documents, can also be geotagged
+	if info.Mime != "image/jpeg" && info.Mime != "image/png" {
+		return nil
+	}
+	// every file on Commons is freely licensed but the license must be shown
+	license := plainText(info.Metadata["LicenseShortName"].Value)
+	if len(license) == 0 {
+		return nil
+	}
+	uploaded, err := time.Parse(time.RFC3339, info.Timestamp)
+	if err != nil {
+		return nil
+	}
+	imageURL, thumbnailURL := wikimediaImageURLs(info)
+	// the artist is the author, which may differ from the uploader
+	author := plainText(info.Metadata["Artist"].Value)
+	if len(author) == 0 {
+		author = info.User
+	}
+	caption := plainText(info.Metadata["ImageDescription"].Value)
+	if len(caption) == 0 {
+		title := strings.TrimPrefix(page.Title, "File:")
+		caption = strings.TrimSuffix(title, path.Ext(title))
+	}
+	// titles are unique on Commons
+	image := hanapi.NewImage(caption, uploaded.Unix(), imageURL, thumbnailURL,
+		page.Title, page.Coordinates[0].Lat, page.Coordinates[0].Lon,
+		info.DescriptionURL, author, "", c.config.CollectorName)
+	image.License = license
+	return image
+}
+
+// wikimediaImageURLs returns a scaled image and thumbnail for the file. The
+// thumbnail is found by changing the width in the scaled image's URL, since
+// only one width can be requested at a time
+func wikimediaImageURLs(info wikimediaImageInfo) (string, string) {
+	// files smaller than the requested width aren't scaled
+	if len(info.ThumbURL) == 0 {
+		return info.URL, info.URL
+	}
+	thumbnailURL := strings.Replace(info.ThumbURL,
+		fmt.Sprintf("/%dpx-", wikimediaImageWidth),
+		fmt.Sprintf("/%dpx-", wikimediaThumbnailWidth), 1)
+	return info.ThumbURL, thumbnailURL
+}
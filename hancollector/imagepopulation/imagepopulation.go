@@ -1,12 +1,20 @@
 package imagepopulation
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
 	"github.com/oliveroneill/hanserver/hanapi/reporting"
 	"github.com/oliveroneill/hanserver/hancollector/collectors"
 	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
-	"os"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
@@ -15,147 +23,508 @@ import (
 const sanFranciscoLat = 37.769950
 const sanFranciscoLng = -122.448226
 
+// ErrNoCollectors is returned when population is started or reloaded without
+// any enabled collectors
+var ErrNoCollectors = errors.New("No collectors are enabled")
+
+// tracer starts spans for each population and each collector's search
+var tracer = otel.Tracer("github.com/oliveroneill/hanserver/hancollector/imagepopulation")
+
 // ImagePopulator is a type that will populate images from its set of
 // collectors
 type ImagePopulator struct {
 	collectorsList []collectors.ImageCollector
-	logger         reporting.Logger
+	// guards collectorsList, loops and running since collectors can be
+	// reloaded while populating
+	mutex sync.Mutex
+	// the update loop of each collector that is being populated
+	loops map[string]*collectorLoop
+	// set while PopulateImageDB is running, so that reloaded collectors
+	// can be started
+	running *population
+	logger  reporting.Logger
+	quota   *collectors.QuotaManager
+	// the last circuit state reported for each collector
+	circuits     map[string]collectors.CircuitState
+	circuitMutex sync.Mutex
+	// the last error of each collector, by name
+	lastErrors map[string]*CollectorError
+	errorMutex sync.Mutex
+	// collectors that are still running, so that their images can be written
+	// before shutting down
+	inFlight sync.WaitGroup
+}
+
+// CollectorState describes a collector and whether it's currently querying
+type CollectorState struct {
+	Name    string                  `json:"name"`
+	Type    string                  `json:"type"`
+	Enabled bool                    `json:"enabled"`
+	Circuit collectors.CircuitState `json:"circuit"`
+	// the collector's most recent error, nil if it hasn't failed
+	LastError *CollectorError `json:"last_error,omitempty"`
+}
+
+// CollectorError describes why a collection failed
+type CollectorError struct {
+	Error string `json:"error"`
+	// see `collectors.ClassifyError`
+	Kind string `json:"kind"`
+	// unix time of the failure
+	Time int64 `json:"time"`
+}
+
+// collectorLoop populates a single collector at its update frequency
+type collectorLoop struct {
+	// closed to stop the loop once its current population has finished
+	stop chan struct{}
+	// closed once the loop has returned
+	done chan struct{}
+}
+
+// population is what PopulateImageDB was called with
+type population struct {
+	ctx   context.Context
+	db    hanapi.DatabaseInterface
+	loops sync.WaitGroup
 }
 
 // NewImagePopulator creates a new `ImagePopulator`
-// @param configString - a json string specifying each collectors configuration
+// @param c - each collector's configuration, see `settings.Load`
 // @param logger - optional logging support
-func NewImagePopulator(configString string, logger reporting.Logger) *ImagePopulator {
-	c := config.UnmarshalConfig(configString)
+// @return an error if the collectors couldn't be created
+func NewImagePopulator(c config.CollectionConfig, logger reporting.Logger) (*ImagePopulator, error) {
+	collectorsList, err := collectors.NewCollectors(c)
+	if err != nil {
+		return nil, err
+	}
 	p := new(ImagePopulator)
-	p.collectorsList = []collectors.ImageCollector{
-		collectors.NewTwitterCollector(c.TwitterConfig),
-		collectors.NewInstagramCollector(c.InstagramConfig),
-		collectors.NewFlickrCollector(c.FlickrConfig),
+	if logger == nil {
+		logger = reporting.Default()
 	}
 	p.logger = logger
-	return p
+	p.collectorsList = collectorsList
+	p.loops = map[string]*collectorLoop{}
+	p.circuits = map[string]collectors.CircuitState{}
+	p.lastErrors = map[string]*CollectorError{}
+	p.UseQuotaStore(collectors.NewMemoryQuotaStore())
+	return p, nil
+}
+
+// UseQuotaStore sets where the collectors' queries are recorded. Use the
+// database so that quotas are shared with other processes
+func (p *ImagePopulator) UseQuotaStore(store collectors.QuotaStore) {
+	p.quota = collectors.NewQuotaManager(store)
+	for _, c := range p.getCollectors() {
+		c.SetQuotaManager(p.quota)
+	}
+}
+
+// QuotaState returns the remaining budget of each endpoint that the
+// collectors have queried
+func (p *ImagePopulator) QuotaState() []collectors.QuotaState {
+	return p.quota.State()
+}
+
+// CollectorStates returns the state of each collector's circuit breaker and
+// its most recent error
+func (p *ImagePopulator) CollectorStates() []CollectorState {
+	states := []CollectorState{}
+	p.errorMutex.Lock()
+	defer p.errorMutex.Unlock()
+	for _, c := range p.getCollectors() {
+		name := c.GetConfig().GetCollectorName()
+		states = append(states, CollectorState{
+			Name:      name,
+			Type:      c.GetConfig().GetCollectorType(),
+			Enabled:   c.GetConfig().IsEnabled(),
+			Circuit:   c.CircuitState(),
+			LastError: p.lastErrors[name],
+		})
+	}
+	return states
+}
+
+// recordError keeps the collector's most recent error for `CollectorStates`
+func (p *ImagePopulator) recordError(collectorName string, err error) {
+	p.errorMutex.Lock()
+	defer p.errorMutex.Unlock()
+	p.lastErrors[collectorName] = &CollectorError{
+		Error: err.Error(),
+		Kind:  collectors.ClassifyError(err).String(),
+		Time:  time.Now().Unix(),
+	}
+}
+
+// Ready returns an error unless at least one enabled collector can query its
+// provider, ie. its circuit isn't open
+func (p *ImagePopulator) Ready() error {
+	enabled := 0
+	for _, c := range p.CollectorStates() {
+		if !c.Enabled {
+			continue
+		}
+		enabled++
+		if c.Circuit != collectors.CircuitOpen {
+			return nil
+		}
+	}
+	if enabled == 0 {
+		return ErrNoCollectors
+	}
+	return fmt.Errorf("All %d enabled collectors have failed", enabled)
+}
+
+// reportCircuit logs when a collector's circuit breaker changes state
+func (p *ImagePopulator) reportCircuit(c collectors.ImageCollector) {
+	name := c.GetConfig().GetCollectorName()
+	state := c.CircuitState()
+	p.circuitMutex.Lock()
+	previous := p.circuits[name]
+	p.circuits[name] = state
+	p.circuitMutex.Unlock()
+	if state == previous {
+		return
+	}
+	level := reporting.Warn
+	if state == collectors.CircuitClosed {
+		level = reporting.Info
+	}
+	p.logger.Log(level, "Circuit breaker changed state", reporting.Fields{
+		"collector": name,
+		"circuit":   state.String(),
+	})
+}
+
+// reportQuota updates the remaining quota of each endpoint in metrics
+func (p *ImagePopulator) reportQuota() {
+	for _, state := range p.QuotaState() {
+		metrics.QuotaRemaining.WithLabelValues(state.Collector, state.Endpoint).
+			Set(float64(state.Remaining))
+	}
 }
 
 func (p *ImagePopulator) getCollectors() []collectors.ImageCollector {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	return p.collectorsList
 }
 
+// Reload replaces the collectors using a new configuration. Collectors whose
+// configuration hasn't changed keep running, while changed collectors finish
+// their current population before being replaced. Quotas are kept, since
+// they're tracked by collector name. The current collectors are kept if the
+// configuration can't be used
+// @param c - each collector's configuration, see `settings.Load`
+func (p *ImagePopulator) Reload(c config.CollectionConfig) error {
+	updated, err := collectors.NewCollectors(c)
+	if err != nil {
+		return err
+	}
+	atLeastOneEnabled := false
+	for _, collector := range updated {
+		atLeastOneEnabled = atLeastOneEnabled || collector.GetConfig().IsEnabled()
+	}
+	if !atLeastOneEnabled {
+		return ErrNoCollectors
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	existing := map[string]collectors.ImageCollector{}
+	for _, collector := range p.collectorsList {
+		existing[collector.GetConfig().GetCollectorName()] = collector
+	}
+	changes := map[string][]string{"added": {}, "updated": {}, "removed": {}}
+	collectorsList := []collectors.ImageCollector{}
+	for _, collector := range updated {
+		name := collector.GetConfig().GetCollectorName()
+		previous, ok := existing[name]
+		delete(existing, name)
+		if ok && reflect.DeepEqual(previous.GetConfig(), collector.GetConfig()) {
+			collectorsList = append(collectorsList, previous)
+			continue
+		}
+		if ok {
+			changes["updated"] = append(changes["updated"], name)
+		} else {
+			changes["added"] = append(changes["added"], name)
+		}
+		collector.SetQuotaManager(p.quota)
+		collectorsList = append(collectorsList, collector)
+		// a disabled collector stops once its current population finishes
+		previousLoop := p.stopLoop(name)
+		if collector.GetConfig().IsEnabled() {
+			p.startLoop(collector, previousLoop)
+		}
+	}
+	for name := range existing {
+		changes["removed"] = append(changes["removed"], name)
+		p.stopLoop(name)
+	}
+	sort.Strings(changes["removed"])
+	p.collectorsList = collectorsList
+	p.logger.Log(reporting.Info, "Reloaded collectors", reporting.Fields{
+		"added":   changes["added"],
+		"updated": changes["updated"],
+		"removed": changes["removed"],
+	})
+	return nil
+}
+
+// startLoop starts populating the collector if PopulateImageDB is running.
+// This must be called with the mutex held
+// @param previous - optional loop to wait for, so that a collector isn't
+// populated twice at once
+func (p *ImagePopulator) startLoop(c collectors.ImageCollector, previous *collectorLoop) {
+	if p.running == nil {
+		return
+	}
+	loop := &collectorLoop{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	p.loops[c.GetConfig().GetCollectorName()] = loop
+	running := p.running
+	running.loops.Add(1)
+	go func() {
+		defer running.loops.Done()
+		defer close(loop.done)
+		if previous != nil {
+			<-previous.done
+		}
+		p.startPopulating(running.ctx, running.db, c, loop.stop)
+	}()
+}
+
+// stopLoop stops populating the collector once its current population has
+// finished. This returns the stopped loop, or nil if it wasn't running. This
+// must be called with the mutex held
+func (p *ImagePopulator) stopLoop(name string) *collectorLoop {
+	loop, ok := p.loops[name]
+	if !ok {
+		return nil
+	}
+	close(loop.stop)
+	delete(p.loops, name)
+	return loop
+}
+
 // PopulateImageDBWithLoc will populate the database with images at this
-// specific location
-func (p *ImagePopulator) PopulateImageDBWithLoc(db hanapi.DatabaseInterface, lat float64, lng float64) {
-	populateImageDBWithCollectors(db, p.getCollectors(), lat, lng, p.logger)
+// specific location, covering the region that it lies in. This returns early
+// if the context is cancelled
+func (p *ImagePopulator) PopulateImageDBWithLoc(ctx context.Context, db hanapi.DatabaseInterface, lat float64, lng float64) {
+	ctx, span := tracer.Start(ctx, "PopulateImageDBWithLoc")
+	defer span.End()
+	// collectors can keep writing after this returns, so they use their own
+	// session rather than the caller's, which may be closed by then
+	session := hanapi.WithContext(ctx, db.Copy())
+	region := hanapi.GetRegion(session, lat, lng)
+	if region == nil {
+		region = hanapi.NewRegion("", lat, lng, hanapi.RegionSize)
+	}
+	searches := &sync.WaitGroup{}
+	populateImageDBWithCollectors(ctx, session, p.getCollectors(), region,
+		p.logger.With(reporting.Fields{"region": region.Label()}),
+		p.recordError, searches)
+	p.inFlight.Add(1)
+	go func() {
+		defer p.inFlight.Done()
+		searches.Wait()
+		session.Close()
+	}()
+}
+
+// Wait blocks until collectors that are still running have returned and
+// written their images. Use this after cancelling population, before closing
+// the database
+func (p *ImagePopulator) Wait() {
+	p.inFlight.Wait()
 }
 
 // PopulateImageDB will populate the database with images using the regions
-// set in the database. This will return once each region has new images from
-// at least one collector
-func (p *ImagePopulator) PopulateImageDB(db hanapi.DatabaseInterface) {
-	regions := hanapi.GetRegions(db)
-	if len(regions) == 0 {
-		fmt.Println(`Warning: No regions were set, so San Francisco has been
-					added. Regions can be added to the 'region' collection in
-					the database or by querying locations using hanhttpserver`)
+// set in the database. Each collector keeps populating at its update
+// frequency until the context is cancelled. ErrNoCollectors is returned
+// straight away if none of the collectors are enabled
+func (p *ImagePopulator) PopulateImageDB(ctx context.Context, db hanapi.DatabaseInterface) error {
+	atLeastOneEnabled := false
+	for _, collector := range p.getCollectors() {
+		atLeastOneEnabled = atLeastOneEnabled || collector.GetConfig().IsEnabled()
+	}
+	if !atLeastOneEnabled {
+		return ErrNoCollectors
+	}
+	if len(hanapi.GetRegions(db)) == 0 {
+		p.logger.Log(reporting.Warn, "No regions were set, so San Francisco has "+
+			"been added. Regions can be added using hanctl or by querying "+
+			"locations using hanhttpserver", nil)
 		hanapi.AddRegion(db, sanFranciscoLat, sanFranciscoLng)
-		// query again
-		regions = hanapi.GetRegions(db)
+	}
+	running := &population{
+		ctx: ctx,
+		db:  db,
 	}
 
-	collectors := p.getCollectors()
-	var wg sync.WaitGroup
-	wg.Add(len(collectors))
-
-	atLeastOneEnabled := false
-	for _, collector := range collectors {
+	p.mutex.Lock()
+	p.running = running
+	for _, collector := range p.collectorsList {
 		if !collector.GetConfig().IsEnabled() {
 			continue
 		}
-		atLeastOneEnabled = true
-		go p.startPopulating(db, collector, regions)
-	}
-	if !atLeastOneEnabled {
-		panic(`No collectors enabled. Please go to hancollector/collectors/config and set
-			Enabled to true on at least one`)
+		p.startLoop(collector, nil)
 	}
-	// wait forever
-	wg.Wait()
+	p.mutex.Unlock()
+	// wait until cancelled
+	<-ctx.Done()
+	p.mutex.Lock()
+	p.running = nil
+	p.loops = map[string]*collectorLoop{}
+	p.mutex.Unlock()
+	running.loops.Wait()
+	return nil
 }
 
-func (p *ImagePopulator) startPopulating(db hanapi.DatabaseInterface,
+func (p *ImagePopulator) startPopulating(ctx context.Context,
+	db hanapi.DatabaseInterface,
 	c collectors.ImageCollector,
-	regions []hanapi.Location) {
-	p.populate(db, c, regions)
+	stop chan struct{}) {
+	select {
+	case <-stop:
+		// reloaded before it started
+		return
+	default:
+	}
+	p.populate(ctx, db, c)
 	// update the collector at its configured frequency
 	freq := c.GetConfig().GetUpdateFrequency() * time.Second
-	for _ = range time.NewTicker(freq).C {
-		p.populate(db, c, regions)
+	ticker := time.NewTicker(freq)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.populate(ctx, db, c)
+		}
 	}
 }
 
-func (p *ImagePopulator) populate(db hanapi.DatabaseInterface,
-	c collectors.ImageCollector,
-	regions []hanapi.Location) {
-	fmt.Println("Populating", c.GetConfig().GetCollectorName())
+func (p *ImagePopulator) populate(ctx context.Context,
+	db hanapi.DatabaseInterface,
+	c collectors.ImageCollector) {
+	name := c.GetConfig().GetCollectorName()
+	// each population is its own trace
+	ctx, span := tracer.Start(ctx, "populate", trace.WithAttributes(
+		attribute.String("collector", name),
+	))
+	defer span.End()
+	db = hanapi.WithContext(ctx, db)
+	// regions are read each time, so that regions created, disabled or
+	// deleted while running are picked up. Disabled regions are not populated
+	regions := hanapi.GetActiveRegions(db)
+	span.SetAttributes(attribute.Int("regions", len(regions)))
+	logger := p.logger.With(reporting.Fields{"collector": name})
+	logger.Log(reporting.Info, "Populating", nil)
+	// the circuit may have become half-open since it was last populated
+	p.reportCircuit(c)
 	// update once at the start
 	for _, region := range regions {
+		if ctx.Err() != nil {
+			return
+		}
 		// populate the image db for this collector
-		populateImageDBWithCollectors(db,
+		populateImageDBWithCollectors(ctx, db,
 			[]collectors.ImageCollector{c},
-			region.Lat, region.Lng, p.logger)
+			&region, logger.With(reporting.Fields{"region": region.Label()}),
+			p.recordError, &p.inFlight)
 	}
+	p.reportCircuit(c)
+	p.reportQuota()
 }
 
 /*
 	Search through each collector at a specific location and
 	add them to the database
 	This will return when at least one image in this region is found
-	OR if all collectors fail
+	OR if all collectors fail OR if the context is cancelled
+	Errors are passed to onError, if it is set
+	Collectors that haven't finished are tracked by inFlight
 */
-func populateImageDBWithCollectors(db hanapi.DatabaseInterface,
-	collectorArr []collectors.ImageCollector, lat float64, lng float64,
-	logger reporting.Logger) {
+func populateImageDBWithCollectors(ctx context.Context,
+	db hanapi.DatabaseInterface,
+	collectorArr []collectors.ImageCollector, region *hanapi.Region,
+	logger reporting.Logger, onError func(collectorName string, err error),
+	inFlight *sync.WaitGroup) {
 	// use a channel to wait for first response, so that we can return without
-	// unnecessarily waiting for all collector
-	successChannel := make(chan int)
-	failureChannel := make(chan int)
-	atLeastOneEnabled := false
-	region := hanapi.NewLocation(lat, lng)
+	// unnecessarily waiting for all collector. These are buffered so that the
+	// remaining collectors don't block once we've returned
+	successChannel := make(chan int, len(collectorArr))
+	failureChannel := make(chan int, len(collectorArr))
+	// only enabled collectors respond, so they're all that's waited for
+	enabled := 0
+	location := region.Location()
 	for _, collector := range collectorArr {
 		if !collector.GetConfig().IsEnabled() {
 			continue
 		}
-		atLeastOneEnabled = true
+		enabled++
+		inFlight.Add(1)
 		go func(c collectors.ImageCollector) {
-			images, err := c.GetImages(lat, lng)
-			if err != nil {
+			defer inFlight.Done()
+			searchCtx, span := tracer.Start(ctx, "collector.GetImages", trace.WithAttributes(
+				attribute.String("collector", c.GetConfig().GetCollectorName()),
+				attribute.String("region", region.Label()),
+			))
+			defer span.End()
+			db := hanapi.WithContext(searchCtx, db)
+			// cursors are only stored once the images they cover are
+			cursors := collectors.NewPendingCursors(db)
+			images, err := c.GetImages(searchCtx, region, cursors)
+			span.SetAttributes(attribute.Int("images", len(images)))
+			// cancellation isn't the collector's fault
+			if err != nil && ctx.Err() == nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
 				reportError(err, c.GetConfig().GetCollectorName(), logger)
-				failureChannel <- 1
-				return
+				if onError != nil {
+					onError(c.GetConfig().GetCollectorName(), err)
+				}
 			}
-			db.AddBulkImagesToRegion(images, region)
 			// only succeed if at least one image was found
 			if len(images) > 0 {
+				// images found before an error or cancellation are still
+				// kept
+				db.AddBulkImagesToRegion(images, location)
+				cursors.Commit()
+				metrics.ImagesIngested.WithLabelValues(
+					c.GetConfig().GetCollectorName(), region.Label(),
+				).Add(float64(len(images)))
 				successChannel <- 1
 			} else {
+				// there's nothing to store, so no images can be skipped
+				cursors.Commit()
 				// consider retrieving no images a failure
 				failureChannel <- 1
 			}
 		}(collector)
 	}
 
-	if !atLeastOneEnabled {
-		panic(`No collectors enabled. Please go to hancollector/collectors/config and set
-			Enabled to true on at least one`)
+	if enabled == 0 {
+		// nothing to wait for
+		return
 	}
 	failures := 0
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-successChannel:
 			return
 		case <-failureChannel:
 			failures++
 			// wait for all failures until we give up
-			if failures >= len(collectorArr) {
+			if failures >= enabled {
 				return
 			}
 		}
@@ -163,8 +532,19 @@ func populateImageDBWithCollectors(db hanapi.DatabaseInterface,
 }
 
 func reportError(err error, collectorName string, logger reporting.Logger) {
-	fmt.Fprintln(os.Stderr, collectorName, "Error:", err)
-	if logger != nil {
-		logger.Log(fmt.Sprintf("%s Error: %s", collectorName, err))
+	if logger == nil {
+		logger = reporting.Default()
+	}
+	message := "Collection failed"
+	kind := collectors.ClassifyError(err)
+	metrics.CollectorErrors.WithLabelValues(collectorName, kind.String()).Inc()
+	if kind == collectors.ErrorCredentials {
+		// the collector won't work again until its configuration is fixed
+		message = "Credentials were rejected, collection is paused until they're fixed"
 	}
+	logger.Log(reporting.Error, message, reporting.Fields{
+		"collector": collectorName,
+		"error":     err,
+		"kind":      kind.String(),
+	})
 }
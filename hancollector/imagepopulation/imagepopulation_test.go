@@ -1,11 +1,19 @@
 package imagepopulation
 
 import (
+	"context"
 	"errors"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
+	"github.com/oliveroneill/hanserver/hanapi/reporting"
 	"github.com/oliveroneill/hanserver/hancollector/collectors"
 	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -13,22 +21,56 @@ import (
 
 type MockDB struct {
 	Images  []hanapi.ImageData
-	regions []hanapi.Location
+	regions []hanapi.Region
 	lock    sync.Mutex
+	// set once closed, images written afterwards are counted
+	closed           bool
+	writesAfterClose int
+	// the amount of images stored when each cursor was set
+	cursorWrites []int
 }
 
-func NewMockDB(regions []hanapi.Location) *MockDB {
+func NewMockDB(regions []hanapi.Region) *MockDB {
 	c := new(MockDB)
 	c.regions = regions
 	c.Images = []hanapi.ImageData{}
 	return c
 }
 
-func (c *MockDB) GetRegions() []hanapi.Location {
+func (c *MockDB) GetRegions() []hanapi.Region {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.regions
 }
 
-func (c *MockDB) AddRegion(lat float64, lng float64) {
+func (c *MockDB) setRegions(regions []hanapi.Region) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.regions = regions
+}
+
+func (c *MockDB) GetRegionByID(id string) (*hanapi.Region, error) {
+	return nil, hanapi.ErrRegionNotFound
+}
+
+func (c *MockDB) GetNearestRegion(lat float64, lng float64) *hanapi.Region {
+	return nil
+}
+
+func (c *MockDB) GetRegionsWithin(lat float64, lng float64, radius float64) []hanapi.Region {
+	return []hanapi.Region{}
+}
+
+func (c *MockDB) AddRegion(region hanapi.Region) error {
+	return nil
+}
+
+func (c *MockDB) UpdateRegion(region hanapi.Region) error {
+	return nil
+}
+
+func (c *MockDB) DeleteRegion(id string) error {
+	return nil
 }
 
 func (c *MockDB) AddImage(image hanapi.ImageData) {
@@ -37,6 +79,9 @@ func (c *MockDB) AddImage(image hanapi.ImageData) {
 func (c *MockDB) AddBulkImagesToRegion(images []hanapi.ImageData,
 	region *hanapi.Location) {
 	c.lock.Lock()
+	if c.closed {
+		c.writesAfterClose++
+	}
 	for _, image := range images {
 		image.Region = region
 		c.Images = append(c.Images, image)
@@ -44,6 +89,14 @@ func (c *MockDB) AddBulkImagesToRegion(images []hanapi.ImageData,
 	c.lock.Unlock()
 }
 
+// images returns a copy of the stored images, since collectors may still be
+// writing
+func (c *MockDB) images() []hanapi.ImageData {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]hanapi.ImageData{}, c.Images...)
+}
+
 func (c *MockDB) GetImages(lat float64, lng float64, start int, end int) []hanapi.ImageData {
 	return []hanapi.ImageData{}
 }
@@ -54,23 +107,113 @@ func (c *MockDB) GetAllImages() []hanapi.ImageData {
 
 func (c *MockDB) DeleteOldImages(amount int) {}
 
+func (c *MockDB) GetCursor(collector string, region string, cell string) string {
+	return ""
+}
+
+func (c *MockDB) SetCursor(collector string, region string, cell string, cursor string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cursorWrites = append(c.cursorWrites, len(c.Images))
+}
+
+func (c *MockDB) AcquireQuery(key string, time int64, since int64, limit int) bool {
+	return true
+}
+
+func (c *MockDB) ReleaseQuery(key string, time int64) {}
+
+func (c *MockDB) CountQueries(key string, since int64) int {
+	return 0
+}
+
+func (c *MockDB) GetProviderQuota(key string) (int, int64) {
+	return -1, 0
+}
+
+func (c *MockDB) SetProviderQuota(key string, remaining int, reset int64) {}
+
+func (c *MockDB) TakeProviderQuota(key string, now int64) bool {
+	return true
+}
+
 func (c *MockDB) Size() int {
 	return 0
 }
 
+func (c *MockDB) CountImagesByRegion() map[hanapi.Location]int {
+	return map[hanapi.Location]int{}
+}
+
+func (c *MockDB) AddReport(report hanapi.Report) {}
+
+func (c *MockDB) CountReporters(imageID string) int {
+	return 0
+}
+
+func (c *MockDB) GetReportedImages(limit int) []hanapi.ReportedImage {
+	return []hanapi.ReportedImage{}
+}
+
+func (c *MockDB) ResolveReports(imageID string, status string) int {
+	return 0
+}
+
+func (c *MockDB) RestoreImage(id string) error {
+	return nil
+}
+
+func (c *MockDB) DeleteImage(id string) error {
+	return nil
+}
+
+func (c *MockDB) AddModerationDecision(decision hanapi.ModerationDecision) {}
+
+func (c *MockDB) GetModerationDecisions(limit int) []hanapi.ModerationDecision {
+	return []hanapi.ModerationDecision{}
+}
+
+func (c *MockDB) Ping() error {
+	return nil
+}
+
+func (c *MockDB) EnsureIndexes() error {
+	return nil
+}
+
+func (c *MockDB) HasImage(id string) bool {
+	return false
+}
+
+func (c *MockDB) HasImageURL(url string) bool {
+	return false
+}
+
 func (c *MockDB) SoftDelete(id string, reason string) {}
 
 func (c *MockDB) Copy() hanapi.DatabaseInterface {
 	return c
 }
 
-func (c *MockDB) Close() {}
+func (c *MockDB) Close() {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+}
 
 type MockCollector struct {
 	collectors.ImageCollector
 	images      []hanapi.ImageData
 	sleepDelay  time.Duration
 	shouldError bool
+	disabled    bool
+	// if set, GetImages blocks until this is closed
+	release chan struct{}
+	// set as the region's cursor when searching, if it's not empty
+	cursor string
+	// the labels of regions that were searched
+	searched []string
+	lock     sync.Mutex
 }
 
 /**
@@ -88,10 +231,11 @@ func NewMockCollector(sleepDelay time.Duration, images []hanapi.ImageData, shoul
 
 type MockConfig struct {
 	config.CollectorConfig
+	disabled bool
 }
 
 func (c *MockConfig) IsEnabled() bool {
-	return true
+	return !c.disabled
 }
 func (c *MockConfig) GetCollectorName() string {
 	return ""
@@ -100,13 +244,23 @@ func (c *MockConfig) GetCollectorName() string {
 func (c *MockCollector) GetConfig() config.CollectorConfiguration {
 	return &MockConfig{
 		CollectorConfig: config.CollectorConfig{},
+		disabled:        c.disabled,
 	}
 }
 
-func (c *MockCollector) GetImages(lat float64, lng float64) ([]hanapi.ImageData, error) {
+func (c *MockCollector) GetImages(ctx context.Context, region *hanapi.Region, cursors collectors.CursorStore) ([]hanapi.ImageData, error) {
 	if c.sleepDelay > 0 {
 		time.Sleep(c.sleepDelay)
 	}
+	if c.release != nil {
+		<-c.release
+	}
+	c.lock.Lock()
+	c.searched = append(c.searched, region.Label())
+	c.lock.Unlock()
+	if len(c.cursor) > 0 {
+		cursors.SetCursor("mock", region.Label(), "cell", c.cursor)
+	}
 	if c.shouldError {
 		return nil, errors.New("Mock error")
 	}
@@ -126,37 +280,419 @@ func TestPopulateImageDB(t *testing.T) {
 		*hanapi.NewImage("caption string3", 10, "", "", "", 56, 233, "", "", "", ""),
 		*hanapi.NewImage("dsgjsdk3", 104, "", "", "", 56, 32, "", "", "", ""),
 	}
+	// the slower collectors are blocked until the first has been stored
+	second := NewMockCollector(0, secondImages, false)
+	second.release = make(chan struct{})
+	third := NewMockCollector(0, thirdImages, false)
+	third.release = make(chan struct{})
 	collectorArray := []collectors.ImageCollector{
-		NewMockCollector(1*time.Millisecond, []hanapi.ImageData{}, true),
-		NewMockCollector(3*time.Millisecond, thirdImages, false),
-		NewMockCollector(0*time.Millisecond, firstImages, false),
-		NewMockCollector(1*time.Millisecond, secondImages, false),
+		NewMockCollector(0, []hanapi.ImageData{}, true),
+		third,
+		NewMockCollector(0, firstImages, false),
+		second,
 	}
-	mockDB := NewMockDB([]hanapi.Location{})
+	mockDB := NewMockDB([]hanapi.Region{})
 	region := hanapi.NewLocation(45, 66)
-	populateImageDBWithCollectors(mockDB, collectorArray, region.Lat, region.Lng, nil)
-	if len(mockDB.Images) != len(firstImages) {
-		t.Error("Expected", len(mockDB.Images), "to equal", len(firstImages))
-	}
+	inFlight := &sync.WaitGroup{}
+	populateImageDBWithCollectors(context.Background(), mockDB, collectorArray,
+		hanapi.NewRegion("", region.Lat, region.Lng, 0), nil, nil, inFlight)
 	// set regions so that images are equal
-	for i := 0; i < len(firstImages); i++ {
-		firstImages[i].Region = region
+	expected := withRegion(firstImages, region)
+	if stored := mockDB.images(); !reflect.DeepEqual(stored, expected) {
+		t.Error("Expected", stored, "to equal", expected)
+	}
+	// wait for the remaining collectors
+	close(second.release)
+	close(third.release)
+	inFlight.Wait()
+	expected = append(expected, withRegion(secondImages, region)...)
+	expected = append(expected, withRegion(thirdImages, region)...)
+	if stored := byCaption(mockDB.images()); !reflect.DeepEqual(stored, byCaption(expected)) {
+		t.Error("Expected", stored, "to equal", expected)
+	}
+}
+
+// withRegion returns a copy of the images with the region set, the originals
+// may still be read by collectors
+func withRegion(images []hanapi.ImageData, region *hanapi.Location) []hanapi.ImageData {
+	result := []hanapi.ImageData{}
+	for _, image := range images {
+		image.Region = region
+		result = append(result, image)
+	}
+	return result
+}
+
+// byCaption sorts the images, for comparing images stored in any order
+func byCaption(images []hanapi.ImageData) []hanapi.ImageData {
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Caption < images[j].Caption
+	})
+	return images
+}
+
+func TestPopulateImageDBWithLocClosesAfterCollectors(t *testing.T) {
+	images := []hanapi.ImageData{
+		*hanapi.NewImage("caption string", 10, "", "", "", 56, 33, "", "", "", ""),
+	}
+	p := &ImagePopulator{
+		collectorsList: []collectors.ImageCollector{
+			NewMockCollector(0, images, false),
+			NewMockCollector(20*time.Millisecond, images, false),
+		},
+		logger:     reporting.Default(),
+		lastErrors: map[string]*CollectorError{},
+	}
+	mockDB := NewMockDB([]hanapi.Region{})
+	// returns after the first collector, while the second is still running
+	p.PopulateImageDBWithLoc(context.Background(), mockDB, 45, 66)
+	p.Wait()
+	mockDB.lock.Lock()
+	defer mockDB.lock.Unlock()
+	if !mockDB.closed {
+		t.Error("Expected the population's session to be closed")
+	}
+	if mockDB.writesAfterClose != 0 {
+		t.Error("Expected no writes after closing but was", mockDB.writesAfterClose)
+	}
+	if len(mockDB.Images) != 2 {
+		t.Error("Expected 2 images but was", len(mockDB.Images))
+	}
+}
+
+func TestPopulateImageDBIgnoresDisabledCollectors(t *testing.T) {
+	disabled := NewMockCollector(0, []hanapi.ImageData{}, false)
+	disabled.disabled = true
+	collectorArray := []collectors.ImageCollector{
+		NewMockCollector(0, []hanapi.ImageData{}, false),
+		disabled,
+	}
+	mockDB := NewMockDB([]hanapi.Region{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		populateImageDBWithCollectors(context.Background(), mockDB, collectorArray,
+			hanapi.NewRegion("", 45, 66, 0), nil, nil, &sync.WaitGroup{})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected to return once the enabled collector found nothing")
+	}
+}
+
+func TestPopulateImageDBStoresCursorsAfterImages(t *testing.T) {
+	images := []hanapi.ImageData{
+		*hanapi.NewImage("caption string", 10, "", "", "", 56, 33, "", "", "", ""),
+	}
+	collector := NewMockCollector(0, images, false)
+	collector.cursor = "cursor"
+	mockDB := NewMockDB([]hanapi.Region{})
+	populateImageDBWithCollectors(context.Background(), mockDB,
+		[]collectors.ImageCollector{collector}, hanapi.NewRegion("", 45, 66, 0),
+		nil, nil, &sync.WaitGroup{})
+	mockDB.lock.Lock()
+	defer mockDB.lock.Unlock()
+	// otherwise the images would be skipped if they failed to be stored
+	if !reflect.DeepEqual(mockDB.cursorWrites, []int{1}) {
+		t.Error("Expected the cursor to be set after storing images but was",
+			mockDB.cursorWrites)
+	}
+}
+
+func TestPopulateImageDBStopsWhenCancelled(t *testing.T) {
+	images := []hanapi.ImageData{
+		*hanapi.NewImage("caption string", 10, "", "", "", 56, 33, "", "", "", ""),
+	}
+	collector := NewMockCollector(0, images, false)
+	collector.release = make(chan struct{})
+	collectorArray := []collectors.ImageCollector{collector}
+	mockDB := NewMockDB([]hanapi.Region{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	inFlight := &sync.WaitGroup{}
+	// the collector is blocked until released, so this can only return
+	// because of the cancellation
+	populateImageDBWithCollectors(ctx, mockDB, collectorArray,
+		hanapi.NewRegion("", 45, 66, 0), nil, nil, inFlight)
+	if len(mockDB.images()) != 0 {
+		t.Error("Expected to return before the collector finished")
+	}
+	// images that are still being collected are written before shutting down
+	close(collector.release)
+	inFlight.Wait()
+	if len(mockDB.images()) != len(images) {
+		t.Error("Expected", len(images), "images but was", len(mockDB.images()))
+	}
+}
+
+func TestPopulateImageDBRecordsMetrics(t *testing.T) {
+	images := []hanapi.ImageData{
+		*hanapi.NewImage("caption string", 10, "", "", "", 56, 33, "", "", "", ""),
+		*hanapi.NewImage("dsgjsdk", 104, "", "", "", 5336, 3, "", "", "", ""),
+	}
+	collectorArray := []collectors.ImageCollector{
+		NewMockCollector(0, []hanapi.ImageData{}, true),
+		NewMockCollector(0, images, false),
+	}
+	ingested := metrics.ImagesIngested.WithLabelValues("", "Metrics")
+	failed := metrics.CollectorErrors.WithLabelValues("", collectors.ErrorPermanent.String())
+	ingestedBefore := testutil.ToFloat64(ingested)
+	failedBefore := testutil.ToFloat64(failed)
+	inFlight := &sync.WaitGroup{}
+	populateImageDBWithCollectors(context.Background(), NewMockDB([]hanapi.Region{}),
+		collectorArray, hanapi.NewRegion("Metrics", 45, 66, 0), nil, nil, inFlight)
+	inFlight.Wait()
+	if count := testutil.ToFloat64(ingested) - ingestedBefore; count != float64(len(images)) {
+		t.Error("Expected", len(images), "images to be counted but was", count)
+	}
+	if count := testutil.ToFloat64(failed) - failedBefore; count != 1 {
+		t.Error("Expected 1 error to be counted but was", count)
+	}
+}
+
+func TestPopulateImageDBTracesCollectors(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	images := []hanapi.ImageData{
+		*hanapi.NewImage("caption string", 10, "", "", "", 56, 33, "", "", "", ""),
+	}
+	inFlight := &sync.WaitGroup{}
+	populateImageDBWithCollectors(context.Background(), NewMockDB([]hanapi.Region{}),
+		[]collectors.ImageCollector{NewMockCollector(0, images, false)},
+		hanapi.NewRegion("Traced", 45, 66, 0), nil, nil, inFlight)
+	inFlight.Wait()
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	search, ok := spans["collector.GetImages"]
+	if !ok {
+		t.Fatal("Expected a span for the collector but was", spans)
+	}
+	attributes := map[string]string{}
+	for _, attribute := range search.Attributes() {
+		attributes[string(attribute.Key)] = attribute.Value.Emit()
+	}
+	if attributes["region"] != "Traced" || attributes["images"] != "1" {
+		t.Error("Unexpected attributes", attributes)
+	}
+	write, ok := spans["db.AddBulkImagesToRegion"]
+	if !ok || write.Parent().SpanID() != search.SpanContext().SpanID() {
+		t.Error("Expected images to be written within the collector's span but was", spans)
+	}
+}
+
+func newLocalConfig(name string, directory string) *config.LocalConfiguration {
+	c := config.NewLocalConfig()
+	c.CollectorName = name
+	c.Enabled = true
+	c.Directory = directory
+	return c
+}
+
+func (p *ImagePopulator) runningLoops() map[string]*collectorLoop {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	loops := map[string]*collectorLoop{}
+	for name, loop := range p.loops {
+		loops[name] = loop
+	}
+	return loops
+}
+
+func TestPopulateRereadsRegions(t *testing.T) {
+	p, err := NewImagePopulator(config.CollectionConfig{
+		"local": newLocalConfig("local", t.TempDir()),
+	}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	collector := NewMockCollector(0, []hanapi.ImageData{}, false)
+	mockDB := NewMockDB([]hanapi.Region{*hanapi.NewRegion("first", 45, 66, 0)})
+	p.populate(context.Background(), mockDB, collector)
+	// regions changed by the admin API or hanctl are used on the next update
+	disabled := hanapi.NewRegion("disabled", 10, 10, 0)
+	disabled.Disabled = true
+	mockDB.setRegions([]hanapi.Region{*hanapi.NewRegion("second", 45, 66, 0), *disabled})
+	p.populate(context.Background(), mockDB, collector)
+	p.Wait()
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	expected := []string{"first", "second"}
+	if !reflect.DeepEqual(collector.searched, expected) {
+		t.Error("Expected", expected, "but was", collector.searched)
+	}
+}
+
+func TestNewImagePopulatorUnknownType(t *testing.T) {
+	_, err := NewImagePopulator(config.CollectionConfig{
+		"unknown": &config.CollectorConfig{CollectorName: "unknown", CollectorType: "unknown"},
+	}, nil)
+	if err == nil {
+		t.Error("Expected an error for an unknown collector type")
+	}
+}
+
+func TestPopulateImageDBWithoutEnabledCollectors(t *testing.T) {
+	p, err := NewImagePopulator(config.CollectionConfig{
+		"feed": config.NewFeedConfig(),
+	}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	mockDB := NewMockDB([]hanapi.Region{})
+	err = p.PopulateImageDB(context.Background(), mockDB)
+	if err != ErrNoCollectors {
+		t.Error("Expected", ErrNoCollectors, "but was", err)
+	}
+	if len(p.runningLoops()) != 0 {
+		t.Error("Expected nothing to be running but was", p.runningLoops())
+	}
+}
+
+func TestReload(t *testing.T) {
+	directory := t.TempDir()
+	p, err := NewImagePopulator(config.CollectionConfig{
+		"local": newLocalConfig("local", directory),
+		"feed":  config.NewFeedConfig(),
+	}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	local := p.getCollectors()[1]
+	err = p.Reload(config.CollectionConfig{
+		"local":     newLocalConfig("local", directory),
+		"wikimedia": config.NewWikimediaConfig(),
+	})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	updated := p.getCollectors()
+	names := []string{}
+	for _, c := range updated {
+		names = append(names, c.GetConfig().GetCollectorName())
+	}
+	expected := []string{"local", "wikimedia"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatal("Expected", expected, "but was", names)
+	}
+	// unchanged collectors are kept
+	if updated[0] != local {
+		t.Error("Expected local collector to be kept")
+	}
+	// configurations without enabled collectors are rejected
+	err = p.Reload(config.CollectionConfig{"feed": config.NewFeedConfig()})
+	if err == nil {
+		t.Error("Expected error when no collectors are enabled")
+	}
+	if len(p.getCollectors()) != 2 {
+		t.Error("Expected collectors to be kept but was", p.getCollectors())
+	}
+}
+
+// circuitCollector has a fixed circuit state
+type circuitCollector struct {
+	*MockCollector
+	circuit collectors.CircuitState
+}
+
+func (c *circuitCollector) CircuitState() collectors.CircuitState {
+	return c.circuit
+}
+
+func TestReady(t *testing.T) {
+	closed := &circuitCollector{NewMockCollector(0, nil, false), collectors.CircuitClosed}
+	open := &circuitCollector{NewMockCollector(0, nil, false), collectors.CircuitOpen}
+	p := &ImagePopulator{collectorsList: []collectors.ImageCollector{open, closed}}
+	if err := p.Ready(); err != nil {
+		t.Error("Expected ready but was", err)
+	}
+	p = &ImagePopulator{collectorsList: []collectors.ImageCollector{open}}
+	if err := p.Ready(); err == nil {
+		t.Error("Expected error when every collector has failed")
+	}
+	p = &ImagePopulator{}
+	if err := p.Ready(); err == nil {
+		t.Error("Expected error without collectors")
+	}
+}
+
+func TestCollectorStatesIncludeLastError(t *testing.T) {
+	failing := NewMockCollector(0, []hanapi.ImageData{}, true)
+	p := &ImagePopulator{
+		collectorsList: []collectors.ImageCollector{failing},
+		lastErrors:     map[string]*CollectorError{},
+	}
+	if states := p.CollectorStates(); states[0].LastError != nil {
+		t.Error("Expected no error before populating but was", states[0].LastError)
+	}
+	inFlight := &sync.WaitGroup{}
+	populateImageDBWithCollectors(context.Background(), NewMockDB([]hanapi.Region{}),
+		p.collectorsList, hanapi.NewRegion("", 45, 66, 0), nil, p.recordError, inFlight)
+	inFlight.Wait()
+	lastError := p.CollectorStates()[0].LastError
+	if lastError == nil || lastError.Error != "Mock error" {
+		t.Error("Expected the collector's error but was", lastError)
+	}
+}
+
+func TestReloadWhilePopulating(t *testing.T) {
+	directory := t.TempDir()
+	p, err := NewImagePopulator(config.CollectionConfig{
+		"local": newLocalConfig("local", directory),
+	}, nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	mockDB := NewMockDB([]hanapi.Region{*hanapi.NewRegion("", 45, 66, 0)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.PopulateImageDB(ctx, mockDB)
+	}()
+	for len(p.runningLoops()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	first := p.runningLoops()["local"]
+	changed := newLocalConfig("local", directory)
+	changed.UpdateFrequency = 60
+	err = p.Reload(config.CollectionConfig{
+		"local":  changed,
+		"photos": newLocalConfig("photos", directory),
+	})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	loops := p.runningLoops()
+	if len(loops) != 2 || loops["photos"] == nil {
+		t.Fatal("Expected the added collector to be started but was", loops)
+	}
+	// changed collectors are restarted once their current population ends
+	if loops["local"] == first {
+		t.Error("Expected the changed collector to be restarted")
 	}
-	for i := 0; i < len(secondImages); i++ {
-		secondImages[i].Region = region
+	select {
+	case <-first.done:
+	case <-time.After(time.Second):
+		t.Error("Expected the previous loop to stop")
 	}
-	for i := 0; i < len(thirdImages); i++ {
-		thirdImages[i].Region = region
+	err = p.Reload(config.CollectionConfig{
+		"photos": newLocalConfig("photos", directory),
+	})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
 	}
-	if !reflect.DeepEqual(mockDB.Images, firstImages) {
-		t.Error("Expected", mockDB.Images, "to equal", firstImages)
+	if _, ok := p.runningLoops()["local"]; ok {
+		t.Error("Expected the removed collector to be stopped")
 	}
-	// TODO: shouldn't rely on timings
-	time.Sleep(10 * time.Millisecond)
-	allImages := firstImages
-	allImages = append(allImages, secondImages...)
-	allImages = append(allImages, thirdImages...)
-	if !reflect.DeepEqual(mockDB.Images, allImages) {
-		t.Error("Expected", mockDB.Images, "to equal", allImages)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected population to stop once cancelled")
 	}
 }
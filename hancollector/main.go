@@ -1,45 +1,107 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
 	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"github.com/oliveroneill/hanserver/hanapi/settings"
 	"github.com/oliveroneill/hanserver/hancollector/imagepopulation"
 	"gopkg.in/alecthomas/kingpin.v2"
-	"io"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	configPath := kingpin.Arg("config", "Config file for data collection.").Required().String()
+	configPath := kingpin.Arg("config", "Config file, settings can also be set using environment variables.").String()
+	mongoURL := kingpin.Flag("mongo", "Specify the MongoDB URL").String()
 	slackAPIToken := kingpin.Flag("slacktoken", "Specify the API token for logging through Slack").String()
 	kingpin.Parse()
 
-	// connect to mongo
-	db := hanapi.NewMongoInterface()
-
 	// parse config
-	config := configToString(*configPath)
-
-	logger := reporting.NewSlackLogger(*slackAPIToken)
-	populator := imagepopulation.NewImagePopulator(config, logger)
-	// call it once before starting the timer
-	populator.PopulateImageDB(db)
-}
+	load := func() (*settings.Config, error) {
+		return settings.Load(*configPath, func(c *settings.Config) {
+			settings.SetString(&c.Storage.MongoURL, *mongoURL)
+			settings.SetString(&c.Logging.SlackToken, *slackAPIToken)
+			// no_collection is for hanhttpserver, so a shared configuration
+			// still needs a collector enabled here
+			c.HTTP.NoCollection = false
+		})
+	}
+	c, err := load()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-func configToString(path string) string {
-	buf := bytes.NewBuffer(nil)
-	f, err := os.Open(path)
-	defer f.Close()
+	logger := c.Logging.NewLogger()
+	reporting.SetDefault(logger)
+	stopTracing, err := c.Tracing.Start("hancollector")
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	io.Copy(buf, f)
+
+	populator, err := imagepopulation.NewImagePopulator(c.Collectors, logger)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	return string(buf.Bytes())
+	// connect to mongo
+	db := hanapi.NewMongoInterfaceWithURL(c.Storage.MongoURL)
+
+	// quotas are shared with any other collectors or servers
+	populator.UseQuotaStore(db)
+	// stop collecting when interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	metrics.RegisterDatabaseSize(func() int {
+		session := db.Copy()
+		defer session.Close()
+		return session.Size()
+	})
+	if len(c.Metrics.Address) > 0 {
+		go func() {
+			if err := metrics.Serve(ctx, c.Metrics.Address); err != nil {
+				logger.Log(reporting.Error, "Metrics server failed",
+					reporting.Fields{"error": err})
+			}
+		}()
+	}
+	// collectors are reloaded when the config file changes or on SIGHUP
+	reload := func() {
+		c, err := load()
+		if err == nil {
+			err = populator.Reload(c.Collectors)
+		}
+		if err != nil {
+			logger.Log(reporting.Error, "Configuration wasn't reloaded",
+				reporting.Fields{"error": err})
+		}
+	}
+	go settings.Watch(ctx, *configPath, settings.WatchInterval, reload)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reload()
+		}
+	}()
+	// call it once before starting the timer
+	if err := populator.PopulateImageDB(ctx, db); err != nil {
+		logger.Log(reporting.Error, "Image collection couldn't start",
+			reporting.Fields{"error": err})
+	}
+	logger.Log(reporting.Info, "Shutting down", nil)
+	// write any images that are still being collected
+	populator.Wait()
+	db.Close()
+	if err := stopTracing(); err != nil {
+		logger.Log(reporting.Warn, "Spans weren't exported before shutting down",
+			reporting.Fields{"error": err})
+	}
+	// send any batched log entries
+	logger.Close()
 }
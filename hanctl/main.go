@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	app      = kingpin.New("hanctl", "Manage a han server's database.")
+	mongoURL = app.Flag("mongo", "Address of the mongo server").Default("mongodb").Envar("HAN_MONGO_URL").String()
+
+	regions = app.Command("regions", "Manage the regions that are populated with images.")
+
+	listRegions = regions.Command("list", "List all regions.")
+
+	addRegion       = regions.Command("add", "Add a new region.")
+	addRegionName   = addRegion.Arg("name", "Name of the region.").Required().String()
+	addRegionLat    = addRegion.Arg("lat", "Latitude of the region's centre.").Required().Float64()
+	addRegionLng    = addRegion.Arg("lng", "Longitude of the region's centre.").Required().Float64()
+	addRegionRadius = addRegion.Flag("radius", "Radius of the region in meters.").Float64()
+
+	renameRegion     = regions.Command("rename", "Rename a region.")
+	renameRegionID   = renameRegion.Arg("id", "ID of the region.").Required().String()
+	renameRegionName = renameRegion.Arg("name", "New name of the region.").Required().String()
+
+	disableRegion   = regions.Command("disable", "Stop populating a region.")
+	disableRegionID = disableRegion.Arg("id", "ID of the region.").Required().String()
+
+	enableRegion   = regions.Command("enable", "Resume populating a disabled region.")
+	enableRegionID = enableRegion.Arg("id", "ID of the region.").Required().String()
+
+	deleteRegion   = regions.Command("delete", "Delete a region.")
+	deleteRegionID = deleteRegion.Arg("id", "ID of the region.").Required().String()
+
+	importRegions       = regions.Command("import", "Add regions from a CSV or GeoJSON file.")
+	importRegionsPath   = importRegions.Arg("file", "CSV rows of name,lat,lng[,radius] or a GeoJSON FeatureCollection of points.").Required().ExistingFile()
+	importRegionsFormat = importRegions.Flag("format", "csv or geojson, defaults to the file extension").String()
+)
+
+func main() {
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	db := hanapi.NewMongoInterfaceWithURL(*mongoURL)
+	defer db.Close()
+
+	var region *hanapi.Region
+	var err error
+	switch command {
+	case listRegions.FullCommand():
+		printRegions(hanapi.GetRegions(db))
+		return
+	case addRegion.FullCommand():
+		region, err = hanapi.CreateRegion(db, *hanapi.NewRegion(*addRegionName,
+			*addRegionLat, *addRegionLng, *addRegionRadius))
+	case renameRegion.FullCommand():
+		region, err = hanapi.RenameRegion(db, *renameRegionID, *renameRegionName)
+	case disableRegion.FullCommand():
+		region, err = hanapi.SetRegionDisabled(db, *disableRegionID, true)
+	case enableRegion.FullCommand():
+		region, err = hanapi.SetRegionDisabled(db, *enableRegionID, false)
+	case deleteRegion.FullCommand():
+		err = hanapi.DeleteRegion(db, *deleteRegionID)
+	case importRegions.FullCommand():
+		var added int
+		added, err = importRegionFile(db, *importRegionsPath, *importRegionsFormat)
+		if err == nil {
+			fmt.Println("Added", added, "regions")
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if region != nil {
+		printRegions([]hanapi.Region{*region})
+	}
+}
+
+func importRegionFile(db hanapi.DatabaseInterface, path string, format string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if len(format) == 0 {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	var regions []hanapi.Region
+	switch format {
+	case "csv":
+		regions, err = hanapi.ParseRegionsCSV(f)
+	case "geojson", "json":
+		regions, err = hanapi.ParseRegionsGeoJSON(f)
+	default:
+		return 0, fmt.Errorf("unknown format %q, use --format", format)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return hanapi.ImportRegions(db, regions)
+}
+
+func printRegions(regions []hanapi.Region) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tLAT\tLNG\tRADIUS\tSTATUS")
+	for _, r := range regions {
+		status := "enabled"
+		if r.Disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%f\t%f\t%.0f\t%s\n", r.ID.Hex(), r.Name,
+			r.Lat, r.Lng, r.GetRadius(), status)
+	}
+	w.Flush()
+}
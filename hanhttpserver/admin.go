@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultListLimit is the amount of reports or decisions returned
+	// without a limit
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// StorageState is the database size compared to hancleaner's limits
+type StorageState struct {
+	Images int `json:"images"`
+	// images are cleared once there are more than this
+	ImageLimit int `json:"image_limit"`
+	// the amount of images cleared at a time
+	ClearCount int `json:"clear_count"`
+	// seconds between hancleaner's checks
+	Frequency int64 `json:"frequency"`
+}
+
+// adminHandler only allows requests that send the admin token as a bearer
+// token. Admin endpoints are disabled if no token has been set
+func (s *HanServer) adminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.adminToken) == 0 {
+			http.Error(w, "Admin endpoints are disabled.", 403)
+			return
+		}
+		// compared in constant time so the token can't be guessed by timing
+		authorization := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(authorization, []byte("Bearer "+s.adminToken)) != 1 {
+			http.Error(w, "Unauthorized.", 401)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *HanServer) regionsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	session := hanapi.WithContext(r.Context(), s.db.Copy())
+	defer session.Close()
+	var region *hanapi.Region
+	var err error
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(hanapi.GetRegions(session))
+		return
+	case "POST":
+		region, err = parseRegion(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		region, err = hanapi.CreateRegion(session, *region)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(201)
+	case "PUT":
+		id := r.FormValue("id")
+		if name := r.FormValue("name"); len(name) > 0 {
+			region, err = hanapi.RenameRegion(session, id, name)
+			if err != nil {
+				writeRegionError(w, err)
+				return
+			}
+		}
+		if disabled := r.FormValue("disabled"); len(disabled) > 0 {
+			value, parseErr := strconv.ParseBool(disabled)
+			if parseErr != nil {
+				http.Error(w, "Invalid disabled value", 400)
+				return
+			}
+			region, err = hanapi.SetRegionDisabled(session, id, value)
+			if err != nil {
+				writeRegionError(w, err)
+				return
+			}
+		}
+		if region == nil {
+			http.Error(w, "Nothing to update", 400)
+			return
+		}
+	case "DELETE":
+		err = hanapi.DeleteRegion(session, r.FormValue("id"))
+		if err != nil {
+			writeRegionError(w, err)
+		}
+		return
+	default:
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	json.NewEncoder(w).Encode(region)
+}
+
+// quotasAdminHandler returns the remaining budget of each collector endpoint
+func (s *HanServer) quotasAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	json.NewEncoder(w).Encode(s.populator.QuotaState())
+}
+
+// collectorsAdminHandler returns each collector and whether its circuit
+// breaker has stopped it querying
+func (s *HanServer) collectorsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	json.NewEncoder(w).Encode(s.populator.CollectorStates())
+}
+
+// reloadAdminHandler reads the configuration again and replaces the
+// collectors, returning their new state
+func (s *HanServer) reloadAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if err := s.reloadCollectors(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(s.populator.CollectorStates())
+}
+
+// regionStatsAdminHandler returns each region with its image count and when
+// it was last populated
+func (s *HanServer) regionStatsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	session := hanapi.WithContext(r.Context(), s.db.Copy())
+	defer session.Close()
+	json.NewEncoder(w).Encode(hanapi.GetRegionStats(session))
+}
+
+// reportsAdminHandler returns the moderation queue on GET, up to `limit`
+// images. POST moderates an image using `id`, `action`, `moderator` and an
+// optional `note`
+func (s *HanServer) reportsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	session := hanapi.WithContext(r.Context(), s.db.Copy())
+	defer session.Close()
+	switch r.Method {
+	case "GET":
+		limit, err := parseLimit(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		json.NewEncoder(w).Encode(hanapi.GetModerationQueue(session, limit))
+	case "POST":
+		id := r.FormValue("id")
+		if len(id) == 0 {
+			http.Error(w, "Invalid image ID", 400)
+			return
+		}
+		moderator := r.FormValue("moderator")
+		if len(moderator) == 0 {
+			http.Error(w, "Moderator is required", 400)
+			return
+		}
+		decision, err := hanapi.ModerateImage(session, id, r.FormValue("action"),
+			moderator, r.FormValue("note"), reporting.FromContext(r.Context()))
+		switch err {
+		case nil:
+			json.NewEncoder(w).Encode(decision)
+		case hanapi.ErrInvalidAction:
+			http.Error(w, err.Error(), 400)
+		case hanapi.ErrImageNotFound:
+			http.Error(w, "Image not found", 404)
+		default:
+			http.Error(w, err.Error(), 500)
+		}
+	default:
+		http.Error(w, "Invalid request method.", 405)
+	}
+}
+
+// moderationLogAdminHandler returns the most recent moderation decisions, up
+// to `limit`
+func (s *HanServer) moderationLogAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	limit, err := parseLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	session := hanapi.WithContext(r.Context(), s.db.Copy())
+	defer session.Close()
+	json.NewEncoder(w).Encode(hanapi.GetModerationLog(session, limit))
+}
+
+// storageAdminHandler returns the amount of images stored along with the
+// limits that hancleaner keeps the database within
+func (s *HanServer) storageAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	session := hanapi.WithContext(r.Context(), s.db.Copy())
+	defer session.Close()
+	json.NewEncoder(w).Encode(StorageState{
+		Images:     session.Size(),
+		ImageLimit: s.cleaning.ImageLimit,
+		ClearCount: s.cleaning.ClearCount,
+		Frequency:  s.cleaning.Frequency,
+	})
+}
+
+// parseLimit reads the optional `limit` of listed items
+func parseLimit(r *http.Request) (int, error) {
+	limitString := r.FormValue("limit")
+	if len(limitString) == 0 {
+		return defaultListLimit, nil
+	}
+	limit, err := strconv.Atoi(limitString)
+	if err != nil || limit <= 0 || limit > maxListLimit {
+		return 0, errors.New("Invalid limit")
+	}
+	return limit, nil
+}
+
+// parseRegion reads either a polygon or a lat, lng and optional radius
+func parseRegion(r *http.Request) (*hanapi.Region, error) {
+	name := r.FormValue("name")
+	if polygonString := r.FormValue("polygon"); len(polygonString) > 0 {
+		polygon := []hanapi.Location{}
+		err := json.Unmarshal([]byte(polygonString), &polygon)
+		if err != nil {
+			return nil, errors.New("Invalid polygon")
+		}
+		// an empty polygon would otherwise become a circle at 0, 0
+		if err := hanapi.ValidatePolygon(polygon); err != nil {
+			return nil, err
+		}
+		return hanapi.NewPolygonRegion(name, polygon), nil
+	}
+	lat, latErr := strconv.ParseFloat(r.FormValue("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(r.FormValue("lng"), 64)
+	if latErr != nil || lngErr != nil {
+		return nil, errors.New("Invalid location")
+	}
+	// radius is optional
+	radius, _ := strconv.ParseFloat(r.FormValue("radius"), 64)
+	return hanapi.NewRegion(name, lat, lng, radius), nil
+}
+
+func writeRegionError(w http.ResponseWriter, err error) {
+	if err == hanapi.ErrRegionNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	http.Error(w, err.Error(), 500)
+}
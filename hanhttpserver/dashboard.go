@@ -0,0 +1,28 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardPage is the admin dashboard, which loads everything it shows from
+// the admin endpoints using the token entered by the user
+//
+//go:embed admin/index.html
+var dashboardPage []byte
+
+// dashboardHandler serves the admin dashboard. The page itself doesn't
+// contain any data so it doesn't require the admin token, but it's hidden
+// when admin endpoints are disabled
+func (s *HanServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	if len(s.adminToken) == 0 {
+		http.Error(w, "Admin endpoints are disabled.", 403)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
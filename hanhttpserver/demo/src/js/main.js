@@ -31,7 +31,8 @@ window.onload = function () {
   window.currentViewer = viewer;
 };
 
-// region size is used to draw blue circles on the map for each region
+// default region size is used to draw blue circles on the map for regions
+// that don't specify a radius
 const regionSize = 5000;
 /**
  * Arrays used to keep track of marker on the map
@@ -111,8 +112,19 @@ function updateLoc(map, lat, lng) {
   xhttp.onreadystatechange = function() {
 	if (this.readyState == 4 && this.status == 200) {
 	  var regions = JSON.parse(this.responseText);
-	  // will draw a blue circle for each region
+	  // will draw a blue circle or polygon for each region
 	  for (var i = 0; i < regions.length; i++) {
+		if (regions[i].polygon) {
+		  var regionPolygon = new google.maps.Polygon({
+			strokeWeight: 0,
+			fillColor: '#0000FF',
+			fillOpacity: 0.35,
+			map: map,
+			paths: regions[i].polygon,
+			clickable: false
+		  });
+		  continue;
+		}
 		var cityCircle = new google.maps.Circle({
 		  strokeColor: '#0000FF',
 		  strokeOpacity: 0.8,
@@ -121,7 +133,7 @@ function updateLoc(map, lat, lng) {
 		  fillOpacity: 0.35,
 		  map: map,
 		  center: regions[i],
-		  radius: regionSize,
+		  radius: regions[i].radius || regionSize,
 		  clickable: false
 		});
 	  }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/oliveroneill/hanserver/hancollector/imagepopulation"
+	"net/http"
+	"time"
+)
+
+// checkTimeout is how long a readiness check can take before the component
+// is considered unavailable
+const checkTimeout = 2 * time.Second
+
+const (
+	statusOK       = "ok"
+	statusFailed   = "failed"
+	statusDisabled = "disabled"
+)
+
+var (
+	errUnreachable = errors.New("Database is unreachable")
+	errTimedOut    = errors.New("Timed out")
+)
+
+// ComponentStatus is the result of checking a single component
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// only set for the collectors component
+	Collectors []imagepopulation.CollectorState `json:"collectors,omitempty"`
+}
+
+// HealthResponse is returned by /healthz and /readyz
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+// newComponentStatus is failed if there was an error
+func newComponentStatus(err error) ComponentStatus {
+	if err != nil {
+		return ComponentStatus{Status: statusFailed, Error: err.Error()}
+	}
+	return ComponentStatus{Status: statusOK}
+}
+
+// checkDatabase pings the database and makes sure that its indexes have been
+// created. This stops waiting once the timeout has passed, since database
+// calls can't be cancelled
+func (s *HanServer) checkDatabase() map[string]ComponentStatus {
+	result := make(chan map[string]ComponentStatus, 1)
+	go func() {
+		session := s.db.Copy()
+		defer session.Close()
+		if err := session.Ping(); err != nil {
+			result <- map[string]ComponentStatus{
+				"mongo":   newComponentStatus(err),
+				"indexes": newComponentStatus(errUnreachable),
+			}
+			return
+		}
+		result <- map[string]ComponentStatus{
+			"mongo":   newComponentStatus(nil),
+			"indexes": newComponentStatus(session.EnsureIndexes()),
+		}
+	}()
+	select {
+	case components := <-result:
+		return components
+	case <-time.After(checkTimeout):
+		return map[string]ComponentStatus{
+			"mongo":   newComponentStatus(errTimedOut),
+			"indexes": newComponentStatus(errUnreachable),
+		}
+	}
+}
+
+// healthHandler is used to check that the process is alive, it doesn't check
+// any dependencies
+func (s *HanServer) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{Status: statusOK})
+}
+
+// readyHandler is used to check that the server can handle requests. The
+// database must be reachable with its indexes created and, unless collection
+// is disabled, at least one enabled collector mustn't have failed
+func (s *HanServer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	components := s.checkDatabase()
+	collectors := ComponentStatus{Status: statusDisabled}
+	if s.collecting {
+		collectors = newComponentStatus(s.populator.Ready())
+		collectors.Collectors = s.populator.CollectorStates()
+	}
+	components["collectors"] = collectors
+	response := HealthResponse{Status: statusOK, Components: components}
+	code := http.StatusOK
+	for _, c := range components {
+		if c.Status == statusFailed {
+			response.Status = statusFailed
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oliveroneill/hanserver/hanapi"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxIngestBodySize is the largest request body accepted by the ingestion
+// endpoint in bytes
+const maxIngestBodySize = 5 << 20
+
+// ingestBatch is used to accept either a single image or a batch of images
+type ingestBatch struct {
+	Images []hanapi.PushedImage `json:"images"`
+}
+
+// ingestHandler stores images pushed by partners. Requests must include the
+// partner's name in the `X-Han-Partner` header, the unix time that it was sent
+// in the `X-Han-Timestamp` header and an HMAC-SHA256 signature of the
+// timestamp and body, created using the partner's secret, in the
+// `X-Han-Signature` header. See `hanapi.SignPayload`
+func (s *HanServer) ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method.", 405)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodySize))
+	if err != nil {
+		http.Error(w, "Request body too large", 413)
+		return
+	}
+	partner := r.Header.Get("X-Han-Partner")
+	secret, ok := s.partners[partner]
+	if !ok || !hanapi.VerifySignature(secret, r.Header.Get("X-Han-Timestamp"), body,
+		r.Header.Get("X-Han-Signature")) {
+		http.Error(w, "Unauthorized.", 401)
+		return
+	}
+	images, err := parseIngestBody(body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	session := hanapi.WithContext(r.Context(), s.db.Copy())
+	defer session.Close()
+	result, err := hanapi.IngestImages(session, partner, images)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseIngestBody reads either a single image or an object containing a list
+// of `images`
+func parseIngestBody(body []byte) ([]hanapi.PushedImage, error) {
+	batch := ingestBatch{}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %s", err)
+	}
+	if batch.Images != nil {
+		return batch.Images, nil
+	}
+	image := hanapi.PushedImage{}
+	if err := json.Unmarshal(body, &image); err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %s", err)
+	}
+	return []hanapi.PushedImage{image}, nil
+}
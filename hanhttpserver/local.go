@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/oliveroneill/hanserver/hancollector/collectors"
+	"github.com/oliveroneill/hanserver/hancollector/collectors/config"
+	"net/http"
+	"strings"
+)
+
+// serveLocalPhotos replaces the handlers of local collectors' photos, this is
+// called again when collectors are reloaded
+func (s *HanServer) serveLocalPhotos(c config.CollectionConfig) {
+	mux := http.NewServeMux()
+	// settings reject paths that are used twice, this stops a duplicate from
+	// panicking if it gets through
+	served := map[string]bool{}
+	for _, name := range c.Names() {
+		localConfig, ok := c[name].(*config.LocalConfiguration)
+		if !ok || served[localConfig.ServePath()] {
+			continue
+		}
+		served[localConfig.ServePath()] = true
+		s.handleLocalPhotos(mux, localConfig)
+	}
+	s.localMutex.Lock()
+	s.localPhotos = mux
+	s.localMutex.Unlock()
+}
+
+// localPhotosHandler serves requests that don't match any other route using
+// the current local photo handlers
+func (s *HanServer) localPhotosHandler(w http.ResponseWriter, r *http.Request) {
+	s.localMutex.RLock()
+	mux := s.localPhotos
+	s.localMutex.RUnlock()
+	mux.ServeHTTP(w, r)
+}
+
+// handleLocalPhotos serves the photos and thumbnails found by the local
+// collector, at the path of the collector's base URL. Only files of images
+// that have been stored and aren't hidden are served, so photos without a
+// location and anything else in the directory stay private
+func (s *HanServer) handleLocalPhotos(mux *http.ServeMux, c *config.LocalConfiguration) {
+	if c == nil || !c.IsEnabled() || len(c.Directory) == 0 {
+		return
+	}
+	prefix := c.ServePath()
+	if len(prefix) == 0 {
+		return
+	}
+	photosPrefix := prefix + collectors.LocalPhotosPath
+	thumbnailsPrefix := prefix + collectors.LocalThumbnailsPath
+	mux.Handle(photosPrefix, http.StripPrefix(photosPrefix,
+		s.fileHandler(http.Dir(c.Directory), c.BaseURL, collectors.LocalPhotosPath)))
+	mux.Handle(thumbnailsPrefix, http.StripPrefix(thumbnailsPrefix,
+		s.fileHandler(http.Dir(c.GetThumbnailDirectory()), c.BaseURL, collectors.LocalThumbnailsPath)))
+}
+
+// fileHandler serves files that belong to a stored image, without listing
+// directories or serving hidden files
+func (s *HanServer) fileHandler(root http.FileSystem, baseURL string, filesPath string) http.Handler {
+	files := http.FileServer(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid request method.", 405)
+			return
+		}
+		if len(r.URL.Path) == 0 || strings.HasSuffix(r.URL.Path, "/") ||
+			strings.Contains(r.URL.Path, "/.") || strings.HasPrefix(r.URL.Path, ".") {
+			http.NotFound(w, r)
+			return
+		}
+		session := s.db.Copy()
+		stored := session.HasImageURL(collectors.LocalURL(baseURL, filesPath, r.URL.Path))
+		session.Close()
+		if !stored {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
+	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestIDHeader is used to match log entries with a request, this is
+// accepted from proxies and returned with each response
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength stops clients from filling logs with their own IDs
+const maxRequestIDLength = 64
+
+// tracer starts a span for each request
+var tracer = otel.Tracer("github.com/oliveroneill/hanserver/hanhttpserver")
+
+// statusRecorder keeps the status code written so that it can be logged
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// unmatchedRoute is the handler label of requests that no route handled, so
+// that unknown paths don't each get their own metrics
+const unmatchedRoute = "unmatched"
+
+// logRequests gives each request a logger with its request_id, which
+// handlers can get using `reporting.FromContext`, and logs each response.
+// Metrics are recorded using the route that matched the request, and each
+// request is traced as part of the caller's trace if there's a `traceparent`
+// header
+func (s *HanServer) logRequests(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if len(id) == 0 || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		_, route := mux.Handler(r)
+		if len(route) == 0 {
+			route = unmatchedRoute
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, methodLabel(r.Method)+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("request_id", id),
+			))
+		defer span.End()
+		fields := reporting.Fields{"request_id": id}
+		if span.SpanContext().IsValid() {
+			// so that logs can be found from a trace
+			fields["trace_id"] = span.SpanContext().TraceID().String()
+		}
+		logger := s.logger.With(fields)
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		start := time.Now()
+		mux.ServeHTTP(recorder, r.WithContext(reporting.NewContext(ctx, logger)))
+		duration := time.Since(start)
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		metrics.HTTPRequests.WithLabelValues(route, methodLabel(r.Method),
+			strconv.Itoa(recorder.status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(route).Observe(duration.Seconds())
+		level := reporting.Info
+		if recorder.status >= 500 {
+			level = reporting.Error
+		}
+		logger.Log(level, "Request", reporting.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      recorder.status,
+			"duration_ms": duration.Milliseconds(),
+		})
+	})
+}
+
+// methodLabel limits the methods recorded in metrics, since clients can send
+// any method
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,46 +1,131 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/oliveroneill/hanserver/hanapi"
+	"github.com/oliveroneill/hanserver/hanapi/metrics"
 	"github.com/oliveroneill/hanserver/hanapi/reporting"
+	"github.com/oliveroneill/hanserver/hanapi/settings"
 	"github.com/oliveroneill/hanserver/hancollector/imagepopulation"
 	"gopkg.in/alecthomas/kingpin.v2"
-	"io"
-	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"time"
+	"sync"
+	"syscall"
 )
 
 // HanServer is a http server that also populates the database periodically
 // This allows easy tracking of API usage
 type HanServer struct {
-	populator *imagepopulation.ImagePopulator
-	db        hanapi.DatabaseInterface
-	logger    reporting.Logger
+	populator  *imagepopulation.ImagePopulator
+	db         hanapi.DatabaseInterface
+	logger     reporting.Logger
+	adminToken string
+	// maps each partner that can push images to their secret
+	partners map[string]string
+	// stops background population
+	cancel context.CancelFunc
+	// closed once background population has stopped
+	populating chan struct{}
+	// reads the configuration again when collectors are reloaded
+	load func() (*settings.Config, error)
+	// whether images are collected in the background, see readyHandler
+	collecting bool
+	// hancleaner's limits, shown alongside the database size
+	cleaning settings.CleaningConfig
+	// decides when reported images are hidden
+	moderation hanapi.ModerationPolicy
+	// serves local collectors' photos, replaced when collectors are reloaded
+	localPhotos *http.ServeMux
+	localMutex  sync.RWMutex
 }
 
 // NewHanServer will create a new http server and start population
-// @param configString - json string specifying collector configuration
-// @param noCollection - set this to true if you don't want hancollector to
-//                       start
-// @param apiToken     - optional slack api token used for logging errors to
-//                       Slack
-func NewHanServer(configString string, noCollection bool, apiToken string) *HanServer {
+// @param c    - the server's configuration, see `settings.Load`
+// @param load - reads the configuration again when reloading collectors
+// @return an error if the collectors couldn't be created
+func NewHanServer(c *settings.Config, load func() (*settings.Config, error)) (*HanServer, error) {
+	logger := c.Logging.NewLogger()
+	populator, err := imagepopulation.NewImagePopulator(c.Collectors, logger)
+	if err != nil {
+		return nil, err
+	}
 	// this database session is kept onto over the lifetime of the server
-	db := hanapi.NewMongoInterface()
-	logger := reporting.NewSlackLogger(apiToken)
-	populator := imagepopulation.NewImagePopulator(configString, logger)
-	if !noCollection {
-		fmt.Println("Starting image collection")
-		// populate image db in the background
-		go populator.PopulateImageDB(db)
-	}
-	return &HanServer{populator: populator, db: db, logger: logger}
+	db := hanapi.NewMongoInterfaceWithURL(c.Storage.MongoURL)
+	// quotas are shared with any other servers or collectors
+	populator.UseQuotaStore(db)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &HanServer{
+		populator:  populator,
+		db:         db,
+		logger:     logger,
+		adminToken: c.HTTP.AdminToken,
+		partners:   c.HTTP.Partners,
+		cancel:     cancel,
+		populating: make(chan struct{}),
+		load:       load,
+		collecting: !c.HTTP.NoCollection,
+		cleaning:   c.Cleaning,
+		moderation: hanapi.ModerationPolicy{
+			ReportThreshold:  c.Moderation.ReportThreshold,
+			ReasonThresholds: c.Moderation.ReasonThresholds,
+		},
+	}
+	s.serveLocalPhotos(c.Collectors)
+	if c.HTTP.NoCollection {
+		close(s.populating)
+		return s, nil
+	}
+	logger.Log(reporting.Info, "Starting image collection", nil)
+	// populate image db in the background
+	go func() {
+		defer close(s.populating)
+		if err := populator.PopulateImageDB(ctx, db); err != nil {
+			logger.Log(reporting.Error, "Image collection couldn't start",
+				reporting.Fields{"error": err})
+		}
+	}()
+	return s, nil
+}
+
+// Close stops background population, waits for collectors to write their
+// images and then closes the database. This should be called once the http
+// server has stopped handling requests, the logger is left open so that
+// shutting down can still be logged
+func (s *HanServer) Close() {
+	s.cancel()
+	<-s.populating
+	s.populator.Wait()
+	s.db.Close()
+}
+
+// reloadCollectors reads the configuration again and replaces any collectors
+// that have changed. Other settings require a restart
+func (s *HanServer) reloadCollectors() error {
+	c, err := s.load()
+	if err == nil {
+		err = s.populator.Reload(c.Collectors)
+	}
+	if err == nil {
+		s.serveLocalPhotos(c.Collectors)
+	}
+	if err != nil {
+		s.logger.Log(reporting.Error, "Configuration wasn't reloaded",
+			reporting.Fields{"error": err})
+	}
+	return err
+}
+
+// databaseSize returns the amount of images stored, for metrics
+func (s *HanServer) databaseSize() int {
+	session := s.db.Copy()
+	defer session.Close()
+	return session.Size()
 }
 
 func (s *HanServer) imageSearchHandler(w http.ResponseWriter, r *http.Request) {
@@ -48,7 +133,7 @@ func (s *HanServer) imageSearchHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request method.", 405)
 		return
 	}
-	session := s.db.Copy()
+	session := hanapi.WithContext(r.Context(), s.db.Copy())
 	defer session.Close()
 	// for running locally with Javascript
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -77,7 +162,8 @@ func (s *HanServer) imageSearchHandler(w http.ResponseWriter, r *http.Request) {
 	// images
 	if !hanapi.ContainsRegion(session, lat, lng) {
 		hanapi.AddRegion(session, lat, lng)
-		s.populator.PopulateImageDBWithLoc(session, lat, lng)
+		// stop collecting if the client goes away
+		s.populator.PopulateImageDBWithLoc(r.Context(), session, lat, lng)
 	}
 
 	images := hanapi.GetImagesWithRange(session, lat, lng, start, end)
@@ -94,63 +180,173 @@ func (s *HanServer) reportImageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// for running locally with Javascript
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	mongo := hanapi.NewMongoInterface()
+	mongo := hanapi.WithContext(r.Context(), s.db.Copy())
 	defer mongo.Close()
 	// get the GET parameters
 	params := r.URL.Query()
 	// found strangeness passing in strings as parameters with mongo
 	id := fmt.Sprintf("%s", params.Get("id"))
 	reason := fmt.Sprintf("%s", params.Get("reason"))
-	hanapi.ReportImage(mongo, id, reason, s.logger)
+	if len(id) == 0 {
+		http.Error(w, "Invalid image ID", 400)
+		return
+	}
+	_, err := hanapi.ReportImage(mongo, id, reason, clientAddress(r), s.moderation,
+		reporting.FromContext(r.Context()))
+	if err == hanapi.ErrImageNotFound {
+		http.Error(w, "Image not found", 404)
+	}
+}
+
+// clientAddress identifies who made a request, so that each client's reports
+// are only counted once
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func getRegionHandler(w http.ResponseWriter, r *http.Request) {
+func (s *HanServer) getRegionHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Invalid request method.", 405)
 		return
 	}
 	// for running locally with Javascript
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	mongo := hanapi.NewMongoInterface()
+	mongo := hanapi.WithContext(r.Context(), s.db.Copy())
 	defer mongo.Close()
+	params := r.URL.Query()
+	// optionally only return regions near a location
+	lat, latErr := strconv.ParseFloat(params.Get("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(params.Get("lng"), 64)
+	if latErr == nil && lngErr == nil {
+		radius, err := strconv.ParseFloat(params.Get("radius"), 64)
+		if err != nil {
+			radius = hanapi.MaxRegionSize
+		}
+		json.NewEncoder(w).Encode(hanapi.GetRegionsWithin(mongo, lat, lng, radius))
+		return
+	}
 	// return regions as json
 	regions := hanapi.GetRegions(mongo)
 	json.NewEncoder(w).Encode(regions)
 }
 
-func configToString(path string) string {
-	buf := bytes.NewBuffer(nil)
-	f, err := os.Open(path)
-	defer f.Close()
+func main() {
+	configPath := kingpin.Arg("config", "Config file, settings can also be set using environment variables.").String()
+	address := kingpin.Flag("address", "Specify the address to listen on").String()
+	mongoURL := kingpin.Flag("mongo", "Specify the MongoDB URL").String()
+	noCollection := kingpin.Flag("no-collection", "Use this argument to stop hancollector being started automatically").Bool()
+	slackAPIToken := kingpin.Flag("slacktoken", "Specify the API token for logging through Slack").String()
+	adminToken := kingpin.Flag("admintoken", "Specify the bearer token required to use the admin endpoints").String()
+	partnersPath := kingpin.Flag("partners", "JSON file mapping partner names to the secrets used to push images").String()
+	kingpin.Parse()
+
+	load := func() (*settings.Config, error) {
+		return settings.Load(*configPath, func(c *settings.Config) {
+			settings.SetString(&c.HTTP.Address, *address)
+			settings.SetString(&c.Storage.MongoURL, *mongoURL)
+			settings.SetString(&c.Logging.SlackToken, *slackAPIToken)
+			settings.SetString(&c.HTTP.AdminToken, *adminToken)
+			settings.SetString(&c.HTTP.PartnersFile, *partnersPath)
+			c.HTTP.NoCollection = c.HTTP.NoCollection || *noCollection
+		})
+	}
+	c, err := load()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	io.Copy(buf, f)
+	stopTracing, err := c.Tracing.Start("hanhttpserver")
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	return string(buf.Bytes())
-}
-
-func main() {
-	configPath := kingpin.Arg("config", "Config file for data collection.").Required().String()
-	noCollection := kingpin.Flag("no-collection", "Use this argument to stop hancollector being started automatically").Bool()
-	slackAPIToken := kingpin.Flag("slacktoken", "Specify the API token for logging through Slack").String()
-	kingpin.Parse()
 
-	// parse config
-	config := configToString(*configPath)
-
-	server := NewHanServer(config, *noCollection, *slackAPIToken)
+	server, err := NewHanServer(c, load)
+	if err != nil {
+		fmt.Println(err)
+		stopTracing()
+		os.Exit(1)
+	}
+	// code without its own logger, such as the database, uses the server's
+	reporting.SetDefault(server.logger)
+	http.HandleFunc("/healthz", server.healthHandler)
+	http.HandleFunc("/readyz", server.readyHandler)
 	http.HandleFunc("/api/image-search", server.imageSearchHandler)
 	http.HandleFunc("/api/report-image", server.reportImageHandler)
-	http.HandleFunc("/api/get-regions", getRegionHandler)
+	http.HandleFunc("/api/get-regions", server.getRegionHandler)
+	http.HandleFunc("/api/ingest", server.ingestHandler)
+	http.HandleFunc("/api/admin/regions", server.adminHandler(server.regionsAdminHandler))
+	http.HandleFunc("/api/admin/quotas", server.adminHandler(server.quotasAdminHandler))
+	http.HandleFunc("/api/admin/collectors", server.adminHandler(server.collectorsAdminHandler))
+	http.HandleFunc("/api/admin/reload", server.adminHandler(server.reloadAdminHandler))
+	http.HandleFunc("/api/admin/region-stats", server.adminHandler(server.regionStatsAdminHandler))
+	http.HandleFunc("/api/admin/reports", server.adminHandler(server.reportsAdminHandler))
+	http.HandleFunc("/api/admin/moderation-log", server.adminHandler(server.moderationLogAdminHandler))
+	http.HandleFunc("/api/admin/storage", server.adminHandler(server.storageAdminHandler))
+	http.HandleFunc("/admin", server.dashboardHandler)
+	metrics.RegisterDatabaseSize(server.databaseSize)
+	if len(c.Metrics.Address) == 0 {
+		// the metrics include region names and quotas, and each scrape counts
+		// the images, so they're private like the admin endpoints
+		http.HandleFunc("/metrics", server.adminHandler(metrics.Handler().ServeHTTP))
+	}
+	// anything that isn't matched may be a local collector's photo
+	http.HandleFunc("/", server.localPhotosHandler)
 	srv := http.Server{
-		Addr:         ":80",
-		ReadTimeout:  2 * time.Minute,
-		WriteTimeout: 1 * time.Minute,
+		Addr:         c.HTTP.Address,
+		Handler:      server.logRequests(http.DefaultServeMux),
+		ReadTimeout:  settings.Seconds(c.HTTP.ReadTimeout),
+		WriteTimeout: settings.Seconds(c.HTTP.WriteTimeout),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// collectors are reloaded when the config file changes or on SIGHUP
+	go settings.Watch(ctx, *configPath, settings.WatchInterval, func() {
+		server.reloadCollectors()
+	})
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			server.reloadCollectors()
+		}
+	}()
+	if len(c.Metrics.Address) > 0 {
+		// metrics can be kept off the public address
+		go func() {
+			if err := metrics.Serve(ctx, c.Metrics.Address); err != nil {
+				server.logger.Log(reporting.Error, "Metrics server failed",
+					reporting.Fields{"error": err})
+			}
+		}()
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			server.logger.Log(reporting.Error, "Server failed", reporting.Fields{"error": err})
+			stopTracing()
+			server.logger.Close()
+			os.Exit(1)
+		}
+	}()
+	<-ctx.Done()
+	server.logger.Log(reporting.Info, "Shutting down", nil)
+	// stop accepting requests and wait for in-flight requests to finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(),
+		settings.Seconds(c.HTTP.ShutdownTimeout))
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		server.logger.Log(reporting.Warn, "Requests didn't finish before shutting down",
+			reporting.Fields{"error": err})
+	}
+	server.Close()
+	if err := stopTracing(); err != nil {
+		server.logger.Log(reporting.Warn, "Spans weren't exported before shutting down",
+			reporting.Fields{"error": err})
 	}
-	log.Fatal(srv.ListenAndServe())
+	// send any batched log entries
+	server.logger.Close()
 }